@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v53/github"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// appJWTLifetime stays below the ten minutes GitHub accepts.
+	appJWTLifetime = 9 * time.Minute
+	// installationTokenMargin renews installation tokens well before they
+	// expire, so a token handed out is good for a whole dependency.
+	installationTokenMargin = 5 * time.Minute
+)
+
+// Auth hands out GitHub credentials, either a static token or the tokens of
+// a GitHub App installation per owner.
+type Auth struct {
+	static oauth2.TokenSource
+	app    *githubApp
+
+	mu            sync.Mutex
+	installations map[string]oauth2.TokenSource
+}
+
+// authFromEnv configures the credentials from the action inputs. A GitHub App
+// (INPUT_GITHUB_APP_ID with INPUT_GITHUB_APP_PRIVATE_KEY or
+// INPUT_GITHUB_APP_PRIVATE_KEY_FILE) wins over a token from INPUT_GITHUB_TOKEN
+// or INPUT_GITHUB_TOKEN_FILE.
+func authFromEnv() (*Auth, error) {
+	auth := &Auth{installations: make(map[string]oauth2.TokenSource)}
+
+	if appID := os.Getenv("INPUT_GITHUB_APP_ID"); appID != "" {
+		key := []byte(os.Getenv("INPUT_GITHUB_APP_PRIVATE_KEY"))
+		if keyFile := os.Getenv("INPUT_GITHUB_APP_PRIVATE_KEY_FILE"); len(key) == 0 && keyFile != "" {
+			var err error
+			key, err = ioutil.ReadFile(keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("error reading GitHub App private key: %v", err)
+			}
+		}
+		app, err := newGitHubApp(appID, key)
+		if err != nil {
+			return nil, err
+		}
+		auth.app = app
+		return auth, nil
+	}
+
+	token := os.Getenv("INPUT_GITHUB_TOKEN")
+	if tokenFile := os.Getenv("INPUT_GITHUB_TOKEN_FILE"); token == "" && tokenFile != "" {
+		content, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading token file: %v", err)
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if token == "" {
+		return nil, errors.New("no GitHub credentials, set github_token, github_token_file or a GitHub App")
+	}
+	auth.static = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
+	return auth, nil
+}
+
+// TokenSource returns the credentials for the repos of owner. Installation
+// tokens are refreshed automatically.
+func (a *Auth) TokenSource(owner string) oauth2.TokenSource {
+	if a.app == nil {
+		return a.static
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ts, ok := a.installations[owner]
+	if !ok {
+		ts = oauth2.ReuseTokenSource(nil, &installationTokenSource{app: a.app, owner: owner})
+		a.installations[owner] = ts
+	}
+	return ts
+}
+
+// Token returns a token for the repos of owner.
+func (a *Auth) Token(owner string) (string, error) {
+	token, err := a.TokenSource(owner).Token()
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// githubApp signs the JWTs a GitHub App authenticates itself with.
+type githubApp struct {
+	id  int64
+	key *rsa.PrivateKey
+}
+
+func newGitHubApp(appID string, privateKey []byte) (*githubApp, error) {
+	id, err := strconv.ParseInt(appID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GitHub App ID %q", appID)
+	}
+
+	block, _ := pem.Decode(privateKey)
+	if block == nil {
+		return nil, errors.New("GitHub App private key is not PEM encoded")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err8 := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err8 != nil {
+			return nil, fmt.Errorf("error parsing GitHub App private key: %v", err)
+		}
+		var ok bool
+		if key, ok = parsed.(*rsa.PrivateKey); !ok {
+			return nil, errors.New("GitHub App private key is not an RSA key")
+		}
+	}
+	return &githubApp{id: id, key: key}, nil
+}
+
+// jwt returns a token signed with RS256 identifying the app.
+func (a *githubApp) jwt(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]int64{
+		// allow for clock drift between us and GitHub
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(appJWTLifetime).Unix(),
+		"iss": a.id,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// client returns a go-github client authenticated as the app itself.
+func (a *githubApp) client() *github.Client {
+	return github.NewClient(&http.Client{Transport: &appTransport{app: a, base: newGitHubTransport()}})
+}
+
+// appTransport signs every request with a fresh app JWT.
+type appTransport struct {
+	app  *githubApp
+	base http.RoundTripper
+}
+
+func (t *appTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	jwt, err := t.app.jwt(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	return t.base.RoundTrip(req)
+}
+
+// installationTokenSource mints tokens for the installation of the app on
+// owner.
+type installationTokenSource struct {
+	app   *githubApp
+	owner string
+
+	installationID int64
+}
+
+func (s *installationTokenSource) Token() (*oauth2.Token, error) {
+	ctx := context.Background()
+	client := s.app.client()
+
+	if s.installationID == 0 {
+		installation, _, err := client.Apps.FindUserInstallation(ctx, s.owner)
+		if err != nil {
+			var orgErr error
+			installation, _, orgErr = client.Apps.FindOrganizationInstallation(ctx, s.owner)
+			if orgErr != nil {
+				return nil, fmt.Errorf("GitHub App is not installed for %s: %v", s.owner, err)
+			}
+		}
+		s.installationID = installation.GetID()
+	}
+
+	token, _, err := client.Apps.CreateInstallationToken(ctx, s.installationID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating installation token for %s: %v", s.owner, err)
+	}
+	secrets.add(token.GetToken())
+	slog.Info("created GitHub App installation token", "owner", s.owner, "expires", token.GetExpiresAt().Format(time.RFC3339))
+
+	return &oauth2.Token{
+		AccessToken: token.GetToken(),
+		Expiry:      token.GetExpiresAt().Add(-installationTokenMargin),
+	}, nil
+}
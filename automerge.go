@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v53/github"
+)
+
+const (
+	updateTypeMajor = "major"
+	updateTypeMinor = "minor"
+	updateTypePatch = "patch"
+
+	mergeModeAuto   = "auto"
+	mergeModeDirect = "direct"
+
+	// defaultMergeTimeout is how long the direct mode leaves an update PR
+	// to its checks, runs are daily so it spans a few of them.
+	defaultMergeTimeout = 3 * 24 * time.Hour
+
+	// automergeLabel marks the PRs a direct merge policy merges in a later
+	// run, once their checks passed.
+	automergeLabel = "automerge"
+)
+
+// getUpdateType classifies the step from oldVersion to newVersion.
+func getUpdateType(oldVersion, newVersion string) string {
+	oldParts := strings.Split(extractVersion(oldVersion), ".")
+	newParts := strings.Split(extractVersion(newVersion), ".")
+	if len(oldParts) < 3 || len(newParts) < 3 || oldParts[0] != newParts[0] {
+		return updateTypeMajor
+	}
+	if oldParts[1] != newParts[1] {
+		return updateTypeMinor
+	}
+	return updateTypePatch
+}
+
+// allowsAutoMerge reports whether the policy merges updates of updateType.
+func (p *MergePolicy) allowsAutoMerge(updateType string) bool {
+	for _, t := range p.AutoMerge {
+		if t == updateType {
+			return true
+		}
+	}
+	return false
+}
+
+// applyMergePolicy auto-merges an update PR if the policy allows it for the
+// update type. Everything else is left for review.
+func applyMergePolicy(ctx context.Context, client *github.Client, owner, repo string, pr *github.PullRequest, policy *MergePolicy, updateType string) error {
+	if client == nil || pr == nil || policy == nil || !policy.allowsAutoMerge(updateType) {
+		return nil
+	}
+
+	mergeMethod := policy.MergeMethod
+	if mergeMethod == "" {
+		mergeMethod = "merge"
+	}
+
+	switch policy.Mode {
+	case mergeModeDirect:
+		timeout, err := policy.timeout()
+		if err != nil {
+			return err
+		}
+		return mergeWhenChecksPass(ctx, client, owner, repo, pr, mergeMethod, timeout)
+	case mergeModeAuto, "":
+		return enableAutoMerge(ctx, client, pr, mergeMethod)
+	default:
+		return fmt.Errorf("unknown merge mode %q", policy.Mode)
+	}
+}
+
+// timeout returns how long the direct mode waits for the checks of a PR.
+func (p *MergePolicy) timeout() (time.Duration, error) {
+	if p.Timeout == "" {
+		return defaultMergeTimeout, nil
+	}
+	timeout, err := parseAge(p.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid merge timeout %q: %v", p.Timeout, err)
+	}
+	return timeout, nil
+}
+
+// enableAutoMerge turns on GitHub auto-merge for the PR. This is only
+// available through the GraphQL API.
+func enableAutoMerge(ctx context.Context, client *github.Client, pr *github.PullRequest, mergeMethod string) error {
+	query := map[string]interface{}{
+		"query": `mutation($id: ID!, $method: PullRequestMergeMethod!) {
+  enablePullRequestAutoMerge(input: {pullRequestId: $id, mergeMethod: $method}) {
+    clientMutationId
+  }
+}`,
+		"variables": map[string]string{
+			"id":     pr.GetNodeID(),
+			"method": strings.ToUpper(mergeMethod),
+		},
+	}
+	body, err := json.Marshal(query)
+	if err != nil {
+		return err
+	}
+
+	graphqlURL := strings.TrimSuffix(client.BaseURL.String(), "/") + "/graphql"
+	if client.BaseURL.Host != "api.github.com" {
+		// GitHub Enterprise serves GraphQL next to /api/v3
+		graphqlURL = strings.TrimSuffix(strings.TrimSuffix(client.BaseURL.String(), "/"), "/v3") + "/graphql"
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", graphqlURL, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || len(result.Errors) > 0 {
+		var messages []string
+		for _, e := range result.Errors {
+			messages = append(messages, e.Message)
+		}
+		return fmt.Errorf("failed to enable auto-merge: %s %s", resp.Status, strings.Join(messages, "; "))
+	}
+
+	logger(ctx).Info("enabled auto-merge", "pull_request", pr.GetHTMLURL())
+	return nil
+}
+
+// requiredChecks returns the status check names required by branch
+// protection. Unprotected branches return nil, then every check counts.
+func requiredChecks(ctx context.Context, client *github.Client, owner, repo, branch string) ([]string, error) {
+	checks, resp, err := client.Repositories.GetRequiredStatusChecks(ctx, owner, repo, branch)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var names []string
+	names = append(names, checks.Contexts...)
+	for _, check := range checks.Checks {
+		names = append(names, check.Context)
+	}
+	return names, nil
+}
+
+// checkState summarizes the checks of a commit: "success", "failure" or
+// "pending". Without required checks a commit no check reported on is pending.
+func checkState(ctx context.Context, client *github.Client, owner, repo, sha string, required []string) (string, error) {
+	results := make(map[string]string)
+
+	checkRuns, _, err := client.Checks.ListCheckRunsForRef(ctx, owner, repo, sha, &github.ListCheckRunsOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, run := range checkRuns.CheckRuns {
+		switch {
+		case run.GetStatus() != "completed":
+			results[run.GetName()] = "pending"
+		case run.GetConclusion() == "success" || run.GetConclusion() == "skipped" || run.GetConclusion() == "neutral":
+			results[run.GetName()] = "success"
+		default:
+			results[run.GetName()] = "failure"
+		}
+	}
+
+	status, _, err := client.Repositories.GetCombinedStatus(ctx, owner, repo, sha, &github.ListOptions{PerPage: 100})
+	if err != nil {
+		return "", err
+	}
+	for _, s := range status.Statuses {
+		switch s.GetState() {
+		case "success":
+			results[s.GetContext()] = "success"
+		case "pending":
+			results[s.GetContext()] = "pending"
+		default:
+			results[s.GetContext()] = "failure"
+		}
+	}
+
+	if required == nil {
+		if len(results) == 0 {
+			// CI hasn't registered its checks yet, don't take that for a pass
+			return "pending", nil
+		}
+		for name := range results {
+			required = append(required, name)
+		}
+	}
+
+	state := "success"
+	for _, name := range required {
+		switch results[name] {
+		case "failure":
+			return "failure", nil
+		case "success":
+		default:
+			// a required check that hasn't reported yet is pending as well
+			state = "pending"
+		}
+	}
+	return state, nil
+}
+
+// mergeWhenChecksPass merges the PR if all required checks succeeded. A PR
+// with pending checks is labelled for a later run to merge, a failing check
+// or one still pending after timeout leaves it for review.
+func mergeWhenChecksPass(ctx context.Context, client *github.Client, owner, repo string, pr *github.PullRequest, mergeMethod string, timeout time.Duration) error {
+	required, err := requiredChecks(ctx, client, owner, repo, pr.GetBase().GetRef())
+	if err != nil {
+		return err
+	}
+	state, err := checkState(ctx, client, owner, repo, pr.GetHead().GetSHA(), required)
+	if err != nil {
+		return err
+	}
+	labelled := hasLabel(pr, automergeLabel)
+
+	switch {
+	case state == "success":
+		_, _, err := client.PullRequests.Merge(ctx, owner, repo, pr.GetNumber(), "", &github.PullRequestOptions{
+			SHA:         pr.GetHead().GetSHA(),
+			MergeMethod: mergeMethod,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to merge pull request: %v", err)
+		}
+		logger(ctx).Info("merged pull request", "pull_request", pr.GetHTMLURL())
+		return nil
+	case state == "failure":
+		logger(ctx).Info("checks failed, leaving it for review", "pull_request", pr.GetHTMLURL())
+	case time.Since(pr.GetCreatedAt().Time) > timeout:
+		logger(ctx).Info("checks still pending, leaving it for review", "pull_request", pr.GetHTMLURL(), "timeout", timeout.String())
+	case labelled:
+		return nil
+	default:
+		logger(ctx).Info("checks pending, merging it in a later run", "pull_request", pr.GetHTMLURL())
+		return labelPullRequest(ctx, client, owner, repo, pr, automergeLabel)
+	}
+
+	if labelled {
+		if _, err := client.Issues.RemoveLabelForIssue(ctx, owner, repo, pr.GetNumber(), automergeLabel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasLabel reports whether the PR carries label.
+func hasLabel(pr *github.PullRequest, label string) bool {
+	for _, l := range pr.Labels {
+		if l.GetName() == label {
+			return true
+		}
+	}
+	return false
+}
+
+// updateBranchRe matches the branches of the update PRs of a dependency.
+func updateBranchRe(name string) *regexp.Regexp {
+	name = regexp.QuoteMeta(name)
+	return regexp.MustCompile(`^(update-` + name + `-to-|update-` + name + `-subcharts-|refresh-` + name + `-digest-)`)
+}
+
+// mergeWaitingPullRequests merges the update PRs of the dependency name an
+// earlier run labelled for a direct merge, once their checks passed.
+func mergeWaitingPullRequests(ctx context.Context, client *github.Client, owner, repo, name string, policy *MergePolicy) error {
+	if client == nil || policy == nil || policy.Mode != mergeModeDirect {
+		return nil
+	}
+	timeout, err := policy.timeout()
+	if err != nil {
+		return err
+	}
+	mergeMethod := policy.MergeMethod
+	if mergeMethod == "" {
+		mergeMethod = "merge"
+	}
+
+	issues, _, err := client.Issues.ListByRepo(ctx, owner, repo, &github.IssueListByRepoOptions{
+		State:       "open",
+		Labels:      []string{automergeLabel},
+		ListOptions: github.ListOptions{PerPage: 100},
+	})
+	if err != nil {
+		return err
+	}
+	branches := updateBranchRe(name)
+	for _, issue := range issues {
+		if !issue.IsPullRequest() {
+			continue
+		}
+		pr, _, err := client.PullRequests.Get(ctx, owner, repo, issue.GetNumber())
+		if err != nil {
+			return err
+		}
+		if !branches.MatchString(pr.GetHead().GetRef()) {
+			continue
+		}
+		if err := mergeWhenChecksPass(ctx, client, owner, repo, pr, mergeMethod, timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
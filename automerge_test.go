@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v53/github"
+)
+
+func TestCheckState(t *testing.T) {
+	tests := []struct {
+		name      string
+		checkRuns string
+		statuses  string
+		required  []string
+		want      string
+	}{
+		{"no checks reported", `[]`, `[]`, nil, "pending"},
+		{"all passed", `[{"name":"test","status":"completed","conclusion":"success"}]`, `[{"context":"lint","state":"success"}]`, nil, "success"},
+		{"running", `[{"name":"test","status":"in_progress"}]`, `[]`, nil, "pending"},
+		{"failed", `[{"name":"test","status":"completed","conclusion":"failure"}]`, `[]`, nil, "failure"},
+		{"required missing", `[{"name":"test","status":"completed","conclusion":"success"}]`, `[]`, []string{"test", "e2e"}, "pending"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/repos/owner/values/commits/abc/check-runs", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"check_runs":%s}`, tt.checkRuns)
+			})
+			mux.HandleFunc("/repos/owner/values/commits/abc/status", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"statuses":%s}`, tt.statuses)
+			})
+			server := httptest.NewServer(mux)
+			defer server.Close()
+			client := github.NewClient(nil)
+			client.BaseURL, _ = url.Parse(server.URL + "/")
+
+			got, err := checkState(context.Background(), client, "owner", "values", "abc", tt.required)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("state %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeWhenChecksPass(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   string
+		labels  string
+		created time.Time
+		want    string
+	}{
+		{name: "passed", state: "success", created: time.Now(), want: "merge"},
+		{name: "pending", state: "pending", created: time.Now(), want: "label"},
+		{name: "pending and labelled", state: "pending", labels: `[{"name":"automerge"}]`, created: time.Now(), want: ""},
+		{name: "pending too long", state: "pending", labels: `[{"name":"automerge"}]`, created: time.Now().Add(-4 * 24 * time.Hour), want: "unlabel"},
+		{name: "failed", state: "failure", labels: `[{"name":"automerge"}]`, created: time.Now(), want: "unlabel"},
+		{name: "failed without label", state: "failure", created: time.Now(), want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			mux := http.NewServeMux()
+			mux.HandleFunc("/repos/owner/values/branches/main/protection/required_status_checks", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+			})
+			mux.HandleFunc("/repos/owner/values/commits/abc/check-runs", func(w http.ResponseWriter, r *http.Request) {
+				if tt.state == "pending" {
+					fmt.Fprint(w, `{"check_runs":[{"name":"test","status":"in_progress"}]}`)
+					return
+				}
+				fmt.Fprintf(w, `{"check_runs":[{"name":"test","status":"completed","conclusion":%q}]}`, tt.state)
+			})
+			mux.HandleFunc("/repos/owner/values/commits/abc/status", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `{"statuses":[]}`)
+			})
+			mux.HandleFunc("/repos/owner/values/pulls/7/merge", func(w http.ResponseWriter, r *http.Request) {
+				got = append(got, "merge")
+				fmt.Fprint(w, `{"merged":true}`)
+			})
+			mux.HandleFunc("/repos/owner/values/issues/7/labels", func(w http.ResponseWriter, r *http.Request) {
+				got = append(got, "label")
+				fmt.Fprint(w, `[{"name":"automerge"}]`)
+			})
+			mux.HandleFunc("/repos/owner/values/issues/7/labels/automerge", func(w http.ResponseWriter, r *http.Request) {
+				got = append(got, "unlabel")
+			})
+			server := httptest.NewServer(mux)
+			defer server.Close()
+			client := github.NewClient(nil)
+			client.BaseURL, _ = url.Parse(server.URL + "/")
+
+			var pr github.PullRequest
+			labels := tt.labels
+			if labels == "" {
+				labels = "[]"
+			}
+			if err := json.Unmarshal([]byte(fmt.Sprintf(`{"number":7,"head":{"sha":"abc"},"base":{"ref":"main"},"labels":%s}`, labels)), &pr); err != nil {
+				t.Fatal(err)
+			}
+			pr.CreatedAt = &github.Timestamp{Time: tt.created}
+
+			if err := mergeWhenChecksPass(context.Background(), client, "owner", "values", &pr, "squash", defaultMergeTimeout); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("did %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateBranchRe(t *testing.T) {
+	re := updateBranchRe("sonarr")
+	for branch, want := range map[string]bool{
+		"update-sonarr-to-4.0.1":          true,
+		"update-sonarr-subcharts-0a1b2c":  true,
+		"refresh-sonarr-digest-0a1b2c":    true,
+		"update-sonarr-exporter-to-0.2.0": false,
+		"update-radarr-to-5.0.0":          false,
+	} {
+		if got := re.MatchString(branch); got != want {
+			t.Errorf("%s: got %v, want %v", branch, got, want)
+		}
+	}
+}
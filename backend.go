@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/google/go-github/v53/github"
+)
+
+const (
+	backendGitHub = "github"
+	backendGit    = "git"
+)
+
+// Backend reads the files of a target and proposes changes to them.
+type Backend interface {
+	// ReadFile returns the content of a file on the base branch of t.
+	ReadFile(ctx context.Context, t Target, path string) ([]byte, error)
+	// Propose commits files on top of the base branch of t. With a Branch
+	// the commit goes to that new branch and is proposed for review, the
+	// pull request is nil if the backend can't open one. Without a Branch the
+	// commit goes to the base branch itself.
+	Propose(ctx context.Context, t Target, change Change) (*github.PullRequest, error)
+}
+
+// Change is a commit proposed to a target.
+type Change struct {
+	Branch    string
+	Message   string
+	Title     string
+	Body      string
+	Files     map[string][]byte
+	Committer *github.CommitAuthor
+}
+
+// paths returns the changed paths sorted, so commits are reproducible.
+func (c Change) paths() []string {
+	paths := make([]string, 0, len(c.Files))
+	for p := range c.Files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// targetBackend returns the backend writing to t. For GitHub targets it also
+// returns the client for labels and merge policies, the other backends
+// return a nil client.
+func targetBackend(ctx context.Context, auth *Auth, t Target) (Backend, *github.Client, error) {
+	switch t.Backend {
+	case "", backendGitHub:
+		client := newGitHubClientWithTokenSource(ctx, auth.TokenSource(t.Owner))
+		return &githubBackend{client: client}, client, nil
+	case backendGit:
+		backend, err := newGitBackend(ctx, auth, t)
+		return backend, nil, err
+	case backendGitea, backendForgejo:
+		backend, err := newGiteaBackend(t)
+		return backend, nil, err
+	case backendGitLab:
+		backend, err := newGitLabBackend(t)
+		return backend, nil, err
+	}
+	return nil, nil, fmt.Errorf("unknown backend %q for %s/%s", t.Backend, t.Owner, t.Repo)
+}
+
+// githubBackend proposes changes through the GitHub API as pull requests.
+type githubBackend struct {
+	client *github.Client
+}
+
+func (b *githubBackend) ReadFile(ctx context.Context, t Target, path string) ([]byte, error) {
+	fileContent, _, _, err := b.client.Repositories.GetContents(ctx, t.Owner, t.Repo, path, &github.RepositoryContentGetOptions{
+		Ref: t.Branch,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if fileContent == nil {
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+
+	// Decode the file content from base64
+	content, err := fileContent.GetContent()
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", path, err)
+	}
+	return []byte(content), nil
+}
+
+func (b *githubBackend) Propose(ctx context.Context, t Target, change Change) (*github.PullRequest, error) {
+	client := b.client
+
+	// Get the latest commit object for the branch
+	ref, _, err := client.Git.GetRef(ctx, t.Owner, t.Repo, "refs/heads/"+t.Branch)
+	if err != nil {
+		return nil, fmt.Errorf("error getting ref: %w", err)
+	}
+	parentSHA := ref.Object.GetSHA()
+
+	// Create a blob object for every updated file
+	var entries []*github.TreeEntry
+	for _, p := range change.paths() {
+		newBlob, _, err := client.Git.CreateBlob(ctx, t.Owner, t.Repo, &github.Blob{
+			Content:  github.String(string(change.Files[p])),
+			Encoding: github.String("utf-8"),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error creating blob: %v", err)
+		}
+		entries = append(entries, &github.TreeEntry{
+			Path: github.String(p),
+			Mode: github.String("100644"),
+			Type: github.String("blob"),
+			SHA:  newBlob.SHA,
+		})
+	}
+
+	// Create a new tree object with the updated files
+	newTree, _, err := client.Git.CreateTree(ctx, t.Owner, t.Repo, parentSHA, entries)
+	if err != nil {
+		return nil, fmt.Errorf("error creating tree: %v", err)
+	}
+
+	// Create a new commit object with the updated tree object
+	newCommit, _, err := client.Git.CreateCommit(ctx, t.Owner, t.Repo, &github.Commit{
+		Message:   github.String(change.Message),
+		Tree:      newTree,
+		Parents:   []*github.Commit{{SHA: &parentSHA}},
+		Author:    change.Committer,
+		Committer: change.Committer,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating commit: %v", err)
+	}
+
+	if change.Branch == "" {
+		// no force, a concurrent push makes us fail instead of dropping it
+		_, _, err = client.Git.UpdateRef(ctx, t.Owner, t.Repo, &github.Reference{
+			Ref:    github.String("refs/heads/" + t.Branch),
+			Object: &github.GitObject{SHA: newCommit.SHA},
+		}, false)
+		if err != nil {
+			return nil, fmt.Errorf("error updating reference: %v", err)
+		}
+		logger(ctx).Info("committed", "sha", newCommit.GetSHA(), "repo", t.Owner+"/"+t.Repo, "branch", t.Branch)
+		return nil, nil
+	}
+
+	// Create a new reference for the updated commit
+	newBranch := "refs/heads/" + change.Branch
+	_, _, err = client.Git.CreateRef(ctx, t.Owner, t.Repo, &github.Reference{
+		Ref:    github.String(newBranch),
+		Object: &github.GitObject{SHA: newCommit.SHA},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating reference: %v", err)
+	}
+
+	// Create a pull request with the changes
+	newPR, _, err := client.PullRequests.Create(ctx, t.Owner, t.Repo, &github.NewPullRequest{
+		Title: github.String(change.Title),
+		Body:  github.String(change.Body),
+		Head:  github.String(newBranch),
+		Base:  github.String(t.Branch),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pull request: %v", err)
+	}
+
+	logger(ctx).Info("created pull request", "pull_request", newPR.GetHTMLURL())
+	return newPR, nil
+}
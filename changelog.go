@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Release is the subset of a GitHub release we use for changelogs.
+type Release struct {
+	TagName     string    `json:"tag_name"`
+	Name        string    `json:"name"`
+	Body        string    `json:"body"`
+	HTMLURL     string    `json:"html_url"`
+	PublishedAt time.Time `json:"published_at"`
+	Draft       bool      `json:"draft"`
+	Prerelease  bool      `json:"prerelease"`
+}
+
+// URL links the release notes, empty without a release.
+func (r *Release) URL() string {
+	if r == nil {
+		return ""
+	}
+	return r.HTMLURL
+}
+
+// ArtifactHubLink is a link attached to an artifacthub.io/changes entry.
+type ArtifactHubLink struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+}
+
+// ArtifactHubChange is one entry of the artifacthub.io/changes annotation.
+type ArtifactHubChange struct {
+	Kind        string            `yaml:"kind"`
+	Description string            `yaml:"description"`
+	Links       []ArtifactHubLink `yaml:"links,omitempty"`
+}
+
+// maxReleaseChanges caps how many items of the upstream release notes end up
+// in the annotation, some projects ship hundreds of lines per release.
+const maxReleaseChanges = 25
+
+// githubAPIURL is where the GitHub REST API is served.
+var githubAPIURL = "https://api.github.com"
+
+// maxReleasePages caps how many pages of releases listReleases reads.
+const maxReleasePages = 5
+
+// listReleases returns the stable releases of a GitHub repository, newest
+// first. Repositories that only push tags return no releases. It reads
+// further pages until reached returns true for a release, complete is false
+// if it stopped at maxReleasePages before that.
+func listReleases(owner, repo, token string, reached func(Release) bool) (stable []Release, complete bool, err error) {
+	url := fmt.Sprintf("%s/repos/%s/%s/releases?per_page=50", githubAPIURL, owner, repo)
+	client := newGitHubHTTPClient()
+	for page := 0; url != ""; page++ {
+		if page == maxReleasePages {
+			return stable, false, nil
+		}
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, false, err
+		}
+		req.Header.Set("Authorization", "token "+token)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, false, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, false, fmt.Errorf("failed to list releases: %w", newStatusError(resp, ""))
+		}
+
+		var releases []Release
+		err = json.NewDecoder(resp.Body).Decode(&releases)
+		resp.Body.Close()
+		if err != nil {
+			return nil, false, err
+		}
+
+		done := false
+		for _, release := range releases {
+			if release.Draft || release.Prerelease {
+				continue
+			}
+			stable = append(stable, release)
+			done = done || reached(release)
+		}
+		if done {
+			break
+		}
+		url = nextPageURL(resp.Header.Get("Link"))
+	}
+	return stable, true, nil
+}
+
+// nextPageRe matches the next page of a Link header.
+var nextPageRe = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// nextPageURL returns the next page of a GitHub Link header, empty on the
+// last page.
+func nextPageURL(link string) string {
+	if m := nextPageRe.FindStringSubmatch(link); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+var (
+	releaseHeadingRe = regexp.MustCompile(`^#{1,6}\s+(.+)$`)
+	releaseBulletRe  = regexp.MustCompile(`^\s{0,3}[-*+]\s+(.+)$`)
+	markdownLinkRe   = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+)
+
+// changeKinds is checked in order, so a "security fix" ends up as security
+// and not as fixed.
+var changeKinds = []struct {
+	kind string
+	re   *regexp.Regexp
+}{
+	{"security", regexp.MustCompile(`\bsecurity\b|\bcve-\d`)},
+	{"deprecated", regexp.MustCompile(`deprecat`)},
+	{"removed", regexp.MustCompile(`\b(remove[ds]?|drop(s|ped)?)\b`)},
+	{"fixed", regexp.MustCompile(`\b(fix(es|ed)?|bugs?|bugfix(es)?)\b`)},
+	{"added", regexp.MustCompile(`\b(adds?|added|feat|features?|new)\b`)},
+	{"changed", regexp.MustCompile(`\b(chang(e|es|ed)|improve(d|ments?)?|update[ds]?|enhancements?)\b`)},
+}
+
+// classifyChange maps a release notes heading or line to an Artifact Hub
+// change kind. It returns an empty string if nothing matches.
+func classifyChange(text string) string {
+	text = strings.ToLower(text)
+	for _, k := range changeKinds {
+		if k.re.MatchString(text) {
+			return k.kind
+		}
+	}
+	return ""
+}
+
+// parseReleaseChanges turns the bullet points of a markdown release body into
+// Artifact Hub changes. The kind is taken from the enclosing heading, e.g.
+// "### Bug Fixes", or from the line itself when the heading says nothing.
+func parseReleaseChanges(release *Release) []ArtifactHubChange {
+	var changes []ArtifactHubChange
+	if release == nil {
+		return changes
+	}
+
+	sectionKind := ""
+	for _, line := range strings.Split(strings.Replace(release.Body, "\r\n", "\n", -1), "\n") {
+		if m := releaseHeadingRe.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			sectionKind = classifyChange(m[1])
+			continue
+		}
+
+		m := releaseBulletRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		description := strings.TrimSpace(markdownLinkRe.ReplaceAllString(m[1], "$1"))
+		description = strings.Replace(description, "**", "", -1)
+		if description == "" {
+			continue
+		}
+
+		// a security note always wins over the section it is listed in
+		kind := classifyChange(description)
+		if sectionKind != "" && kind != "security" {
+			kind = sectionKind
+		}
+		if kind == "" {
+			kind = "changed"
+		}
+
+		change := ArtifactHubChange{Kind: kind, Description: description}
+		if release.HTMLURL != "" {
+			change.Links = []ArtifactHubLink{{Name: "Release " + release.TagName, URL: release.HTMLURL}}
+		}
+		changes = append(changes, change)
+
+		if len(changes) == maxReleaseChanges {
+			break
+		}
+	}
+
+	return changes
+}
+
+// buildChartChanges combines our own entry, the bumped subcharts and the
+// upstream release notes into the artifacthub.io/changes list. Without an
+// appVersion only the subcharts are listed.
+func buildChartChanges(appVersion string, depUpdates []DependencyUpdate, release *Release) []ArtifactHubChange {
+	var changes []ArtifactHubChange
+	if appVersion != "" {
+		own := ArtifactHubChange{
+			Kind:        "changed",
+			Description: fmt.Sprintf("updated to %s", appVersion),
+		}
+		if release != nil && release.HTMLURL != "" {
+			own.Links = []ArtifactHubLink{{Name: "Upstream release", URL: release.HTMLURL}}
+		}
+		changes = append(changes, own)
+	}
+	for _, update := range depUpdates {
+		changes = append(changes, ArtifactHubChange{
+			Kind:        "changed",
+			Description: fmt.Sprintf("updated dependency %s from %s to %s", update.Name, update.OldVersion, update.NewVersion),
+		})
+	}
+	return append(changes, parseReleaseChanges(release)...)
+}
+
+// renderChartChanges renders changes as the yaml list Artifact Hub expects in
+// the artifacthub.io/changes annotation.
+func renderChartChanges(changes []ArtifactHubChange) (string, error) {
+	out, err := yaml.Marshal(changes)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClassifyChange(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Security fix for CVE-2023-1234", "security"},
+		{"fix cve-2023-1234", "security"},
+		{"Deprecations", "deprecated"},
+		{"Deprecated the old API", "deprecated"},
+		{"Removed support for Go 1.19", "removed"},
+		{"drop arm/v6 images", "removed"},
+		{"Bug Fixes", "fixed"},
+		{"fixes a crash on startup", "fixed"},
+		{"New Features", "added"},
+		{"feat: add an option", "added"},
+		{"Improvements", "changed"},
+		{"updated translations", "changed"},
+		{"Contributors", ""},
+		// words only count whole
+		{"prefix the newest", ""},
+		{"affixed labels", ""},
+	}
+	for _, tt := range tests {
+		if got := classifyChange(tt.text); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseReleaseChanges(t *testing.T) {
+	link := []ArtifactHubLink{{Name: "Release v1.2.0", URL: "https://github.com/owner/repo/releases/tag/v1.2.0"}}
+	tests := []struct {
+		name string
+		body string
+		want []ArtifactHubChange
+	}{
+		{
+			name: "sections",
+			body: "## What's Changed\r\n### Features\r\n- add **dark mode** by @alice in [#12](https://github.com/owner/repo/pull/12)\r\n### Bug Fixes\r\n* fix login\r\n* Security: bump openssl\r\n",
+			want: []ArtifactHubChange{
+				{Kind: "added", Description: "add dark mode by @alice in #12", Links: link},
+				{Kind: "fixed", Description: "fix login", Links: link},
+				{Kind: "security", Description: "Security: bump openssl", Links: link},
+			},
+		},
+		{
+			name: "kind from the line",
+			body: "Thanks to everyone!\n\n- removed the legacy importer\n- something else\n    - deeper nested notes are skipped\n",
+			want: []ArtifactHubChange{
+				{Kind: "removed", Description: "removed the legacy importer", Links: link},
+				{Kind: "changed", Description: "something else", Links: link},
+			},
+		},
+		{
+			name: "empty bullets",
+			body: "- \n- **\n",
+		},
+		{
+			name: "no bullets",
+			body: "Just a paragraph about the release.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := &Release{TagName: "v1.2.0", HTMLURL: "https://github.com/owner/repo/releases/tag/v1.2.0", Body: tt.body}
+			if got := parseReleaseChanges(release); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("no release", func(t *testing.T) {
+		if got := parseReleaseChanges(nil); len(got) != 0 {
+			t.Errorf("got %+v", got)
+		}
+	})
+	t.Run("capped", func(t *testing.T) {
+		var body strings.Builder
+		for i := 0; i < 2*maxReleaseChanges; i++ {
+			fmt.Fprintf(&body, "- change %d\n", i)
+		}
+		got := parseReleaseChanges(&Release{TagName: "v1.2.0", Body: body.String()})
+		if len(got) != maxReleaseChanges || got[0].Links != nil {
+			t.Errorf("got %d changes, links %v", len(got), got[0].Links)
+		}
+	})
+}
+
+func TestBuildChartChanges(t *testing.T) {
+	release := &Release{TagName: "v1.2.0", HTMLURL: "https://github.com/owner/repo/releases/tag/v1.2.0", Body: "### Fixes\n- fix login"}
+	updates := []DependencyUpdate{{Name: "postgresql", OldVersion: "12.5.6", NewVersion: "13.0.0"}}
+
+	got := buildChartChanges("1.2.0", updates, release)
+	want := []ArtifactHubChange{
+		{Kind: "changed", Description: "updated to 1.2.0", Links: []ArtifactHubLink{{Name: "Upstream release", URL: release.HTMLURL}}},
+		{Kind: "changed", Description: "updated dependency postgresql from 12.5.6 to 13.0.0"},
+		{Kind: "fixed", Description: "fix login", Links: []ArtifactHubLink{{Name: "Release v1.2.0", URL: release.HTMLURL}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// subchart updates without an app update
+	got = buildChartChanges("", updates, nil)
+	if !reflect.DeepEqual(got, want[1:2]) {
+		t.Errorf("got %+v, want %+v", got, want[1:2])
+	}
+
+	rendered, err := renderChartChanges(want[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRendered := `- kind: changed
+  description: updated to 1.2.0
+  links:
+  - name: Upstream release
+    url: https://github.com/owner/repo/releases/tag/v1.2.0
+- kind: changed
+  description: updated dependency postgresql from 12.5.6 to 13.0.0
+`
+	if rendered != wantRendered {
+		t.Errorf("rendered\n%s\nwant\n%s", rendered, wantRendered)
+	}
+}
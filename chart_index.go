@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// chartIndexTimeout bounds the download of an index, the Bitnami one is tens
+// of megabytes.
+const chartIndexTimeout = 2 * time.Minute
+
+var (
+	chartIndexClientOnce sync.Once
+	chartIndexClient     *http.Client
+)
+
+// newChartIndexClient returns the client for chart indexes. Indexes are kept
+// in the disk cache and only downloaded again when they changed.
+func newChartIndexClient() *http.Client {
+	chartIndexClientOnce.Do(func() {
+		caching := &cachingTransport{}
+
+		dir := os.Getenv("INPUT_CACHE_DIR")
+		if dir == "" {
+			dir = defaultCacheDir
+		}
+		cache, err := newDiskCache(filepath.Join(dir, "indexes"))
+		if err != nil {
+			slog.Warn("not caching chart indexes", "error", err)
+		} else {
+			caching.cache = cache
+		}
+
+		chartIndexClient = &http.Client{Transport: caching, Timeout: chartIndexTimeout}
+	})
+	return chartIndexClient
+}
+
+// chartIndexFetch is a single download of an index shared by every chart
+// looked up in it.
+type chartIndexFetch struct {
+	once    sync.Once
+	started bool
+	names   map[string]bool
+	entries map[string][]ChartVersion
+	err     error
+}
+
+// chartIndexes holds the fetches of this run by index URL. Charts wanted once
+// a download started, like the subcharts of a chart, wait for the next one.
+var chartIndexes = struct {
+	sync.Mutex
+	fetches map[string][]*chartIndexFetch
+}{fetches: make(map[string][]*chartIndexFetch)}
+
+// wantChartIndex announces that the charts will be looked up in the index at
+// url, so a single download can serve all of them.
+func wantChartIndex(url string, chartNames ...string) {
+	chartIndexes.Lock()
+	defer chartIndexes.Unlock()
+	for _, chartName := range chartNames {
+		chartIndexFetchOf(url, chartName)
+	}
+}
+
+// chartIndexFetchOf returns the fetch of url serving chartName, joining the
+// pending one if it isn't. chartIndexes has to be locked.
+func chartIndexFetchOf(url, chartName string) *chartIndexFetch {
+	fetches := chartIndexes.fetches[url]
+	for _, f := range fetches {
+		if f.names[chartName] {
+			return f
+		}
+	}
+	if n := len(fetches); n > 0 && !fetches[n-1].started {
+		fetches[n-1].names[chartName] = true
+		return fetches[n-1]
+	}
+	f := &chartIndexFetch{names: map[string]bool{chartName: true}}
+	chartIndexes.fetches[url] = append(fetches, f)
+	return f
+}
+
+// chartIndexEntries returns the versions of a chart listed in the index at
+// url, newest first as in the index.
+func chartIndexEntries(url, chartName string) ([]ChartVersion, error) {
+	chartIndexes.Lock()
+	f := chartIndexFetchOf(url, chartName)
+	f.started = true
+	chartIndexes.Unlock()
+
+	f.once.Do(func() {
+		f.entries, f.err = fetchChartIndex(url, f.names)
+	})
+	if f.err != nil {
+		return nil, f.err
+	}
+	return lookupChart(f.entries, chartName)
+}
+
+func lookupChart(entries map[string][]ChartVersion, chartName string) ([]ChartVersion, error) {
+	versions, ok := entries[chartName]
+	if !ok {
+		return nil, fmt.Errorf("chart %s not found", chartName)
+	}
+	return versions, nil
+}
+
+// fetchChartIndex downloads an index and decodes the entries of the given
+// charts only.
+func fetchChartIndex(url string, names map[string]bool) (map[string][]ChartVersion, error) {
+	resp, err := newChartIndexClient().Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get chart index: %w", newStatusError(resp, ""))
+	}
+
+	entries, err := parseChartIndex(bufio.NewReader(resp.Body), names)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing chart index %s: %v", url, err)
+	}
+	return entries, nil
+}
+
+// parseChartIndex streams through an index.yaml and decodes the entries of
+// the wanted charts. Helm writes the entries as a block mapping, so the
+// section of a chart runs from its key under "entries:" to the next key at
+// the same indentation.
+func parseChartIndex(r *bufio.Reader, names map[string]bool) (map[string][]ChartVersion, error) {
+	entries := make(map[string][]ChartVersion)
+
+	inEntries := false
+	indent := -1
+	current := ""
+	var section bytes.Buffer
+
+	flush := func() error {
+		if current == "" {
+			return nil
+		}
+		var versions []ChartVersion
+		if err := yaml.Unmarshal(section.Bytes(), &versions); err != nil {
+			return fmt.Errorf("chart %s: %v", current, err)
+		}
+		entries[current] = versions
+		current = ""
+		section.Reset()
+		return nil
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if len(line) > 0 {
+			trimmed := strings.TrimLeft(line, " ")
+			lineIndent := len(line) - len(trimmed)
+			blank := strings.TrimSpace(trimmed) == "" || strings.HasPrefix(trimmed, "#")
+
+			switch {
+			case blank:
+				if current != "" {
+					section.WriteString(line)
+				}
+			case lineIndent == 0:
+				// a top level key ends the entries
+				if err := flush(); err != nil {
+					return nil, err
+				}
+				inEntries = strings.HasPrefix(trimmed, "entries:")
+			case inEntries && (indent == -1 || lineIndent == indent) && !strings.HasPrefix(trimmed, "- "):
+				if err := flush(); err != nil {
+					return nil, err
+				}
+				indent = lineIndent
+				name := strings.Trim(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(trimmed), ":")), `"'`)
+				if names[name] {
+					current = name
+				}
+			case current != "" && lineIndent >= indent:
+				// drop the indentation of the chart key, helm lists the
+				// versions at the same indentation as their key
+				section.WriteString(line[indent:])
+			case current != "":
+				section.WriteString(trimmed)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	if indent == -1 {
+		return nil, fmt.Errorf("no entries found")
+	}
+	return entries, nil
+}
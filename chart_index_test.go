@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseChartIndex(t *testing.T) {
+	tests := []struct {
+		name  string
+		index string
+		want  map[string][]string
+	}{
+		{
+			name: "helm layout",
+			index: `apiVersion: v1
+entries:
+  grafana:
+  - appVersion: 10.1.0
+    name: grafana
+    version: 7.0.1
+  - appVersion: 10.0.0
+    name: grafana
+    version: 7.0.0
+  loki:
+  - appVersion: 2.9.0
+    version: 5.0.0
+generated: "2023-09-01T00:00:00Z"
+`,
+			want: map[string][]string{"grafana": {"7.0.1 10.1.0", "7.0.0 10.0.0"}},
+		},
+		{
+			name: "chart-releaser layout",
+			index: `apiVersion: v1
+entries:
+    grafana:
+        - appVersion: 10.1.0
+          version: 7.0.1
+        - appVersion: 10.0.0
+          version: 7.0.0
+    loki:
+        - version: 5.0.0
+generated: "2023-09-01T00:00:00Z"
+`,
+			want: map[string][]string{"grafana": {"7.0.1 10.1.0", "7.0.0 10.0.0"}},
+		},
+		{
+			name: "quoted keys",
+			index: `entries:
+  "grafana":
+  - appVersion: 10.1.0
+    version: 7.0.1
+  'loki':
+  - version: 5.0.0
+`,
+			want: map[string][]string{"grafana": {"7.0.1 10.1.0"}},
+		},
+		{
+			name: "block scalars with blank lines",
+			index: `entries:
+  grafana:
+  - appVersion: 10.1.0
+    description: |
+      The leading tool for querying and visualizing time series.
+
+      grafana:
+      - not a chart
+
+    version: 7.0.1
+  - appVersion: 10.0.0
+    version: 7.0.0
+  loki:
+  - version: 5.0.0
+`,
+			want: map[string][]string{"grafana": {"7.0.1 10.1.0", "7.0.0 10.0.0"}},
+		},
+		{
+			name: "chart missing",
+			index: `entries:
+  loki:
+  - version: 5.0.0
+`,
+			want: map[string][]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := parseChartIndex(bufio.NewReader(strings.NewReader(tt.index)), map[string]bool{"grafana": true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string][]string)
+			for name, versions := range entries {
+				for _, v := range versions {
+					got[name] = append(got[name], strings.TrimSpace(v.Version+" "+v.AppVersion))
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if _, err := lookupChart(entries, "grafana"); (err != nil) != (len(tt.want) == 0) {
+				t.Errorf("lookup grafana: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseChartIndexWithoutEntries(t *testing.T) {
+	_, err := parseChartIndex(bufio.NewReader(strings.NewReader("apiVersion: v1\n")), map[string]bool{"grafana": true})
+	if err == nil {
+		t.Error("no error for an index without entries")
+	}
+}
+
+func TestChartIndexEntriesShareDownloads(t *testing.T) {
+	t.Setenv("INPUT_CACHE_DIR", t.TempDir())
+	index := `entries:
+  grafana:
+  - version: 7.0.1
+  loki:
+  - version: 5.0.0
+  tempo:
+  - version: 1.0.0
+`
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/index.yaml" {
+			http.NotFound(w, r)
+			return
+		}
+		downloads++
+		w.Write([]byte(index))
+	}))
+	defer server.Close()
+	url := server.URL + "/index.yaml"
+
+	wantChartIndex(url, "grafana", "loki")
+	for _, name := range []string{"grafana", "loki"} {
+		if _, err := chartIndexEntries(url, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("%d downloads for the charts announced, want 1", downloads)
+	}
+
+	// wanted after the download, tempo gets one of its own
+	for i := 0; i < 2; i++ {
+		versions, err := chartIndexEntries(url, "tempo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 1 || versions[0].Version != "1.0.0" {
+			t.Errorf("tempo versions %v", versions)
+		}
+	}
+	if downloads != 2 {
+		t.Errorf("%d downloads, want 2", downloads)
+	}
+
+	if _, err := chartIndexEntries(server.URL+"/missing/index.yaml", "grafana"); !isNotFound(err) {
+		t.Errorf("missing index: %v, want a 404", err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultConfigFile is read from the workspace if INPUT_CONFIG_FILE is unset.
+const defaultConfigFile = "updater.yaml"
+
+// Config is the declarative part of the updater configuration, everything
+// that doesn't fit into a single action input.
+type Config struct {
+	// Policies decide which update PRs are merged automatically, the first
+	// matching policy wins.
+	Policies []MergePolicy `yaml:"policies"`
+	// Rules hold per dependency settings, every matching rule applies and
+	// later rules override earlier ones.
+	Rules []DependencyRule `yaml:"rules"`
+	// Groups combine updates into one PR per target repo, the first matching
+	// group wins.
+	Groups []UpdateGroup `yaml:"groups"`
+	// Charts lists the dependencies checked in a single run when no chart is
+	// passed through the action inputs.
+	Charts []Dependency `yaml:"charts"`
+	// Targets are the repositories and files updates are proposed to.
+	Targets Targets `yaml:"targets"`
+	// Notifications configure where updates and errors are reported.
+	Notifications NotificationConfig `yaml:"notifications"`
+	// State configures where the updater remembers what it announced.
+	State StateConfig `yaml:"state"`
+	// PullRequestTemplate is a text/template over a PullRequestBody
+	// rendering the body of update PRs.
+	PullRequestTemplate string `yaml:"pullRequestTemplate"`
+}
+
+// DependencyRule holds settings for the dependencies it matches.
+type DependencyRule struct {
+	// Dependencies and ChartTypes select the dependencies like in MergePolicy.
+	Dependencies []string `yaml:"dependencies"`
+	ChartTypes   []string `yaml:"chartTypes"`
+	// MinimumReleaseAge holds back versions younger than this, e.g. "72h" or "3d".
+	MinimumReleaseAge string `yaml:"minimumReleaseAge"`
+	// IgnoreVersions skips known bad versions, exact ("27.0.0") or ranges
+	// (">=28.0.0 <28.0.2", "28.1.x").
+	IgnoreVersions []string `yaml:"ignoreVersions"`
+	// AllowedVersions holds the dependency at a constraint such as "<5".
+	AllowedVersions string `yaml:"allowedVersions"`
+	// SeparateMajor proposes major updates in their own PR labelled as
+	// breaking, the regular PR stays on the current major line.
+	SeparateMajor *bool `yaml:"separateMajor"`
+}
+
+// MergePolicy describes how update PRs of matching dependencies are merged.
+type MergePolicy struct {
+	// Dependencies are matched against the values chart name and support
+	// path.Match patterns like "*arr". Empty matches every dependency.
+	Dependencies []string `yaml:"dependencies"`
+	// ChartTypes restricts the policy to core or optional charts.
+	ChartTypes []string `yaml:"chartTypes"`
+	// AutoMerge lists the update types (patch, minor, major) that are merged
+	// without review.
+	AutoMerge []string `yaml:"automerge"`
+	// MergeMethod is one of merge, squash or rebase.
+	MergeMethod string `yaml:"mergeMethod"`
+	// Mode is "auto" to enable GitHub auto-merge or "direct" to merge the PR
+	// ourselves once the required checks passed, in the run proposing it or
+	// a later one.
+	Mode string `yaml:"mode"`
+	// Timeout is how long the direct mode waits for checks before leaving
+	// the PR for review, e.g. "3d". Defaults to three days.
+	Timeout string `yaml:"timeout"`
+}
+
+// loadConfig reads the config file. A missing default config file is not an
+// error, the updater then runs without policies.
+func loadConfig(filename string) (*Config, error) {
+	config := &Config{}
+
+	explicit := filename != ""
+	if !explicit {
+		filename = defaultConfigFile
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) && !explicit {
+		return config, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, fmt.Errorf("error unmarshalling config file %s: %v", filename, err)
+	}
+	return config, nil
+}
+
+// matchesAny reports whether name matches one of the patterns. An empty list
+// matches everything.
+func matchesAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchingRules returns all rules that apply to the dependency in order.
+func (c *Config) matchingRules(name, chartType string) []DependencyRule {
+	var rules []DependencyRule
+	for _, rule := range c.Rules {
+		if matchesAny(rule.Dependencies, name) && matchesAny(rule.ChartTypes, chartType) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// versionRules merges the version settings of all rules matching the
+// dependency.
+func (c *Config) versionRules(name, chartType string) (VersionRules, error) {
+	var rules VersionRules
+	for _, rule := range c.matchingRules(name, chartType) {
+		if rule.MinimumReleaseAge != "" {
+			age, err := parseAge(rule.MinimumReleaseAge)
+			if err != nil {
+				return rules, fmt.Errorf("invalid minimumReleaseAge %q: %v", rule.MinimumReleaseAge, err)
+			}
+			rules.MinAge = age
+		}
+		for _, ignore := range rule.IgnoreVersions {
+			constraint, err := parseConstraint(ignore)
+			if err != nil {
+				return rules, err
+			}
+			rules.Ignore = append(rules.Ignore, constraint)
+		}
+		if rule.AllowedVersions != "" {
+			constraint, err := parseConstraint(rule.AllowedVersions)
+			if err != nil {
+				return rules, err
+			}
+			rules.Allowed = constraint
+		}
+		if rule.SeparateMajor != nil {
+			rules.SeparateMajor = *rule.SeparateMajor
+		}
+	}
+	return rules, nil
+}
+
+// parseAge parses a duration and additionally accepts days like "3d".
+func parseAge(age string) (time.Duration, error) {
+	if strings.HasSuffix(age, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(age, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(age)
+}
+
+// findMergePolicy returns the first policy matching the dependency, or nil.
+func (c *Config) findMergePolicy(name, chartType string) *MergePolicy {
+	for i, policy := range c.Policies {
+		if matchesAny(policy.Dependencies, name) && matchesAny(policy.ChartTypes, chartType) {
+			return &c.Policies[i]
+		}
+	}
+	return nil
+}
+
+// dependencies returns the charts of the config file. Settings missing in an
+// entry fall back to the action inputs and the current chart version is read
+// from the values file of its chart type.
+func (c *Config) dependencies() ([]Dependency, error) {
+	defaults := dependencyFromEnv()
+
+	deps := make([]Dependency, len(c.Charts))
+	for i, dep := range c.Charts {
+		if dep.DockerImage == "" && len(dep.Images) > 0 {
+			dep.DockerImage = dep.Images[0]
+		}
+		if len(dep.Images) == 0 && dep.DockerImage != "" {
+			dep.Images = []string{dep.DockerImage}
+		}
+		if len(dep.Platforms) == 0 {
+			dep.Platforms = defaults.Platforms
+		}
+		if dep.PlatformPolicy == "" {
+			dep.PlatformPolicy = defaults.PlatformPolicy
+		}
+		if dep.ChartVersion == "" {
+			version, err := readChartVersion("values-"+dep.ChartType+".yaml", dep.ValuesChartName)
+			if err != nil {
+				return nil, err
+			}
+			dep.ChartVersion = version
+		}
+		deps[i] = dep
+	}
+	return deps, nil
+}
+
+// readChartVersion reads the chartVersion of a chart from a values file.
+func readChartVersion(filename, valuesChartName string) (string, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("error reading values file: %v", err)
+	}
+
+	values := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return "", fmt.Errorf("error unmarshalling values file %s: %v", filename, err)
+	}
+	chart, _ := values[valuesChartName].(map[interface{}]interface{})
+	version, ok := chart["chartVersion"]
+	if !ok {
+		return "", fmt.Errorf("no chartVersion of %s in %s", valuesChartName, filename)
+	}
+	return fmt.Sprint(version), nil
+}
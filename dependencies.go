@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ChartDependency mirrors an entry of the dependencies block in Chart.yaml.
+// The json tags match helm's chart.Dependency so the Chart.lock digest we
+// generate is the same one `helm dependency update` would write.
+type ChartDependency struct {
+	Name         string        `yaml:"name" json:"name"`
+	Version      string        `yaml:"version,omitempty" json:"version,omitempty"`
+	Repository   string        `yaml:"repository" json:"repository"`
+	Condition    string        `yaml:"condition,omitempty" json:"condition,omitempty"`
+	Tags         []string      `yaml:"tags,omitempty" json:"tags,omitempty"`
+	Enabled      bool          `yaml:"enabled,omitempty" json:"enabled,omitempty"`
+	ImportValues []interface{} `yaml:"import-values,omitempty" json:"import-values,omitempty"`
+	Alias        string        `yaml:"alias,omitempty" json:"alias,omitempty"`
+}
+
+// LockedDependency is a resolved dependency as written to Chart.lock, in the
+// key order helm writes. The digest hashes it as a ChartDependency.
+type LockedDependency struct {
+	Name       string `yaml:"name"`
+	Repository string `yaml:"repository"`
+	Version    string `yaml:"version,omitempty"`
+}
+
+// ChartLock is the content of Chart.lock.
+type ChartLock struct {
+	Dependencies []LockedDependency `yaml:"dependencies"`
+	Digest       string             `yaml:"digest"`
+	Generated    string             `yaml:"generated"`
+}
+
+// DependencyUpdate describes a subchart that was bumped.
+type DependencyUpdate struct {
+	Name       string
+	OldVersion string
+	NewVersion string
+}
+
+// listDependencyVersions returns the stable versions of a subchart in its
+// http(s) chart repository or OCI registry, highest first.
+func listDependencyVersions(repository, name string) ([]string, error) {
+	if strings.HasPrefix(repository, "oci://") {
+		return listOCIChartVersions(repository, name)
+	}
+	if indexURL := dependencyIndexURL(repository); indexURL != "" {
+		chartVersions, err := listChartVersions(indexURL, name)
+		if err != nil {
+			return nil, err
+		}
+		versions := make([]string, len(chartVersions))
+		for i, version := range chartVersions {
+			versions[i] = version.Version
+		}
+		sort.Slice(versions, func(i, j int) bool {
+			return compareVersions(versions[i], versions[j]) > 0
+		})
+		return versions, nil
+	}
+	return nil, fmt.Errorf("unsupported repository %q for dependency %s", repository, name)
+}
+
+// getLatestDependencyVersion resolves the newest stable version of a subchart.
+func getLatestDependencyVersion(repository, name string) (string, error) {
+	versions, err := listDependencyVersions(repository, name)
+	if err != nil {
+		return "", err
+	}
+	return versions[0], nil
+}
+
+// resolveDependencyVersion returns the newest stable version of a subchart
+// within the range constraint, like helm does for a dependency without a
+// lock.
+func resolveDependencyVersion(repository, name, constraint string) (string, error) {
+	if constraint == "" {
+		constraint = "*"
+	}
+	c, err := parseConstraint(constraint)
+	if err != nil {
+		return "", err
+	}
+	versions, err := listDependencyVersions(repository, name)
+	if err != nil {
+		return "", err
+	}
+	for _, version := range versions {
+		if c.matches(version) {
+			return version, nil
+		}
+	}
+	return "", fmt.Errorf("no version of %s matches %s", name, constraint)
+}
+
+// dependencyIndexURL returns the index of an http(s) chart repository, empty
+// for other repositories.
+func dependencyIndexURL(repository string) string {
+	if strings.HasPrefix(repository, "http://") || strings.HasPrefix(repository, "https://") {
+		return strings.TrimSuffix(repository, "/") + "/index.yaml"
+	}
+	return ""
+}
+
+// updateChartDependencies bumps every exactly pinned subchart in the
+// dependencies block of a Chart.yaml to its latest stable version. Version
+// ranges are left alone, their locked version is taken from oldLock or
+// resolved if oldLock doesn't have them.
+func updateChartDependencies(ctx context.Context, values map[interface{}]interface{}, oldLock *ChartLock) ([]ChartDependency, []LockedDependency, []DependencyUpdate, error) {
+	rawDeps, ok := values["dependencies"].([]interface{})
+	if !ok || len(rawDeps) == 0 {
+		return nil, nil, nil, nil
+	}
+
+	// subcharts sharing a repository are looked up in a single download
+	for _, rawDep := range rawDeps {
+		if depMap, ok := rawDep.(map[interface{}]interface{}); ok {
+			repository, _ := depMap["repository"].(string)
+			name, _ := depMap["name"].(string)
+			if indexURL := dependencyIndexURL(repository); indexURL != "" {
+				wantChartIndex(indexURL, name)
+			}
+		}
+	}
+
+	var deps []ChartDependency
+	var locked []LockedDependency
+	var updates []DependencyUpdate
+
+	for _, rawDep := range rawDeps {
+		depMap, ok := rawDep.(map[interface{}]interface{})
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("dependency entry is not a map")
+		}
+
+		// Round trip through yaml to get a typed view of the entry
+		depBytes, err := yaml.Marshal(depMap)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		var dep ChartDependency
+		if err := yaml.Unmarshal(depBytes, &dep); err != nil {
+			return nil, nil, nil, err
+		}
+
+		lockedVersion := dep.Version
+		if stableSemverRe.MatchString(dep.Version) {
+			latest, err := getLatestDependencyVersion(dep.Repository, dep.Name)
+			if err != nil {
+				logger(ctx).Warn("could not resolve dependency", "name", dep.Name, "error", err)
+			} else if compareVersions(dep.Version, latest) < 0 {
+				logger(ctx).Info("dependency updated", "name", dep.Name, "from", dep.Version, "to", latest)
+				updates = append(updates, DependencyUpdate{Name: dep.Name, OldVersion: dep.Version, NewVersion: latest})
+				dep.Version = latest
+				depMap["version"] = latest
+			}
+			lockedVersion = dep.Version
+		} else {
+			lockedVersion = ""
+			if oldLock != nil {
+				for _, l := range oldLock.Dependencies {
+					if l.Name == dep.Name && l.Repository == dep.Repository {
+						lockedVersion = l.Version
+					}
+				}
+			}
+			if lockedVersion == "" {
+				// Chart.lock takes a version, never the range
+				if lockedVersion, err = resolveDependencyVersion(dep.Repository, dep.Name, dep.Version); err != nil {
+					return nil, nil, nil, fmt.Errorf("error locking dependency %s %s: %v", dep.Name, dep.Version, err)
+				}
+			}
+		}
+
+		deps = append(deps, dep)
+		locked = append(locked, LockedDependency{Name: dep.Name, Repository: dep.Repository, Version: lockedVersion})
+	}
+
+	return deps, locked, updates, nil
+}
+
+// hashDependencies computes the Chart.lock digest the same way helm does:
+// sha256 over the json encoding of the requested and the locked dependencies,
+// both as chart.Dependency.
+func hashDependencies(deps []ChartDependency, locked []LockedDependency) (string, error) {
+	req := make([]ChartDependency, len(deps))
+	for i, dep := range deps {
+		dep.ImportValues = jsonCompatible(dep.ImportValues).([]interface{})
+		req[i] = dep
+	}
+	lock := make([]ChartDependency, len(locked))
+	for i, l := range locked {
+		lock[i] = ChartDependency{Name: l.Name, Version: l.Version, Repository: l.Repository}
+	}
+
+	data, err := json.Marshal([2][]ChartDependency{req, lock})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data)), nil
+}
+
+// jsonCompatible converts the map[interface{}]interface{} values yaml.v2
+// produces into map[string]interface{} so they can be json encoded.
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonCompatible(value)
+		}
+		return m
+	case []interface{}:
+		if v == nil {
+			return []interface{}(nil)
+		}
+		s := make([]interface{}, len(v))
+		for i, value := range v {
+			s[i] = jsonCompatible(value)
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+// generateChartLock renders a Chart.lock for the given dependencies.
+func generateChartLock(deps []ChartDependency, locked []LockedDependency) ([]byte, error) {
+	digest, err := hashDependencies(deps, locked)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := ChartLock{
+		Dependencies: locked,
+		Digest:       digest,
+		Generated:    time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	return yaml.Marshal(lock)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v53/github"
+	"gopkg.in/yaml.v2"
+)
+
+// helmDependency is helm's chart.Dependency, helm hashes Chart.lock entries
+// with its field order.
+type helmDependency struct {
+	Name         string        `json:"name"`
+	Version      string        `json:"version,omitempty"`
+	Repository   string        `json:"repository"`
+	Condition    string        `json:"condition,omitempty"`
+	Tags         []string      `json:"tags,omitempty"`
+	Enabled      bool          `json:"enabled,omitempty"`
+	ImportValues []interface{} `json:"import-values,omitempty"`
+	Alias        string        `json:"alias,omitempty"`
+}
+
+// helmHashReq is helm's resolver.HashReq.
+func helmHashReq(req, lock []*helmDependency) string {
+	data, _ := json.Marshal([2][]*helmDependency{req, lock})
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+func TestHashDependencies(t *testing.T) {
+	deps := []ChartDependency{
+		{Name: "postgresql", Version: "12.5.6", Repository: "https://charts.bitnami.com/bitnami", Condition: "postgresql.enabled"},
+		{Name: "redis", Version: "~17.11.0", Repository: "oci://registry-1.docker.io/bitnamicharts", Alias: "cache", ImportValues: []interface{}{
+			map[interface{}]interface{}{"child": "default.data", "parent": "cache"},
+		}},
+	}
+	locked := []LockedDependency{
+		{Name: "postgresql", Repository: "https://charts.bitnami.com/bitnami", Version: "12.5.6"},
+		{Name: "redis", Repository: "oci://registry-1.docker.io/bitnamicharts", Version: "17.11.3"},
+	}
+
+	want := helmHashReq([]*helmDependency{
+		{Name: "postgresql", Version: "12.5.6", Repository: "https://charts.bitnami.com/bitnami", Condition: "postgresql.enabled"},
+		{Name: "redis", Version: "~17.11.0", Repository: "oci://registry-1.docker.io/bitnamicharts", Alias: "cache", ImportValues: []interface{}{
+			map[string]interface{}{"child": "default.data", "parent": "cache"},
+		}},
+	}, []*helmDependency{
+		{Name: "postgresql", Version: "12.5.6", Repository: "https://charts.bitnami.com/bitnami"},
+		{Name: "redis", Version: "17.11.3", Repository: "oci://registry-1.docker.io/bitnamicharts"},
+	})
+
+	got, err := hashDependencies(deps, locked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got digest %s, helm computes %s", got, want)
+	}
+}
+
+// memBackend keeps the files of a target in memory and records the changes
+// proposed to it.
+type memBackend struct {
+	files   map[string]string
+	changes []Change
+}
+
+func (b *memBackend) ReadFile(ctx context.Context, t Target, path string) ([]byte, error) {
+	content, ok := b.files[path]
+	if !ok {
+		return nil, &StatusError{Method: "GET", URL: path, StatusCode: http.StatusNotFound, Status: "404 Not Found"}
+	}
+	return []byte(content), nil
+}
+
+func (b *memBackend) Propose(ctx context.Context, t Target, change Change) (*github.PullRequest, error) {
+	b.changes = append(b.changes, change)
+	return &github.PullRequest{Number: github.Int(len(b.changes)), HTMLURL: github.String(fmt.Sprintf("https://github.com/owner/charts/pull/%d", len(b.changes)))}, nil
+}
+
+// newChartRepo serves an index.yaml with postgresql and redis releases.
+func newChartRepo(t *testing.T) string {
+	t.Helper()
+	t.Setenv("INPUT_CACHE_DIR", t.TempDir())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`apiVersion: v1
+entries:
+  postgresql:
+  - version: 13.0.0
+  - version: 12.6.0
+  - version: 12.5.6
+  redis:
+  - version: 18.0.0
+  - version: 17.12.0
+  - version: 17.11.3
+  - version: 17.11.0
+`))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestUpdateSubchartsWithPR(t *testing.T) {
+	repo := newChartRepo(t)
+	backend := &memBackend{files: map[string]string{
+		"charts/nextcloud/Chart.yaml": `apiVersion: v2
+name: nextcloud
+version: 1.2.3
+appVersion: 27.0.0
+dependencies:
+- name: postgresql
+  version: 12.5.6
+  repository: ` + repo + `
+- name: redis
+  version: ~17.11.0
+  repository: ` + repo + `
+`,
+		"charts/nextcloud/Chart.lock": `dependencies:
+- name: postgresql
+  repository: ` + repo + `
+  version: 12.5.6
+- name: redis
+  repository: ` + repo + `
+  version: 17.11.0
+digest: sha256:old
+generated: "2023-01-01T00:00:00Z"
+`,
+	}}
+	target := Target{Owner: "owner", Repo: "charts", Branch: "main", Path: "charts/nextcloud/Chart.yaml"}
+	body, err := newPullRequestBody(Dependency{}, &Config{}, "nextcloud", "", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pr, version, err := UpdateSubchartsWithPR(context.Background(), backend, target, "nextcloud", body, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "1.2.4" || pr.GetNumber() != 1 || len(backend.changes) != 1 {
+		t.Fatalf("version %q, PR %d, %d changes", version, pr.GetNumber(), len(backend.changes))
+	}
+	change := backend.changes[0]
+	if !strings.HasPrefix(change.Branch, "update-nextcloud-subcharts-") || change.Title != "Update subcharts of nextcloud" {
+		t.Errorf("branch %q, title %q", change.Branch, change.Title)
+	}
+	if !strings.Contains(change.Body, "- dependency postgresql 12.5.6 -> 13.0.0") {
+		t.Errorf("body doesn't list the subchart:\n%s", change.Body)
+	}
+
+	var chart struct {
+		Version      string            `yaml:"version"`
+		AppVersion   string            `yaml:"appVersion"`
+		Dependencies []ChartDependency `yaml:"dependencies"`
+	}
+	if err := yaml.Unmarshal(change.Files[target.Path], &chart); err != nil {
+		t.Fatal(err)
+	}
+	if chart.Version != "1.2.4" || chart.AppVersion != "27.0.0" {
+		t.Errorf("chart %s with app %s, want 1.2.4 with 27.0.0", chart.Version, chart.AppVersion)
+	}
+	if chart.Dependencies[0].Version != "13.0.0" || chart.Dependencies[1].Version != "~17.11.0" {
+		t.Errorf("dependencies %+v", chart.Dependencies)
+	}
+
+	var lock ChartLock
+	if err := yaml.Unmarshal(change.Files["charts/nextcloud/Chart.lock"], &lock); err != nil {
+		t.Fatal(err)
+	}
+	// the range keeps its locked version
+	want := []LockedDependency{{Name: "postgresql", Repository: repo, Version: "13.0.0"}, {Name: "redis", Repository: repo, Version: "17.11.0"}}
+	if !reflect.DeepEqual(lock.Dependencies, want) {
+		t.Errorf("locked %+v, want %+v", lock.Dependencies, want)
+	}
+	if digest, _ := hashDependencies(chart.Dependencies, want); lock.Digest != digest {
+		t.Errorf("digest %s, want %s", lock.Digest, digest)
+	}
+
+	// up to date after the merge
+	backend.files[target.Path] = string(change.Files[target.Path])
+	backend.files["charts/nextcloud/Chart.lock"] = string(change.Files["charts/nextcloud/Chart.lock"])
+	if _, version, err := UpdateSubchartsWithPR(context.Background(), backend, target, "nextcloud", body, nil); err != nil || version != "" {
+		t.Errorf("proposed %q again: %v", version, err)
+	}
+}
+
+func TestUpdateChartDependencies(t *testing.T) {
+	repo := newChartRepo(t)
+	tests := []struct {
+		name    string
+		version string
+		lock    *ChartLock
+		want    string
+		locked  string
+		updated bool
+	}{
+		{name: "pinned", version: "17.11.0", want: "18.0.0", locked: "18.0.0", updated: true},
+		{name: "pinned up to date", version: "18.0.0", want: "18.0.0", locked: "18.0.0"},
+		{name: "range with lock", version: "~17.11.0", lock: &ChartLock{Dependencies: []LockedDependency{{Name: "redis", Repository: repo, Version: "17.11.0"}}}, want: "~17.11.0", locked: "17.11.0"},
+		{name: "range without lock", version: "~17.11.0", want: "~17.11.0", locked: "17.11.3"},
+		{name: "caret range without lock entry", version: "^17.0.0", lock: &ChartLock{}, want: "^17.0.0", locked: "17.12.0"},
+		{name: "no version", want: "", locked: "18.0.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dep := map[interface{}]interface{}{"name": "redis", "repository": repo}
+			if tt.version != "" {
+				dep["version"] = tt.version
+			}
+			values := map[interface{}]interface{}{"dependencies": []interface{}{dep}}
+
+			deps, locked, updates, err := updateChartDependencies(context.Background(), values, tt.lock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deps[0].Version != tt.want {
+				t.Errorf("version %q, want %q", deps[0].Version, tt.want)
+			}
+			if tt.version != "" && dep["version"] != tt.want {
+				t.Errorf("Chart.yaml has %v, want %s", dep["version"], tt.want)
+			}
+			if locked[0].Version != tt.locked {
+				t.Errorf("locked %q, want %q", locked[0].Version, tt.locked)
+			}
+			if (len(updates) > 0) != tt.updated {
+				t.Errorf("updates %+v", updates)
+			}
+		})
+	}
+
+	t.Run("range nothing matches", func(t *testing.T) {
+		values := map[interface{}]interface{}{"dependencies": []interface{}{
+			map[interface{}]interface{}{"name": "redis", "repository": repo, "version": "^19.0.0"},
+		}}
+		if _, _, _, err := updateChartDependencies(context.Background(), values, nil); err == nil {
+			t.Error("no error for a range without versions")
+		}
+	})
+	t.Run("no dependencies", func(t *testing.T) {
+		deps, locked, updates, err := updateChartDependencies(context.Background(), map[interface{}]interface{}{}, nil)
+		if err != nil || deps != nil || locked != nil || updates != nil {
+			t.Errorf("got %v %v %v %v", deps, locked, updates, err)
+		}
+	})
+}
+
+func TestGenerateChartLock(t *testing.T) {
+	deps := []ChartDependency{
+		{Name: "postgresql", Version: "12.5.6", Repository: "https://charts.bitnami.com/bitnami"},
+		{Name: "redis", Version: "~17.11.0", Repository: "oci://registry-1.docker.io/bitnamicharts"},
+	}
+	locked := []LockedDependency{
+		{Name: "postgresql", Repository: "https://charts.bitnami.com/bitnami", Version: "12.5.6"},
+		{Name: "redis", Repository: "oci://registry-1.docker.io/bitnamicharts", Version: "17.11.3"},
+	}
+	content, err := generateChartLock(deps, locked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := hashDependencies(deps, locked)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the layout helm writes, the timestamp aside
+	want := `dependencies:
+- name: postgresql
+  repository: https://charts.bitnami.com/bitnami
+  version: 12.5.6
+- name: redis
+  repository: oci://registry-1.docker.io/bitnamicharts
+  version: 17.11.3
+digest: ` + digest + `
+generated: "`
+	if !strings.HasPrefix(string(content), want) {
+		t.Errorf("got\n%s\nwant\n%s...", content, want)
+	}
+	var lock ChartLock
+	if err := yaml.Unmarshal(content, &lock); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, lock.Generated); err != nil {
+		t.Errorf("generated: %v", err)
+	}
+}
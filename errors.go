@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-github/v53/github"
+)
+
+// Phase is the step of a check an error happened in.
+type Phase string
+
+const (
+	// PhaseResolve covers the config, targets, rules and credentials.
+	PhaseResolve Phase = "resolve"
+	// PhaseFetch covers chart indexes, releases, tags and registries.
+	PhaseFetch Phase = "fetch"
+	// PhaseEdit covers reading and changing the files of a target.
+	PhaseEdit Phase = "edit"
+	// PhasePublish covers commits, pull requests, labels and merges.
+	PhasePublish Phase = "publish"
+)
+
+// Exit codes of a run.
+const (
+	exitUpToDate = 0
+	exitError    = 1
+	exitUpdated  = 2
+)
+
+// PhaseError is an error of a check typed by the phase it happened in.
+type PhaseError struct {
+	Phase Phase
+	Err   error
+}
+
+func (e *PhaseError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Phase, e.Err)
+}
+
+func (e *PhaseError) Unwrap() error {
+	return e.Err
+}
+
+// withPhase types err with phase, errors typed already keep their phase.
+func withPhase(phase Phase, err error) error {
+	if err == nil {
+		return nil
+	}
+	var phaseErr *PhaseError
+	if errors.As(err, &phaseErr) {
+		return err
+	}
+	return &PhaseError{Phase: phase, Err: err}
+}
+
+// phaseOf returns the phase of err, empty if it isn't typed.
+func phaseOf(err error) Phase {
+	var phaseErr *PhaseError
+	if errors.As(err, &phaseErr) {
+		return phaseErr.Phase
+	}
+	return ""
+}
+
+// StatusError is an HTTP response outside of 2xx.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("%s %s: %s", e.Method, e.URL, e.Status)
+	if e.Body != "" {
+		msg += " " + e.Body
+	}
+	return msg
+}
+
+// newStatusError describes the response to a failed request.
+func newStatusError(resp *http.Response, body string) *StatusError {
+	return &StatusError{
+		Method:     resp.Request.Method,
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       body,
+	}
+}
+
+// isNotFound reports whether err is a 404, of our own requests or of
+// go-github.
+func isNotFound(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusNotFound
+	}
+	var githubErr *github.ErrorResponse
+	if errors.As(err, &githubErr) {
+		return githubErr.Response != nil && githubErr.Response.StatusCode == http.StatusNotFound
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v53/github"
+)
+
+const (
+	backendGitea   = "gitea"
+	backendForgejo = "forgejo"
+	backendGitLab  = "gitlab"
+
+	// defaultForgeTokenEnv holds the token for Gitea, Forgejo and GitLab
+	// targets that don't name their own variable.
+	defaultForgeTokenEnv = "INPUT_FORGE_TOKEN"
+	forgeTimeout         = time.Minute
+)
+
+// forgeClient talks to the REST API of a self hosted forge.
+type forgeClient struct {
+	base       string
+	authHeader string
+	authValue  string
+	client     *http.Client
+}
+
+// newForgeClient returns a client for the API at base, authenticated with
+// the token in the variable the target names.
+func newForgeClient(t Target, apiPath, authHeader, authPrefix string) (*forgeClient, error) {
+	if t.Server == "" {
+		return nil, fmt.Errorf("no server configured for %s/%s", t.Owner, t.Repo)
+	}
+	tokenEnv := t.TokenEnv
+	if tokenEnv == "" {
+		tokenEnv = defaultForgeTokenEnv
+	}
+	token := os.Getenv(tokenEnv)
+	if token == "" {
+		return nil, fmt.Errorf("no token for %s in %s", t.Server, tokenEnv)
+	}
+	secrets.add(token)
+	return &forgeClient{
+		base:       strings.TrimSuffix(t.Server, "/") + apiPath,
+		authHeader: authHeader,
+		authValue:  authPrefix + token,
+		client:     &http.Client{Timeout: forgeTimeout},
+	}, nil
+}
+
+// do sends a request with an optional JSON body and decodes the JSON answer
+// into out, or copies it verbatim if out is a *[]byte.
+func (c *forgeClient) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		payload, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(c.authHeader, c.authValue)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return newStatusError(resp, strings.TrimSpace(string(content)))
+	}
+
+	switch out := out.(type) {
+	case nil:
+		return nil
+	case *[]byte:
+		*out = content
+		return nil
+	default:
+		return json.Unmarshal(content, out)
+	}
+}
+
+// forgePullRequest carries a pull or merge request of another forge in the
+// type the rest of the updater passes around. Labels and merge policies only
+// apply to GitHub, it is good for its number and link.
+func forgePullRequest(number int, title, htmlURL string) *github.PullRequest {
+	return &github.PullRequest{
+		Number:  github.Int(number),
+		Title:   github.String(title),
+		HTMLURL: github.String(htmlURL),
+	}
+}
+
+// commitIdentity returns name and email of a committer, empty without one.
+func commitIdentity(committer *github.CommitAuthor) (string, string) {
+	if committer == nil {
+		return "", ""
+	}
+	return committer.GetName(), committer.GetEmail()
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-github/v53/github"
+)
+
+const forgeToken = "forge-test-token"
+
+var testCommitter = &github.CommitAuthor{Name: github.String("updater"), Email: github.String("updater@example.com")}
+
+// fakeGitea serves the contents and pulls API of a repo holding values.yaml.
+type fakeGitea struct {
+	t       *testing.T
+	commits []giteaChangeFiles
+	pulls   []map[string]string
+}
+
+func (f *fakeGitea) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if got := r.Header.Get("Authorization"); got != "token "+forgeToken {
+		f.t.Errorf("%s %s: Authorization %q", r.Method, r.URL, got)
+	}
+	switch r.Method + " " + r.URL.RequestURI() {
+	case "GET /api/v1/repos/owner/values/contents/values.yaml?ref=main":
+		json.NewEncoder(w).Encode(giteaContents{SHA: "abc123", Content: base64.StdEncoding.EncodeToString([]byte("chartVersion: 1.0.0\n")), Encoding: "base64"})
+	case "GET /api/v1/repos/owner/values/contents/new.yaml?ref=main":
+		http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+	case "POST /api/v1/repos/owner/values/contents":
+		var request giteaChangeFiles
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			f.t.Error(err)
+		}
+		f.commits = append(f.commits, request)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	case "POST /api/v1/repos/owner/values/pulls":
+		var pull map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&pull); err != nil {
+			f.t.Error(err)
+		}
+		f.pulls = append(f.pulls, pull)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"number":7,"html_url":"https://gitea.example.com/owner/values/pulls/7"}`))
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL.RequestURI())
+		http.NotFound(w, r)
+	}
+}
+
+func TestGiteaBackend(t *testing.T) {
+	fake := &fakeGitea{t: t}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	t.Setenv(defaultForgeTokenEnv, forgeToken)
+
+	ctx := context.Background()
+	target := Target{Owner: "owner", Repo: "values", Branch: "main", Backend: backendGitea, Server: server.URL}
+	backend, err := newGiteaBackend(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := backend.ReadFile(ctx, target, "values.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "chartVersion: 1.0.0\n" {
+		t.Errorf("ReadFile got %q", content)
+	}
+
+	pr, err := backend.Propose(ctx, target, Change{
+		Branch:  "update-app-to-2.0.0",
+		Message: "Update app to 2.0.0",
+		Title:   "Update app to version 2.0.0",
+		Body:    "release notes",
+		Files: map[string][]byte{
+			"values.yaml": []byte("chartVersion: 2.0.0\n"),
+			"new.yaml":    []byte("new: true\n"),
+		},
+		Committer: testCommitter,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.commits) != 1 {
+		t.Fatalf("got %d commits, want 1", len(fake.commits))
+	}
+	commit := fake.commits[0]
+	if commit.Branch != "main" || commit.NewBranch != "update-app-to-2.0.0" {
+		t.Errorf("committed to %s as %s", commit.Branch, commit.NewBranch)
+	}
+	if commit.Committer == nil || *commit.Committer != (giteaIdentity{Name: "updater", Email: "updater@example.com"}) {
+		t.Errorf("committer %+v", commit.Committer)
+	}
+	wantFiles := []giteaFileChange{
+		{Operation: "create", Path: "new.yaml", Content: base64.StdEncoding.EncodeToString([]byte("new: true\n"))},
+		{Operation: "update", Path: "values.yaml", Content: base64.StdEncoding.EncodeToString([]byte("chartVersion: 2.0.0\n")), SHA: "abc123"},
+	}
+	if !reflect.DeepEqual(commit.Files, wantFiles) {
+		t.Errorf("files %+v, want %+v", commit.Files, wantFiles)
+	}
+
+	wantPull := map[string]string{"head": "update-app-to-2.0.0", "base": "main", "title": "Update app to version 2.0.0", "body": "release notes"}
+	if len(fake.pulls) != 1 || !reflect.DeepEqual(fake.pulls[0], wantPull) {
+		t.Errorf("pulls %v, want %v", fake.pulls, wantPull)
+	}
+	if pr.GetNumber() != 7 || pr.GetHTMLURL() != "https://gitea.example.com/owner/values/pulls/7" {
+		t.Errorf("got pull request %d %s", pr.GetNumber(), pr.GetHTMLURL())
+	}
+
+	// without a branch the commit goes to main and nothing is proposed
+	pr, err = backend.Propose(ctx, target, Change{Message: "state", Files: map[string][]byte{"new.yaml": []byte("x")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr != nil || len(fake.pulls) != 1 {
+		t.Errorf("a commit without a branch opened a pull request")
+	}
+	if got := fake.commits[1]; got.Branch != "main" || got.NewBranch != "" {
+		t.Errorf("committed to %s as %s", got.Branch, got.NewBranch)
+	}
+}
+
+// fakeGitLab serves the files, commits and merge requests API of a project
+// holding values.yaml.
+type fakeGitLab struct {
+	t       *testing.T
+	commits []gitlabCommit
+	mrs     []map[string]interface{}
+}
+
+func (f *fakeGitLab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if got := r.Header.Get("PRIVATE-TOKEN"); got != forgeToken {
+		f.t.Errorf("%s %s: PRIVATE-TOKEN %q", r.Method, r.URL, got)
+	}
+	const project = "/api/v4/projects/group%2Fsub%2Fvalues"
+	switch r.Method + " " + r.URL.RequestURI() {
+	case "GET " + project + "/repository/files/charts%2Fvalues.yaml/raw?ref=main":
+		w.Write([]byte("chartVersion: 1.0.0\n"))
+	case "HEAD " + project + "/repository/files/charts%2Fvalues.yaml?ref=main":
+	case "HEAD " + project + "/repository/files/new.yaml?ref=main":
+		w.WriteHeader(http.StatusNotFound)
+	case "POST " + project + "/repository/commits":
+		var commit gitlabCommit
+		if err := json.NewDecoder(r.Body).Decode(&commit); err != nil {
+			f.t.Error(err)
+		}
+		f.commits = append(f.commits, commit)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	case "POST " + project + "/merge_requests":
+		var mr map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&mr); err != nil {
+			f.t.Error(err)
+		}
+		f.mrs = append(f.mrs, mr)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"iid":12,"web_url":"https://gitlab.example.com/group/sub/values/-/merge_requests/12"}`))
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL.RequestURI())
+		http.NotFound(w, r)
+	}
+}
+
+func TestGitLabBackend(t *testing.T) {
+	fake := &fakeGitLab{t: t}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	t.Setenv("GITLAB_TOKEN", forgeToken)
+
+	ctx := context.Background()
+	target := Target{Owner: "group/sub", Repo: "values", Branch: "main", Backend: backendGitLab, Server: server.URL + "/", TokenEnv: "GITLAB_TOKEN"}
+	backend, err := newGitLabBackend(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := backend.ReadFile(ctx, target, "charts/values.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "chartVersion: 1.0.0\n" {
+		t.Errorf("ReadFile got %q", content)
+	}
+
+	pr, err := backend.Propose(ctx, target, Change{
+		Branch:  "update-app-to-2.0.0",
+		Message: "Update app to 2.0.0",
+		Title:   "Update app to version 2.0.0",
+		Body:    "release notes",
+		Files: map[string][]byte{
+			"charts/values.yaml": []byte("chartVersion: 2.0.0\n"),
+			"new.yaml":           []byte("new: true\n"),
+		},
+		Committer: testCommitter,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := gitlabCommit{
+		Branch:        "update-app-to-2.0.0",
+		StartBranch:   "main",
+		CommitMessage: "Update app to 2.0.0",
+		AuthorName:    "updater",
+		AuthorEmail:   "updater@example.com",
+		Actions: []gitlabCommitAction{
+			{Action: "update", FilePath: "charts/values.yaml", Content: "chartVersion: 2.0.0\n"},
+			{Action: "create", FilePath: "new.yaml", Content: "new: true\n"},
+		},
+	}
+	if len(fake.commits) != 1 || !reflect.DeepEqual(fake.commits[0], want) {
+		t.Errorf("commits %+v, want %+v", fake.commits, want)
+	}
+	if len(fake.mrs) != 1 || fake.mrs[0]["source_branch"] != "update-app-to-2.0.0" || fake.mrs[0]["target_branch"] != "main" || fake.mrs[0]["description"] != "release notes" {
+		t.Errorf("merge requests %v", fake.mrs)
+	}
+	if pr.GetNumber() != 12 || pr.GetHTMLURL() != "https://gitlab.example.com/group/sub/values/-/merge_requests/12" || pr.GetTitle() != "Update app to version 2.0.0" {
+		t.Errorf("got merge request %d %s %s", pr.GetNumber(), pr.GetHTMLURL(), pr.GetTitle())
+	}
+
+	// without a branch the commit goes to main without start_branch
+	pr, err = backend.Propose(ctx, target, Change{Message: "state", Files: map[string][]byte{"new.yaml": []byte("x")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr != nil || len(fake.mrs) != 1 {
+		t.Errorf("a commit without a branch opened a merge request")
+	}
+	if got := fake.commits[1]; got.Branch != "main" || got.StartBranch != "" {
+		t.Errorf("committed to %s from %s", got.Branch, got.StartBranch)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-github/v53/github"
+)
+
+// gitBackend proposes changes with the git command line: files are edited in
+// a temporary worktree of a local repository, committed and pushed to the
+// remote, any remote git understands. It pushes update branches but can't
+// open pull requests.
+type gitBackend struct {
+	dir    string
+	remote string
+	// env is added to the environment of every git command, it carries the
+	// credentials of the remote.
+	env []string
+}
+
+// newGitBackend opens the repository of t. Without a dir the remote is kept
+// in a bare repository in the cache dir.
+func newGitBackend(ctx context.Context, auth *Auth, t Target) (*gitBackend, error) {
+	if t.Remote == "" {
+		return nil, fmt.Errorf("no remote configured for %s/%s", t.Owner, t.Repo)
+	}
+	remote := t.Remote
+	if _, err := os.Stat(remote); err == nil {
+		// a repository on disk, git runs in other directories too
+		if remote, err = filepath.Abs(remote); err != nil {
+			return nil, err
+		}
+	}
+	env, err := gitCredentials(auth, t)
+	if err != nil {
+		return nil, err
+	}
+	if t.Dir != "" {
+		return &gitBackend{dir: t.Dir, remote: remote, env: env}, nil
+	}
+
+	cacheDir := os.Getenv("INPUT_CACHE_DIR")
+	if cacheDir == "" {
+		cacheDir = defaultCacheDir
+	}
+	dir, err := filepath.Abs(filepath.Join(cacheDir, "repos", t.Owner, t.Repo))
+	if err != nil {
+		return nil, err
+	}
+	backend := &gitBackend{dir: dir, remote: remote, env: env}
+	if _, err := os.Stat(filepath.Join(dir, "HEAD")); err == nil {
+		return backend, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if _, err := backend.git(ctx, dir, "init", "--quiet", "--bare"); err != nil {
+		return nil, err
+	}
+	return backend, nil
+}
+
+// gitCredentials returns the environment authenticating git to the https
+// remote of t: the token in TokenEnv, or the GitHub token of the owner for
+// github.com. Other remotes are left to the git configuration.
+func gitCredentials(auth *Auth, t Target) ([]string, error) {
+	u, err := url.Parse(t.Remote)
+	if err != nil || u.Scheme != "https" || u.User != nil {
+		return nil, nil
+	}
+	var user, token string
+	switch {
+	case t.TokenEnv != "":
+		if token = os.Getenv(t.TokenEnv); token == "" {
+			return nil, fmt.Errorf("no token for %s in %s", t.Remote, t.TokenEnv)
+		}
+		user = "oauth2"
+	case u.Host == "github.com":
+		if token, err = auth.Token(t.Owner); err != nil {
+			return nil, err
+		}
+		user = "x-access-token"
+	}
+	if token == "" {
+		return nil, nil
+	}
+	basic := base64.StdEncoding.EncodeToString([]byte(user + ":" + token))
+	secrets.add(token)
+	secrets.add(basic)
+	// the header is only sent to the host of the remote, passed through the
+	// environment it stays off the command line
+	return []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http." + u.Scheme + "://" + u.Host + "/.extraheader",
+		"GIT_CONFIG_VALUE_0=Authorization: Basic " + basic,
+	}, nil
+}
+
+// git runs a git command in dir and returns its output.
+func (b *gitBackend) git(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	if len(b.env) > 0 {
+		cmd.Env = append(os.Environ(), b.env...)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// fetch updates the private ref of branch from the remote and returns it.
+// Fetching into our own namespace leaves the branches and the checkout of
+// the repository alone.
+func (b *gitBackend) fetch(ctx context.Context, branch string) (string, error) {
+	ref := "refs/homelab-updater/" + branch
+	if _, err := b.git(ctx, b.dir, "fetch", "--quiet", "--no-tags", b.remote, "+refs/heads/"+branch+":"+ref); err != nil {
+		return "", err
+	}
+	return ref, nil
+}
+
+func (b *gitBackend) ReadFile(ctx context.Context, t Target, path string) ([]byte, error) {
+	ref, err := b.fetch(ctx, t.Branch)
+	if err != nil {
+		return nil, err
+	}
+	// a missing file is a 404 like on the forges, so isNotFound works
+	if _, err := b.git(ctx, b.dir, "cat-file", "-e", ref+":"+path); err != nil {
+		return nil, &StatusError{
+			Method:     "git show",
+			URL:        b.remote + " " + t.Branch + ":" + path,
+			StatusCode: http.StatusNotFound,
+			Status:     fmt.Sprintf("%d %s", http.StatusNotFound, http.StatusText(http.StatusNotFound)),
+		}
+	}
+	return b.git(ctx, b.dir, "show", ref+":"+path)
+}
+
+func (b *gitBackend) Propose(ctx context.Context, t Target, change Change) (*github.PullRequest, error) {
+	ref, err := b.fetch(ctx, t.Branch)
+	if err != nil {
+		return nil, err
+	}
+
+	worktree, err := ioutil.TempDir("", "homelab-updater-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(worktree)
+	if _, err := b.git(ctx, b.dir, "worktree", "add", "--quiet", "--detach", worktree, ref); err != nil {
+		return nil, err
+	}
+	defer b.git(context.Background(), b.dir, "worktree", "remove", "--force", worktree)
+
+	paths := change.paths()
+	for _, p := range paths {
+		filename := filepath.Join(worktree, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(filename, change.Files[p], 0644); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := b.git(ctx, worktree, append([]string{"add", "--"}, paths...)...); err != nil {
+		return nil, err
+	}
+
+	// without a committer git uses its own configuration
+	var commit []string
+	if committer := change.Committer; committer != nil {
+		commit = append(commit, "-c", "user.name="+committer.GetName(), "-c", "user.email="+committer.GetEmail())
+	}
+	commit = append(commit, "commit", "--quiet", "-m", change.Message)
+	if _, err := b.git(ctx, worktree, commit...); err != nil {
+		return nil, err
+	}
+
+	branch := change.Branch
+	if branch == "" {
+		branch = t.Branch
+	}
+	// no force, an existing update branch or a concurrent push fails the push
+	if _, err := b.git(ctx, worktree, "push", "--quiet", b.remote, "HEAD:refs/heads/"+branch); err != nil {
+		return nil, err
+	}
+	logger(ctx).Info("pushed", "branch", branch, "remote", b.remote)
+	return nil, nil
+}
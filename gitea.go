@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/go-github/v53/github"
+)
+
+// giteaBackend proposes changes to Gitea and Forgejo, which share their API.
+// Committing several files at once needs Gitea 1.20 or any Forgejo release.
+type giteaBackend struct {
+	client *forgeClient
+}
+
+func newGiteaBackend(t Target) (*giteaBackend, error) {
+	client, err := newForgeClient(t, "/api/v1", "Authorization", "token ")
+	if err != nil {
+		return nil, err
+	}
+	return &giteaBackend{client: client}, nil
+}
+
+type giteaContents struct {
+	SHA      string `json:"sha"`
+	Content  string `json:"content"`
+	Encoding string `json:"encoding"`
+}
+
+func (b *giteaBackend) contentsPath(t Target, filePath string) string {
+	return fmt.Sprintf("/repos/%s/%s/contents/%s?ref=%s", url.PathEscape(t.Owner), url.PathEscape(t.Repo), escapeFilePath(filePath), url.QueryEscape(t.Branch))
+}
+
+func (b *giteaBackend) contents(ctx context.Context, t Target, filePath string) (*giteaContents, error) {
+	var contents giteaContents
+	if err := b.client.do(ctx, http.MethodGet, b.contentsPath(t, filePath), nil, &contents); err != nil {
+		return nil, err
+	}
+	return &contents, nil
+}
+
+func (b *giteaBackend) ReadFile(ctx context.Context, t Target, filePath string) ([]byte, error) {
+	contents, err := b.contents(ctx, t, filePath)
+	if err != nil {
+		return nil, err
+	}
+	if contents.Encoding != "base64" {
+		return nil, fmt.Errorf("%s is not a file", filePath)
+	}
+	return base64.StdEncoding.DecodeString(contents.Content)
+}
+
+type giteaFileChange struct {
+	Operation string `json:"operation"`
+	Path      string `json:"path"`
+	Content   string `json:"content"`
+	SHA       string `json:"sha,omitempty"`
+}
+
+type giteaIdentity struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type giteaChangeFiles struct {
+	Branch    string            `json:"branch"`
+	NewBranch string            `json:"new_branch,omitempty"`
+	Message   string            `json:"message"`
+	Files     []giteaFileChange `json:"files"`
+	Author    *giteaIdentity    `json:"author,omitempty"`
+	Committer *giteaIdentity    `json:"committer,omitempty"`
+}
+
+func (b *giteaBackend) Propose(ctx context.Context, t Target, change Change) (*github.PullRequest, error) {
+	request := giteaChangeFiles{
+		Branch:    t.Branch,
+		NewBranch: change.Branch,
+		Message:   change.Message,
+	}
+	if name, email := commitIdentity(change.Committer); name != "" {
+		request.Author = &giteaIdentity{Name: name, Email: email}
+		request.Committer = request.Author
+	}
+
+	// updates need the sha of the file they replace
+	for _, p := range change.paths() {
+		file := giteaFileChange{Operation: "create", Path: p, Content: base64.StdEncoding.EncodeToString(change.Files[p])}
+		contents, err := b.contents(ctx, t, p)
+		switch {
+		case err == nil:
+			file.Operation, file.SHA = "update", contents.SHA
+		case !isNotFound(err):
+			return nil, err
+		}
+		request.Files = append(request.Files, file)
+	}
+
+	repoPath := fmt.Sprintf("/repos/%s/%s", url.PathEscape(t.Owner), url.PathEscape(t.Repo))
+	if err := b.client.do(ctx, http.MethodPost, repoPath+"/contents", request, nil); err != nil {
+		return nil, fmt.Errorf("error committing to %s/%s: %v", t.Owner, t.Repo, err)
+	}
+	if change.Branch == "" {
+		logger(ctx).Info("committed", "repo", t.Owner+"/"+t.Repo, "branch", t.Branch)
+		return nil, nil
+	}
+
+	var pr struct {
+		Number  int    `json:"number"`
+		HTMLURL string `json:"html_url"`
+	}
+	err := b.client.do(ctx, http.MethodPost, repoPath+"/pulls", map[string]string{
+		"head":  change.Branch,
+		"base":  t.Branch,
+		"title": change.Title,
+		"body":  change.Body,
+	}, &pr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pull request: %v", err)
+	}
+
+	logger(ctx).Info("created pull request", "pull_request", pr.HTMLURL)
+	return forgePullRequest(pr.Number, change.Title, pr.HTMLURL), nil
+}
+
+// escapeFilePath escapes the segments of a repository path for a URL.
+func escapeFilePath(filePath string) string {
+	segments := strings.Split(filePath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
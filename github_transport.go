@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxRetries       = 4
+	retryBaseDelay   = time.Second
+	retryMaxDelay    = 30 * time.Second
+	maxRateLimitWait = 15 * time.Minute
+	// secondaryRateLimitWait is what GitHub asks for when a secondary rate
+	// limit response comes without Retry-After.
+	secondaryRateLimitWait = time.Minute
+)
+
+// githubTransport retries failed GitHub API requests with jittered backoff
+// and waits for rate limits to reset instead of failing. GET requests are
+// made conditional through the disk cache, 304 responses don't count against
+// the rate limit.
+type githubTransport struct {
+	base http.RoundTripper
+
+	mu           sync.Mutex
+	blockedUntil time.Time
+}
+
+var (
+	githubTransportOnce   sync.Once
+	sharedGitHubTransport *githubTransport
+)
+
+// newGitHubTransport returns the transport shared by every GitHub client of
+// the process, so they all respect the same rate limit.
+func newGitHubTransport() *githubTransport {
+	githubTransportOnce.Do(func() {
+		caching := &cachingTransport{}
+
+		dir := os.Getenv("INPUT_CACHE_DIR")
+		if dir == "" {
+			dir = defaultCacheDir
+		}
+		cache, err := newDiskCache(dir)
+		if err != nil {
+			slog.Warn("not caching GitHub responses", "error", err)
+		} else {
+			caching.cache = cache
+		}
+
+		sharedGitHubTransport = &githubTransport{base: caching}
+	})
+	return sharedGitHubTransport
+}
+
+// newGitHubHTTPClient returns a plain HTTP client for the GitHub API calls
+// that don't go through go-github.
+func newGitHubHTTPClient() *http.Client {
+	return &http.Client{Transport: newGitHubTransport()}
+}
+
+func (t *githubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := t.waitForReset(req.Context()); err != nil {
+			return nil, err
+		}
+
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			if attempt >= maxRetries || !isIdempotent(req) || !rewindable(req) || req.Context().Err() != nil {
+				return nil, err
+			}
+			delay := backoff(attempt)
+			logger(req.Context()).Warn("request failed, retrying", "method", req.Method, "path", req.URL.Path, "error", err, "delay", delay.String())
+			if err := sleepContext(req.Context(), delay); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		t.trackRateLimit(resp)
+
+		delay, retry := t.retryDelay(req, resp, attempt)
+		if !retry {
+			return resp, nil
+		}
+		if delay > maxRateLimitWait {
+			logger(req.Context()).Warn("rate limited, giving up", "method", req.Method, "path", req.URL.Path, "delay", delay.Round(time.Second).String())
+			return resp, nil
+		}
+
+		// drain so the connection can be reused
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		logger(req.Context()).Warn("request failed, retrying", "method", req.Method, "path", req.URL.Path, "status", resp.Status, "delay", delay.Round(time.Second).String())
+		if err := sleepContext(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryDelay decides whether a response is worth retrying and how long to
+// wait before doing so.
+func (t *githubTransport) retryDelay(req *http.Request, resp *http.Response, attempt int) (time.Duration, bool) {
+	if attempt >= maxRetries || !rewindable(req) {
+		return 0, false
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusForbidden:
+		if after := resp.Header.Get("Retry-After"); after != "" {
+			if seconds, err := strconv.Atoi(after); err == nil {
+				return time.Duration(seconds) * time.Second, true
+			}
+		}
+		if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+			return time.Until(rateLimitReset(resp)) + time.Second, true
+		}
+		if resp.StatusCode == http.StatusTooManyRequests || isSecondaryRateLimit(resp) {
+			return secondaryRateLimitWait, true
+		}
+		// a plain permission problem
+		return 0, false
+	case resp.StatusCode >= 500:
+		// the request may have been processed, only repeat what is safe to repeat
+		if !isIdempotent(req) {
+			return 0, false
+		}
+		return backoff(attempt), true
+	}
+	return 0, false
+}
+
+// trackRateLimit remembers an exhausted rate limit so the next request waits
+// for the reset instead of being rejected.
+func (t *githubTransport) trackRateLimit(resp *http.Response) {
+	if resp.Header.Get("X-RateLimit-Remaining") != "0" {
+		return
+	}
+	reset := rateLimitReset(resp)
+	t.mu.Lock()
+	if reset.After(t.blockedUntil) {
+		t.blockedUntil = reset
+	}
+	t.mu.Unlock()
+}
+
+func (t *githubTransport) waitForReset(ctx context.Context) error {
+	t.mu.Lock()
+	wait := time.Until(t.blockedUntil)
+	t.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	if wait > maxRateLimitWait {
+		return fmt.Errorf("GitHub rate limit exhausted until %s", t.blockedUntil.Format(time.RFC3339))
+	}
+	logger(ctx).Warn("GitHub rate limit exhausted, waiting for the reset", "wait", wait.Round(time.Second).String())
+	return sleepContext(ctx, wait)
+}
+
+// rateLimitReset reads X-RateLimit-Reset, a unix timestamp.
+func rateLimitReset(resp *http.Response) time.Time {
+	seconds, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return time.Now().Add(secondaryRateLimitWait)
+	}
+	return time.Unix(seconds, 0)
+}
+
+// isSecondaryRateLimit peeks at the body of a 403 for the secondary rate
+// limit message. The body stays readable for the caller.
+func isSecondaryRateLimit(resp *http.Response) bool {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+	return err == nil && strings.Contains(strings.ToLower(string(body)), "secondary rate limit")
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// rewindable reports whether the request body can be sent again.
+func rewindable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// backoff returns an exponential delay with jitter.
+func backoff(attempt int) time.Duration {
+	delay := retryBaseDelay << uint(attempt)
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
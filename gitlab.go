@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/google/go-github/v53/github"
+)
+
+// gitlabBackend proposes changes to GitLab as merge requests. Owner is the
+// namespace of the project, groups and subgroups included.
+type gitlabBackend struct {
+	client *forgeClient
+}
+
+func newGitLabBackend(t Target) (*gitlabBackend, error) {
+	client, err := newForgeClient(t, "/api/v4", "PRIVATE-TOKEN", "")
+	if err != nil {
+		return nil, err
+	}
+	return &gitlabBackend{client: client}, nil
+}
+
+// projectPath returns the API path of the project of t, GitLab takes the
+// URL encoded full path in place of the project ID.
+func (b *gitlabBackend) projectPath(t Target) string {
+	return "/projects/" + url.PathEscape(t.Owner+"/"+t.Repo)
+}
+
+func (b *gitlabBackend) filePath(t Target, filePath string) string {
+	return fmt.Sprintf("%s/repository/files/%s", b.projectPath(t), url.PathEscape(filePath))
+}
+
+func (b *gitlabBackend) ReadFile(ctx context.Context, t Target, filePath string) ([]byte, error) {
+	var content []byte
+	if err := b.client.do(ctx, http.MethodGet, b.filePath(t, filePath)+"/raw?ref="+url.QueryEscape(t.Branch), nil, &content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+type gitlabCommitAction struct {
+	Action   string `json:"action"`
+	FilePath string `json:"file_path"`
+	Content  string `json:"content"`
+}
+
+type gitlabCommit struct {
+	Branch        string               `json:"branch"`
+	StartBranch   string               `json:"start_branch,omitempty"`
+	CommitMessage string               `json:"commit_message"`
+	AuthorName    string               `json:"author_name,omitempty"`
+	AuthorEmail   string               `json:"author_email,omitempty"`
+	Actions       []gitlabCommitAction `json:"actions"`
+}
+
+func (b *gitlabBackend) Propose(ctx context.Context, t Target, change Change) (*github.PullRequest, error) {
+	commit := gitlabCommit{
+		Branch:        t.Branch,
+		CommitMessage: change.Message,
+	}
+	if change.Branch != "" {
+		commit.Branch, commit.StartBranch = change.Branch, t.Branch
+	}
+	commit.AuthorName, commit.AuthorEmail = commitIdentity(change.Committer)
+
+	// GitLab wants to know whether a file is created or updated
+	for _, p := range change.paths() {
+		action := gitlabCommitAction{Action: "update", FilePath: p, Content: string(change.Files[p])}
+		err := b.client.do(ctx, http.MethodHead, b.filePath(t, p)+"?ref="+url.QueryEscape(t.Branch), nil, nil)
+		switch {
+		case isNotFound(err):
+			action.Action = "create"
+		case err != nil:
+			return nil, err
+		}
+		commit.Actions = append(commit.Actions, action)
+	}
+
+	if err := b.client.do(ctx, http.MethodPost, b.projectPath(t)+"/repository/commits", commit, nil); err != nil {
+		return nil, fmt.Errorf("error committing to %s/%s: %v", t.Owner, t.Repo, err)
+	}
+	if change.Branch == "" {
+		logger(ctx).Info("committed", "repo", t.Owner+"/"+t.Repo, "branch", t.Branch)
+		return nil, nil
+	}
+
+	var mr struct {
+		IID    int    `json:"iid"`
+		WebURL string `json:"web_url"`
+	}
+	err := b.client.do(ctx, http.MethodPost, b.projectPath(t)+"/merge_requests", map[string]interface{}{
+		"source_branch":        change.Branch,
+		"target_branch":        t.Branch,
+		"title":                change.Title,
+		"description":          change.Body,
+		"remove_source_branch": true,
+	}, &mr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create merge request: %v", err)
+	}
+
+	logger(ctx).Info("created merge request", "merge_request", mr.WebURL)
+	return forgePullRequest(mr.IID, change.Title, mr.WebURL), nil
+}
@@ -1,11 +1,12 @@
 module github.com/loeken/homelab-updater
 
-go 1.20
+go 1.21
 
 require (
 	github.com/google/go-github/v53 v53.2.0
 	golang.org/x/oauth2 v0.16.0
 	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v53/github"
+)
+
+const (
+	scheduleDaily   = "daily"
+	scheduleWeekly  = "weekly"
+	scheduleMonthly = "monthly"
+)
+
+// UpdateGroup combines the updates of all matching dependencies into a single
+// branch and PR per target repo.
+type UpdateGroup struct {
+	// Name identifies the group in branch names and PR titles.
+	Name string `yaml:"name"`
+	// Dependencies and ChartTypes select the members like in MergePolicy.
+	Dependencies []string `yaml:"dependencies"`
+	ChartTypes   []string `yaml:"chartTypes"`
+	// UpdateTypes restricts the group to patch, minor or major updates.
+	UpdateTypes []string `yaml:"updateTypes"`
+	// Schedule starts a new group PR every day, week or month. Without a
+	// schedule the group PR collects updates until it is merged or closed.
+	Schedule string `yaml:"schedule"`
+}
+
+// GroupMember is a single update inside a group PR.
+type GroupMember struct {
+	Name       string `json:"name"`
+	OldVersion string `json:"old"`
+	NewVersion string `json:"new"`
+	Note       string `json:"note,omitempty"`
+}
+
+// groupMembersRe finds the member list we keep in the group PR body, so later
+// runs can rebuild the PR without any state of their own.
+var groupMembersRe = regexp.MustCompile(`<!-- homelab-updater-group: (.*) -->`)
+
+// findGroup returns the first group matching the dependency and update type,
+// or nil.
+func (c *Config) findGroup(name, chartType, updateType string) *UpdateGroup {
+	for i, group := range c.Groups {
+		if !matchesAny(group.Dependencies, name) || !matchesAny(group.ChartTypes, chartType) {
+			continue
+		}
+		if len(group.UpdateTypes) > 0 && !matchesAny(group.UpdateTypes, updateType) {
+			continue
+		}
+		return &c.Groups[i]
+	}
+	return nil
+}
+
+// branchName returns the branch the group collects its updates on at now.
+func (g *UpdateGroup) branchName(now time.Time) (string, error) {
+	branch := "updates/" + g.Name
+	switch g.Schedule {
+	case "":
+		return branch, nil
+	case scheduleDaily:
+		return branch + "-" + now.Format("2006-01-02"), nil
+	case scheduleWeekly:
+		year, week := now.ISOWeek()
+		return fmt.Sprintf("%s-%d-w%02d", branch, year, week), nil
+	case scheduleMonthly:
+		return branch + "-" + now.Format("2006-01"), nil
+	}
+	return "", fmt.Errorf("unknown schedule %q of group %s", g.Schedule, g.Name)
+}
+
+// parseGroupMembers reads the members stored in a group PR body.
+func parseGroupMembers(body string) []GroupMember {
+	var members []GroupMember
+	if m := groupMembersRe.FindStringSubmatch(body); m != nil {
+		if err := json.Unmarshal([]byte(m[1]), &members); err != nil {
+			slog.Warn("ignoring unreadable group members", "error", err)
+			return nil
+		}
+	}
+	return members
+}
+
+// renderGroupBody renders the table of old and new versions of a group PR.
+func renderGroupBody(group *UpdateGroup, members []GroupMember) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Updates of group %s\n\n", group.Name)
+	b.WriteString("| Dependency | Old | New |\n")
+	b.WriteString("|---|---|---|\n")
+	for _, m := range members {
+		fmt.Fprintf(&b, "| %s | %s | %s |\n", m.Name, m.OldVersion, m.NewVersion)
+	}
+	for _, m := range members {
+		if m.Note != "" {
+			fmt.Fprintf(&b, "\n**%s**%s\n", m.Name, m.Note)
+		}
+	}
+
+	encoded, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(&b, "\n<!-- homelab-updater-group: %s -->\n", encoded)
+	return b.String(), nil
+}
+
+// upsertGroupMember adds member to members or replaces the entry of the same
+// dependency. It reports whether anything changed.
+func upsertGroupMember(members []GroupMember, member GroupMember) ([]GroupMember, bool) {
+	for i, m := range members {
+		if m.Name != member.Name {
+			continue
+		}
+		if m.NewVersion == member.NewVersion {
+			return members, false
+		}
+		// keep the version we started from
+		member.OldVersion = m.OldVersion
+		members[i] = member
+		return members, true
+	}
+	members = append(members, member)
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+	return members, true
+}
+
+// findGroupPR returns the open PR of a group branch, or nil.
+func findGroupPR(ctx context.Context, client *github.Client, owner, repo, base, branch string) (*github.PullRequest, error) {
+	prs, _, err := client.PullRequests.List(ctx, owner, repo, &github.PullRequestListOptions{
+		State: "open",
+		Head:  owner + ":" + branch,
+		Base:  base,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(prs) == 0 {
+		return nil, nil
+	}
+	return prs[0], nil
+}
+
+// createGroupBranch creates the group branch at the head of base and returns
+// that commit. A branch that exists already is left alone, its head is
+// returned instead.
+func createGroupBranch(ctx context.Context, client *github.Client, owner, repo, base, branch string) (string, bool, error) {
+	baseRef, _, err := client.Git.GetRef(ctx, owner, repo, "refs/heads/"+base)
+	if err != nil {
+		return "", false, fmt.Errorf("error getting ref: %v", err)
+	}
+	sha := baseRef.Object.GetSHA()
+
+	_, resp, err := client.Git.CreateRef(ctx, owner, repo, &github.Reference{
+		Ref:    github.String("refs/heads/" + branch),
+		Object: &github.GitObject{SHA: github.String(sha)},
+	})
+	if err == nil {
+		return sha, true, nil
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnprocessableEntity {
+		return "", false, fmt.Errorf("error creating reference: %v", err)
+	}
+	existing, _, err := client.Git.GetRef(ctx, owner, repo, "refs/heads/"+branch)
+	if err != nil {
+		return "", false, fmt.Errorf("error getting ref: %v", err)
+	}
+	return existing.Object.GetSHA(), false, nil
+}
+
+// groupBranchLeftover reports whether the group branch at head is left over
+// from a merged or closed group PR. Commits on it that no PR has seen yet
+// belong to a run that is about to open the PR.
+func groupBranchLeftover(ctx context.Context, client *github.Client, owner, repo, base, branch, head string) (bool, error) {
+	comparison, _, err := client.Repositories.CompareCommits(ctx, owner, repo, base, head, nil)
+	if err != nil {
+		return false, fmt.Errorf("error comparing %s with %s: %v", branch, base, err)
+	}
+	if comparison.GetAheadBy() == 0 {
+		return true, nil
+	}
+	prs, _, err := client.PullRequests.List(ctx, owner, repo, &github.PullRequestListOptions{
+		State: "closed",
+		Head:  owner + ":" + branch,
+		Base:  base,
+	})
+	if err != nil {
+		return false, fmt.Errorf("error listing pull requests: %v", err)
+	}
+	for _, pr := range prs {
+		if pr.GetHead().GetSHA() == head {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// resetGroupBranch points the group branch at sha.
+func resetGroupBranch(ctx context.Context, client *github.Client, owner, repo, branch, sha string) error {
+	_, _, err := client.Git.UpdateRef(ctx, owner, repo, &github.Reference{
+		Ref:    github.String("refs/heads/" + branch),
+		Object: &github.GitObject{SHA: github.String(sha)},
+	}, true)
+	if err != nil {
+		return fmt.Errorf("error resetting reference: %v", err)
+	}
+	return nil
+}
+
+// updateGroupPR adds an update to the group PR in a repo. The edits are
+// applied to the files as they are on the group branch, so every member
+// builds on top of the previous ones. The branch and PR are created on first
+// use, later members update the table in the PR body. Whether an update is
+// part of the group is decided by the files on the branch, the table only
+// lists them. It returns the PR and its members after the update, the members
+// are nil if the update already was part of the group.
+func updateGroupPR(ctx context.Context, client *github.Client, owner, repo, base string, group *UpdateGroup, member GroupMember, committer *github.CommitAuthor, edits map[string]func([]byte) ([]byte, error)) (*github.PullRequest, []GroupMember, error) {
+	branch, err := group.branchName(time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pr, err := findGroupPR(ctx, client, owner, repo, base, branch)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error listing pull requests: %v", err)
+	}
+
+	var members []GroupMember
+	var headSHA string
+	if pr == nil {
+		var created bool
+		headSHA, created, err = createGroupBranch(ctx, client, owner, repo, base, branch)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !created {
+			// the branch exists, a concurrent run may have opened its PR
+			// since we looked
+			pr, err = findGroupPR(ctx, client, owner, repo, base, branch)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error listing pull requests: %v", err)
+			}
+		}
+		if !created && pr == nil {
+			leftover, err := groupBranchLeftover(ctx, client, owner, repo, base, branch, headSHA)
+			if err != nil {
+				return nil, nil, err
+			}
+			if leftover {
+				// merged or closed before, start over from base
+				baseRef, _, err := client.Git.GetRef(ctx, owner, repo, "refs/heads/"+base)
+				if err != nil {
+					return nil, nil, fmt.Errorf("error getting ref: %v", err)
+				}
+				headSHA = baseRef.Object.GetSHA()
+				if err := resetGroupBranch(ctx, client, owner, repo, branch, headSHA); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+	if pr != nil {
+		members = parseGroupMembers(pr.GetBody())
+		headSHA = pr.GetHead().GetSHA()
+	}
+	members, changed := upsertGroupMember(members, member)
+
+	paths := make([]string, 0, len(edits))
+	for p := range edits {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var entries []*github.TreeEntry
+	for _, p := range paths {
+		fileContent, _, _, err := client.Repositories.GetContents(ctx, owner, repo, p, &github.RepositoryContentGetOptions{
+			Ref: headSHA,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("error getting file content: %v", err)
+		}
+		content, err := fileContent.GetContent()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error decoding file content: %v", err)
+		}
+
+		updated, err := edits[p]([]byte(content))
+		if err != nil {
+			return nil, nil, err
+		}
+		if string(updated) == content {
+			continue
+		}
+
+		newBlob, _, err := client.Git.CreateBlob(ctx, owner, repo, &github.Blob{
+			Content:  github.String(string(updated)),
+			Encoding: github.String("utf-8"),
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error creating blob: %v", err)
+		}
+		entries = append(entries, &github.TreeEntry{
+			Path: github.String(p),
+			Mode: github.String("100644"),
+			Type: github.String("blob"),
+			SHA:  newBlob.SHA,
+		})
+	}
+
+	if len(entries) == 0 && !changed {
+		logger(ctx).Info("already part of group", "name", member.Name, "version", member.NewVersion, "group", group.Name)
+		return pr, nil, nil
+	}
+
+	if len(entries) > 0 {
+		newTree, _, err := client.Git.CreateTree(ctx, owner, repo, headSHA, entries)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error creating tree: %v", err)
+		}
+		newCommit, _, err := client.Git.CreateCommit(ctx, owner, repo, &github.Commit{
+			Message:   github.String(fmt.Sprintf("Update %s to version %s", member.Name, member.NewVersion)),
+			Tree:      newTree,
+			Parents:   []*github.Commit{{SHA: github.String(headSHA)}},
+			Author:    committer,
+			Committer: committer,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("error creating commit: %v", err)
+		}
+		// no force, a concurrent run updating the group makes us fail
+		// instead of dropping its commit
+		_, _, err = client.Git.UpdateRef(ctx, owner, repo, &github.Reference{
+			Ref:    github.String("refs/heads/" + branch),
+			Object: &github.GitObject{SHA: newCommit.SHA},
+		}, false)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error updating reference: %v", err)
+		}
+	}
+
+	title := fmt.Sprintf("Update group %s (%d updates)", group.Name, len(members))
+	body, err := renderGroupBody(group, members)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if pr == nil {
+		created, _, err := client.PullRequests.Create(ctx, owner, repo, &github.NewPullRequest{
+			Title: github.String(title),
+			Body:  github.String(body),
+			Head:  github.String(branch),
+			Base:  github.String(base),
+		})
+		if err == nil {
+			logger(ctx).Info("created pull request", "pull_request", created.GetHTMLURL())
+			return created, members, nil
+		}
+		// a concurrent run opened it after committing to the branch, add
+		// our update to its table
+		pr, findErr := findGroupPR(ctx, client, owner, repo, base, branch)
+		if findErr != nil || pr == nil {
+			return nil, nil, fmt.Errorf("failed to create pull request: %v", err)
+		}
+		members, _ = upsertGroupMember(parseGroupMembers(pr.GetBody()), member)
+		title = fmt.Sprintf("Update group %s (%d updates)", group.Name, len(members))
+		if body, err = renderGroupBody(group, members); err != nil {
+			return nil, nil, err
+		}
+		return editGroupPR(ctx, client, owner, repo, pr, title, body, members)
+	}
+	return editGroupPR(ctx, client, owner, repo, pr, title, body, members)
+}
+
+// editGroupPR sets the title and the table of members of a group PR.
+func editGroupPR(ctx context.Context, client *github.Client, owner, repo string, pr *github.PullRequest, title, body string, members []GroupMember) (*github.PullRequest, []GroupMember, error) {
+	pr, _, err := client.PullRequests.Edit(ctx, owner, repo, pr.GetNumber(), &github.PullRequest{
+		Title: github.String(title),
+		Body:  github.String(body),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to update pull request: %v", err)
+	}
+	logger(ctx).Info("updated pull request", "pull_request", pr.GetHTMLURL())
+	return pr, members, nil
+}
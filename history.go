@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	proposalOpen   = "open"
+	proposalMerged = "merged"
+	proposalClosed = "closed"
+	// proposalCommitted are changes committed without a pull request.
+	proposalCommitted = "committed"
+
+	// maxHistoryVersions is how many versions of an app or chart are kept,
+	// the oldest are forgotten first.
+	maxHistoryVersions = 100
+)
+
+// History is what the updater saw of a dependency over its runs.
+type History struct {
+	Deployed  DeployedVersions `json:"deployed"`
+	Versions  []VersionRecord  `json:"versions,omitempty"`
+	Proposals []ProposalRecord `json:"proposals,omitempty"`
+}
+
+// DeployedVersions are the versions the values repo runs.
+type DeployedVersions struct {
+	Chart string `json:"chart,omitempty"`
+	App   string `json:"app,omitempty"`
+	// Since is the run that first saw them deployed.
+	Since time.Time `json:"since"`
+}
+
+// VersionRecord is an app or chart version published upstream.
+type VersionRecord struct {
+	Kind      string     `json:"kind"`
+	Version   string     `json:"version"`
+	Published *time.Time `json:"published,omitempty"`
+	FirstSeen time.Time  `json:"firstSeen"`
+	LastSeen  time.Time  `json:"lastSeen"`
+	// Retracted is the run that missed the version upstream, it is cleared
+	// if the version comes back.
+	Retracted *time.Time `json:"retracted,omitempty"`
+}
+
+// available is when the version could have been deployed.
+func (v VersionRecord) available() time.Time {
+	if v.Published != nil && !v.Published.IsZero() && v.Published.Before(v.FirstSeen) {
+		return *v.Published
+	}
+	return v.FirstSeen
+}
+
+// ProposalRecord is a change proposed for a dependency and what became of it.
+type ProposalRecord struct {
+	Kind        string    `json:"kind"`
+	Target      string    `json:"target"`
+	Version     string    `json:"version,omitempty"`
+	PullRequest string    `json:"pullRequest,omitempty"`
+	ProposedAt  time.Time `json:"proposedAt"`
+	// Outcome is open, merged or closed for pull requests, committed for
+	// changes without one.
+	Outcome   string     `json:"outcome"`
+	DecidedAt *time.Time `json:"decidedAt,omitempty"`
+}
+
+// ObservedVersion is a version published upstream, as seen by a check.
+type ObservedVersion struct {
+	Kind      string
+	Version   string
+	Published time.Time
+}
+
+// history returns the history of a dependency, creating it.
+func (s *State) history(name string) *History {
+	if s.History == nil {
+		s.History = make(map[string]*History)
+	}
+	h, ok := s.History[name]
+	if !ok {
+		h = &History{}
+		s.History[name] = h
+	}
+	return h
+}
+
+// record adds what the checks in results saw to the history.
+func (s *State) record(results []DependencyResult, now time.Time) {
+	for _, r := range results {
+		if r.Name == "" {
+			continue
+		}
+		h := s.history(r.Name)
+		h.deploy(r.ChartVersion, r.DeployedAppVersion, now)
+
+		// a failed fetch doesn't see everything, nothing is retracted then
+		complete := true
+		for _, err := range r.Errors {
+			if phaseOf(err) == PhaseFetch {
+				complete = false
+			}
+		}
+		for _, kind := range []string{"app", "chart"} {
+			var observed []ObservedVersion
+			for _, o := range r.Observed {
+				if o.Kind == kind {
+					observed = append(observed, o)
+				}
+			}
+			h.observe(kind, observed, complete, now)
+		}
+
+		for _, action := range r.Actions {
+			h.propose(action, now)
+		}
+	}
+}
+
+// deploy records the deployed versions, unknown ones are kept.
+func (h *History) deploy(chart, app string, now time.Time) {
+	deployed := h.Deployed
+	if chart != "" {
+		deployed.Chart = chart
+	}
+	if app != "" {
+		deployed.App = app
+	}
+	if deployed.Chart != h.Deployed.Chart || deployed.App != h.Deployed.App || deployed.Since.IsZero() {
+		deployed.Since = now
+	}
+	h.Deployed = deployed
+}
+
+// observe records the versions of kind seen upstream. Releases are listed
+// newest first and only so many, so a version is retracted only if it is
+// missing among versions that are still listed.
+func (h *History) observe(kind string, observed []ObservedVersion, complete bool, now time.Time) {
+	if len(observed) == 0 {
+		return
+	}
+	seen := make(map[string]bool)
+	oldest := ""
+	for _, o := range observed {
+		seen[o.Version] = true
+		if oldest == "" || compareVersions(comparableVersion(o.Version), comparableVersion(oldest)) < 0 {
+			oldest = o.Version
+		}
+		i := h.version(kind, o.Version)
+		if i < 0 {
+			h.Versions = append(h.Versions, VersionRecord{Kind: kind, Version: o.Version, FirstSeen: now})
+			i = len(h.Versions) - 1
+		}
+		v := &h.Versions[i]
+		v.LastSeen = now
+		v.Retracted = nil
+		if !o.Published.IsZero() {
+			published := o.Published.UTC()
+			v.Published = &published
+		}
+	}
+	if complete {
+		for i, v := range h.Versions {
+			if v.Kind != kind || seen[v.Version] || v.Retracted != nil {
+				continue
+			}
+			if compareVersions(comparableVersion(v.Version), comparableVersion(oldest)) > 0 {
+				retracted := now
+				h.Versions[i].Retracted = &retracted
+			}
+		}
+	}
+
+	// newest first, forgetting the oldest versions of kind
+	sort.SliceStable(h.Versions, func(i, j int) bool {
+		a, b := h.Versions[i], h.Versions[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return compareVersions(comparableVersion(a.Version), comparableVersion(b.Version)) > 0
+	})
+	kept := h.Versions[:0]
+	count := 0
+	for _, v := range h.Versions {
+		if v.Kind == kind {
+			count++
+			if count > maxHistoryVersions {
+				continue
+			}
+		}
+		kept = append(kept, v)
+	}
+	h.Versions = kept
+}
+
+func (h *History) version(kind, version string) int {
+	for i, v := range h.Versions {
+		if v.Kind == kind && v.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// propose records an action, pull requests updated by later runs are the
+// same proposal.
+func (h *History) propose(action Action, now time.Time) {
+	for _, p := range h.Proposals {
+		if action.PullRequest != "" && p.PullRequest == action.PullRequest {
+			return
+		}
+		if action.PullRequest == "" && p.PullRequest == "" && p.Kind == action.Kind && p.Target == action.Target && p.Version == action.Version {
+			return
+		}
+	}
+	outcome := proposalOpen
+	if action.PullRequest == "" {
+		outcome = proposalCommitted
+	}
+	h.Proposals = append(h.Proposals, ProposalRecord{
+		Kind:        action.Kind,
+		Target:      action.Target,
+		Version:     action.Version,
+		PullRequest: action.PullRequest,
+		ProposedAt:  now,
+		Outcome:     outcome,
+	})
+}
+
+// behind returns the newest version of kind newer than deployed and for how
+// long a newer version than deployed has been available, zero if deployed is
+// the newest.
+func (h *History) behind(kind, deployed string, now time.Time) (string, time.Duration) {
+	if deployed == "" {
+		return "", 0
+	}
+	latest := ""
+	var since time.Time
+	for _, v := range h.Versions {
+		if v.Kind != kind || v.Retracted != nil || compareVersions(comparableVersion(v.Version), comparableVersion(deployed)) <= 0 {
+			continue
+		}
+		if latest == "" || compareVersions(comparableVersion(v.Version), comparableVersion(latest)) > 0 {
+			latest = v.Version
+		}
+		if since.IsZero() || v.available().Before(since) {
+			since = v.available()
+		}
+	}
+	if latest == "" {
+		return "", 0
+	}
+	return latest, now.Sub(since)
+}
+
+// githubPullRe matches the pull requests whose outcome is followed up.
+var githubPullRe = regexp.MustCompile(`^https://github\.com/([^/]+)/([^/]+)/pull/(\d+)$`)
+
+// refreshProposals looks up what became of the open pull requests of the
+// dependencies in results. Only pull requests on github.com are followed.
+func (s *State) refreshProposals(ctx context.Context, auth *Auth, results []DependencyResult) {
+	log := logger(ctx)
+	for _, r := range results {
+		h, ok := s.History[r.Name]
+		if !ok {
+			continue
+		}
+		for i, p := range h.Proposals {
+			m := githubPullRe.FindStringSubmatch(p.PullRequest)
+			if p.Outcome != proposalOpen || m == nil {
+				continue
+			}
+			number, _ := strconv.Atoi(m[3])
+			client := newGitHubClientWithTokenSource(ctx, auth.TokenSource(m[1]))
+			pr, _, err := client.PullRequests.Get(ctx, m[1], m[2], number)
+			if err != nil {
+				log.Warn("error looking up pull request", "pull_request", p.PullRequest, "error", err)
+				continue
+			}
+			switch {
+			case pr.GetMerged():
+				merged := pr.GetMergedAt().UTC()
+				h.Proposals[i].Outcome, h.Proposals[i].DecidedAt = proposalMerged, &merged
+			case pr.GetState() == "closed":
+				closed := pr.GetClosedAt().UTC()
+				h.Proposals[i].Outcome, h.Proposals[i].DecidedAt = proposalClosed, &closed
+			}
+		}
+	}
+}
+
+// behindRecord is how far a dependency lags behind upstream.
+type behindRecord struct {
+	Name        string  `json:"name"`
+	Chart       string  `json:"chart"`
+	LatestChart string  `json:"latestChart,omitempty"`
+	ChartDays   float64 `json:"chartDaysBehind"`
+	App         string  `json:"app,omitempty"`
+	LatestApp   string  `json:"latestApp,omitempty"`
+	AppDays     float64 `json:"appDaysBehind"`
+}
+
+// query answers the history and behind commands from the stored state.
+func query(ctx context.Context, store StateStore, w io.Writer, format string, args []string) error {
+	if store == nil {
+		return fmt.Errorf("no state store configured")
+	}
+	state, err := loadState(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	// every dependency, or the ones named
+	names := args[1:]
+	if len(names) == 0 {
+		for name := range state.History {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	histories := make(map[string]*History)
+	for _, name := range names {
+		h, ok := state.History[name]
+		if !ok {
+			return fmt.Errorf("no history of %s", name)
+		}
+		histories[name] = h
+	}
+
+	switch args[0] {
+	case "history":
+		if format == "json" {
+			return writeJSON(w, histories)
+		}
+		return writeHistory(w, names, histories)
+	case "behind":
+		now := time.Now().UTC()
+		records := make([]behindRecord, 0, len(names))
+		for _, name := range names {
+			h := histories[name]
+			record := behindRecord{Name: name, Chart: h.Deployed.Chart, App: h.Deployed.App}
+			var lag time.Duration
+			record.LatestChart, lag = h.behind("chart", h.Deployed.Chart, now)
+			record.ChartDays = days(lag)
+			record.LatestApp, lag = h.behind("app", h.Deployed.App, now)
+			record.AppDays = days(lag)
+			records = append(records, record)
+		}
+		if format == "json" {
+			return writeJSON(w, records)
+		}
+		return writeBehind(w, records)
+	}
+	return fmt.Errorf("unknown command %q, use history or behind", args[0])
+}
+
+// days rounds d to tenths of days.
+func days(d time.Duration) float64 {
+	return float64(int64(d.Hours()/24*10)) / 10
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func writeHistory(w io.Writer, names []string, histories map[string]*History) error {
+	var b strings.Builder
+	for _, name := range names {
+		h := histories[name]
+		fmt.Fprintf(&b, "%s: chart %s, app %s since %s\n", name, h.Deployed.Chart, h.Deployed.App, formatDay(h.Deployed.Since))
+		for _, v := range h.Versions {
+			line := fmt.Sprintf("  %s %s first seen %s", v.Kind, v.Version, formatDay(v.FirstSeen))
+			if v.Published != nil {
+				line += ", published " + formatDay(*v.Published)
+			}
+			if v.Retracted != nil {
+				line += ", retracted " + formatDay(*v.Retracted)
+			}
+			b.WriteString(line + "\n")
+		}
+		for _, p := range h.Proposals {
+			line := fmt.Sprintf("  proposed %s %s to %s %s, %s", p.Kind, p.Version, p.Target, formatDay(p.ProposedAt), p.Outcome)
+			if p.DecidedAt != nil {
+				line += " " + formatDay(*p.DecidedAt)
+			}
+			if p.PullRequest != "" {
+				line += " " + p.PullRequest
+			}
+			b.WriteString(line + "\n")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeBehind(w io.Writer, records []behindRecord) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEPENDENCY\tCHART\tLATEST\tDAYS BEHIND\tAPP\tLATEST\tDAYS BEHIND")
+	for _, r := range records {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.1f\t%s\t%s\t%.1f\n", r.Name, r.Chart, orDash(r.LatestChart), r.ChartDays, orDash(r.App), orDash(r.LatestApp), r.AppDays)
+	}
+	return tw.Flush()
+}
+
+func formatDay(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestHistoryRecordsDeployedAppVersion(t *testing.T) {
+	// the newest chart ships app 11.0.0, the deployed 7.0.0 ships 10.0.0
+	dep := Dependency{ValuesChartName: "grafana", ChartVersion: "7.0.0", ChartVersions: []ChartVersion{
+		{Version: "8.0.0", AppVersion: "11.0.0"},
+		{Version: "7.0.0", AppVersion: "10.0.0"},
+	}}
+	result := DependencyResult{Name: "grafana", ChartVersion: "7.0.0", AppVersion: "11.0.0", DeployedAppVersion: dep.deployedAppVersion()}
+
+	state := &State{}
+	state.record([]DependencyResult{result}, time.Now())
+	if got := state.History["grafana"].Deployed.App; got != "10.0.0" {
+		t.Errorf("deployed app %q, want 10.0.0", got)
+	}
+	if got := reportRecords([]DependencyResult{result})[0].App.Current; got != "10.0.0" {
+		t.Errorf("current app %q, want 10.0.0", got)
+	}
+}
+
+func TestHistoryObserveRetraction(t *testing.T) {
+	day := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	observed := func(versions ...string) []ObservedVersion {
+		var o []ObservedVersion
+		for _, v := range versions {
+			o = append(o, ObservedVersion{Kind: "app", Version: v})
+		}
+		return o
+	}
+	retracted := func(h *History) []string {
+		var versions []string
+		for _, v := range h.Versions {
+			if v.Retracted != nil {
+				versions = append(versions, v.Version)
+			}
+		}
+		return versions
+	}
+
+	tests := []struct {
+		name     string
+		second   []string
+		complete bool
+		want     []string
+	}{
+		{"still listed", []string{"1.3.0", "1.2.0", "1.1.0"}, true, nil},
+		{"missing within the window", []string{"1.3.0", "1.1.0"}, true, []string{"1.2.0"}},
+		// only the newest releases are listed, 1.1.0 dropped out of the window
+		{"older than the window", []string{"1.4.0", "1.3.0", "1.2.0"}, true, nil},
+		{"failed fetch", []string{"1.3.0"}, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &History{}
+			h.observe("app", observed("1.3.0", "1.2.0", "1.1.0"), true, day)
+			h.observe("app", observed(tt.second...), tt.complete, day.Add(24*time.Hour))
+			if got := retracted(h); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("retracted %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("comes back", func(t *testing.T) {
+		h := &History{}
+		h.observe("app", observed("1.3.0", "1.2.0", "1.1.0"), true, day)
+		h.observe("app", observed("1.3.0", "1.1.0"), true, day.Add(24*time.Hour))
+		h.observe("app", observed("1.3.0", "1.2.0", "1.1.0"), true, day.Add(48*time.Hour))
+		if got := retracted(h); got != nil {
+			t.Errorf("retracted %v", got)
+		}
+		if v := h.Versions[h.version("app", "1.2.0")]; !v.FirstSeen.Equal(day) || !v.LastSeen.Equal(day.Add(48*time.Hour)) {
+			t.Errorf("first seen %s, last seen %s", v.FirstSeen, v.LastSeen)
+		}
+	})
+	t.Run("other kinds", func(t *testing.T) {
+		h := &History{}
+		h.observe("app", observed("1.3.0", "1.2.0"), true, day)
+		h.observe("chart", []ObservedVersion{{Kind: "chart", Version: "5.0.0"}}, true, day)
+		if got := retracted(h); got != nil {
+			t.Errorf("retracted %v", got)
+		}
+	})
+}
+
+func TestHistoryObserveTrims(t *testing.T) {
+	now := time.Now()
+	h := &History{}
+	h.observe("chart", []ObservedVersion{{Kind: "chart", Version: "1.0.0"}}, true, now)
+	var observed []ObservedVersion
+	for i := maxHistoryVersions + 10; i > 0; i-- {
+		observed = append(observed, ObservedVersion{Kind: "app", Version: fmt.Sprintf("1.%d.0", i)})
+	}
+	h.observe("app", observed, true, now)
+
+	apps := 0
+	for _, v := range h.Versions {
+		if v.Kind == "app" {
+			apps++
+		}
+	}
+	if apps != maxHistoryVersions {
+		t.Errorf("kept %d app versions, want %d", apps, maxHistoryVersions)
+	}
+	// the oldest are forgotten, other kinds are kept
+	if h.version("app", "1.10.0") >= 0 || h.version("app", "1.11.0") < 0 || h.version("chart", "1.0.0") < 0 {
+		t.Errorf("kept %+v", h.Versions)
+	}
+}
+
+func TestHistoryPropose(t *testing.T) {
+	now := time.Now()
+	h := &History{}
+	pr := "https://github.com/owner/homelab/pull/1"
+	h.propose(Action{Kind: "chart", Target: "owner/homelab", Version: "1.0.0", PullRequest: pr}, now)
+	// a later run updating the same PR
+	h.propose(Action{Kind: "chart", Target: "owner/homelab", Version: "1.0.1", PullRequest: pr}, now.Add(time.Hour))
+	h.propose(Action{Kind: "app", Target: "owner/images", Version: "2.0.0"}, now)
+	h.propose(Action{Kind: "app", Target: "owner/images", Version: "2.0.0"}, now.Add(time.Hour))
+	h.propose(Action{Kind: "app", Target: "owner/images", Version: "2.0.1"}, now.Add(time.Hour))
+
+	want := []ProposalRecord{
+		{Kind: "chart", Target: "owner/homelab", Version: "1.0.0", PullRequest: pr, ProposedAt: now, Outcome: proposalOpen},
+		{Kind: "app", Target: "owner/images", Version: "2.0.0", ProposedAt: now, Outcome: proposalCommitted},
+		{Kind: "app", Target: "owner/images", Version: "2.0.1", ProposedAt: now.Add(time.Hour), Outcome: proposalCommitted},
+	}
+	if !reflect.DeepEqual(h.Proposals, want) {
+		t.Errorf("proposals %+v, want %+v", h.Proposals, want)
+	}
+}
+
+func TestHistoryBehind(t *testing.T) {
+	now := time.Date(2023, 6, 30, 0, 0, 0, 0, time.UTC)
+	days := func(n int) time.Time { return now.Add(-time.Duration(n) * 24 * time.Hour) }
+	published := days(20)
+	retracted := days(1)
+	h := &History{Versions: []VersionRecord{
+		{Kind: "app", Version: "1.4.0", FirstSeen: days(2), Retracted: &retracted},
+		{Kind: "app", Version: "1.3.0", FirstSeen: days(5)},
+		// published before the updater saw it
+		{Kind: "app", Version: "1.2.0", FirstSeen: days(10), Published: &published},
+		{Kind: "app", Version: "1.1.0", FirstSeen: days(30)},
+		{Kind: "chart", Version: "9.0.0", FirstSeen: days(1)},
+	}}
+
+	tests := []struct {
+		deployed string
+		latest   string
+		days     int
+	}{
+		{"1.1.0", "1.3.0", 20},
+		{"1.2.0", "1.3.0", 5},
+		{"1.3.0", "", 0},
+		{"", "", 0},
+	}
+	for _, tt := range tests {
+		latest, behind := h.behind("app", tt.deployed, now)
+		if latest != tt.latest || behind != time.Duration(tt.days)*24*time.Hour {
+			t.Errorf("%q: %s behind by %s, want %s by %d days", tt.deployed, latest, behind, tt.latest, tt.days)
+		}
+	}
+}
+
+// rewriteTransport sends every request to the test server.
+type rewriteTransport struct {
+	server *url.URL
+	base   http.RoundTripper
+}
+
+func (t rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = t.server.Scheme, t.server.Host
+	return t.base.RoundTrip(req)
+}
+
+func TestRefreshProposals(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/owner/homelab/pulls/1":
+			fmt.Fprint(w, `{"number":1,"state":"closed","merged":true,"merged_at":"2023-06-02T10:00:00Z","closed_at":"2023-06-02T10:00:00Z"}`)
+		case "/repos/owner/homelab/pulls/2":
+			fmt.Fprint(w, `{"number":2,"state":"closed","closed_at":"2023-06-03T10:00:00Z"}`)
+		case "/repos/owner/homelab/pulls/3":
+			fmt.Fprint(w, `{"number":3,"state":"open"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	// the GitHub client goes to api.github.com
+	base := http.DefaultTransport
+	http.DefaultTransport = rewriteTransport{server: serverURL, base: base}
+	defer func() { http.DefaultTransport = base }()
+	t.Setenv("INPUT_CACHE_DIR", t.TempDir())
+
+	proposed := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	state := &State{History: map[string]*History{"grafana": {Proposals: []ProposalRecord{
+		{PullRequest: "https://github.com/owner/homelab/pull/1", Outcome: proposalOpen, ProposedAt: proposed},
+		{PullRequest: "https://github.com/owner/homelab/pull/2", Outcome: proposalOpen, ProposedAt: proposed},
+		{PullRequest: "https://github.com/owner/homelab/pull/3", Outcome: proposalOpen, ProposedAt: proposed},
+		// gone upstream, left open
+		{PullRequest: "https://github.com/owner/homelab/pull/4", Outcome: proposalOpen, ProposedAt: proposed},
+		{Outcome: proposalCommitted, ProposedAt: proposed},
+		{PullRequest: "https://git.example.com/owner/homelab/pulls/5", Outcome: proposalOpen, ProposedAt: proposed},
+	}}}}
+	auth := &Auth{static: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"})}
+
+	state.refreshProposals(context.Background(), auth, []DependencyResult{{Name: "grafana"}, {Name: "unknown"}})
+
+	merged := time.Date(2023, 6, 2, 10, 0, 0, 0, time.UTC)
+	closed := time.Date(2023, 6, 3, 10, 0, 0, 0, time.UTC)
+	want := []struct {
+		outcome string
+		decided *time.Time
+	}{
+		{proposalMerged, &merged},
+		{proposalClosed, &closed},
+		{proposalOpen, nil},
+		{proposalOpen, nil},
+		{proposalCommitted, nil},
+		{proposalOpen, nil},
+	}
+	for i, p := range state.History["grafana"].Proposals {
+		if p.Outcome != want[i].outcome || (p.DecidedAt == nil) != (want[i].decided == nil) || (p.DecidedAt != nil && !p.DecidedAt.Equal(*want[i].decided)) {
+			t.Errorf("%s: %s at %v, want %s at %v", p.PullRequest, p.Outcome, p.DecidedAt, want[i].outcome, want[i].decided)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// defaultCacheDir is relative to the workspace so the workflow can keep it
+// between runs.
+const defaultCacheDir = ".cache/homelab-updater"
+
+// cacheEntry is the metadata of a cached response, the body is stored next to
+// it.
+type cacheEntry struct {
+	URL          string      `json:"url"`
+	StatusCode   int         `json:"statusCode"`
+	Header       http.Header `json:"header"`
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"lastModified,omitempty"`
+}
+
+// diskCache stores responses on disk keyed by request.
+type diskCache struct {
+	dir string
+}
+
+func newDiskCache(dir string) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &diskCache{dir: dir}, nil
+}
+
+// key identifies a request. The accept header is part of it because the same
+// URL serves different media types, the credentials because the cache is
+// kept between runs and one token must not read what another one fetched.
+func (c *diskCache) key(req *http.Request) string {
+	identity := sha256.Sum256([]byte(req.Header.Get("Authorization")))
+	sum := sha256.Sum256([]byte(req.Method + " " + req.URL.String() + " " + req.Header.Get("Accept") + " " + hex.EncodeToString(identity[:])))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+func (c *diskCache) get(req *http.Request) (*cacheEntry, bool) {
+	content, err := ioutil.ReadFile(c.key(req) + ".json")
+	if err != nil {
+		return nil, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return nil, false
+	}
+	if _, err := os.Stat(c.key(req) + ".body"); err != nil {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// response turns a cached entry back into a response. Headers of the
+// revalidation response (e.g. rate limits) replace the cached ones.
+func (c *diskCache) response(req *http.Request, entry *cacheEntry, fresh http.Header) (*http.Response, error) {
+	body, err := os.Open(c.key(req) + ".body")
+	if err != nil {
+		return nil, err
+	}
+
+	header := entry.Header.Clone()
+	for name, values := range fresh {
+		header[name] = values
+	}
+	return &http.Response{
+		Status:        http.StatusText(entry.StatusCode),
+		StatusCode:    entry.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+// cachingBody writes the body to the cache while the caller reads it. The
+// entry is only stored once the body was read completely.
+type cachingBody struct {
+	io.ReadCloser
+	cache    *diskCache
+	req      *http.Request
+	entry    cacheEntry
+	tmp      *os.File
+	complete bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.tmp != nil {
+		if _, werr := b.tmp.Write(p[:n]); werr != nil {
+			b.discard()
+		}
+	}
+	if err == io.EOF {
+		b.complete = true
+	}
+	return n, err
+}
+
+func (b *cachingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.tmp == nil {
+		return err
+	}
+	if !b.complete {
+		b.discard()
+		return err
+	}
+
+	tmpName := b.tmp.Name()
+	b.tmp.Close()
+	b.tmp = nil
+
+	meta, merr := json.Marshal(b.entry)
+	key := b.cache.key(b.req)
+	if merr == nil && os.Rename(tmpName, key+".body") == nil {
+		ioutil.WriteFile(key+".json", meta, 0644)
+	} else {
+		os.Remove(tmpName)
+	}
+	return err
+}
+
+func (b *cachingBody) discard() {
+	if b.tmp != nil {
+		b.tmp.Close()
+		os.Remove(b.tmp.Name())
+		b.tmp = nil
+	}
+}
+
+// cachingTransport makes GET requests conditional with If-None-Match and
+// If-Modified-Since and answers 304 responses from the disk cache. Without a
+// cache it passes requests through.
+type cachingTransport struct {
+	base  http.RoundTripper
+	cache *diskCache
+}
+
+func (t *cachingTransport) baseTransport() http.RoundTripper {
+	if t.base != nil {
+		return t.base
+	}
+	return http.DefaultTransport
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.cache == nil || req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return t.baseTransport().RoundTrip(req)
+	}
+
+	entry, cached := t.cache.get(req)
+	if cached {
+		req = req.Clone(req.Context())
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	resp, err := t.baseTransport().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if cached && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return t.cache.response(req, entry, resp.Header)
+	}
+
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+	if resp.StatusCode != http.StatusOK || (etag == "" && lastModified == "") {
+		return resp, nil
+	}
+
+	tmp, err := ioutil.TempFile(t.cache.dir, "body-*")
+	if err != nil {
+		return resp, nil
+	}
+	resp.Body = &cachingBody{
+		ReadCloser: resp.Body,
+		cache:      t.cache,
+		req:        req,
+		entry: cacheEntry{
+			URL:          req.URL.String(),
+			StatusCode:   resp.StatusCode,
+			Header:       resp.Header.Clone(),
+			ETag:         etag,
+			LastModified: lastModified,
+		},
+		tmp: tmp,
+	}
+	return resp, nil
+}
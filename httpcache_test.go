@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCachingTransportSeparatesCredentials(t *testing.T) {
+	var conditional []bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conditional = append(conditional, r.Header.Get("If-None-Match") != "")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("private"))
+	}))
+	defer server.Close()
+
+	cache, err := newDiskCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &cachingTransport{cache: cache}}
+	get := func(token string) string {
+		req, _ := http.NewRequest("GET", server.URL+"/repos/owner/private/contents/values.yaml", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "token "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	for _, token := range []string{"a", "a", "b", ""} {
+		if body := get(token); body != "private" {
+			t.Fatalf("token %q: got %q", token, body)
+		}
+	}
+	// only the second request of token a is answered from the cache
+	want := []bool{false, true, false, false}
+	for i := range want {
+		if conditional[i] != want[i] {
+			t.Errorf("conditional requests %v, want %v", conditional, want)
+			break
+		}
+	}
+}
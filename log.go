@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	redacted = "[REDACTED]"
+	// maxDumpBody is how much of a body a verbose run logs.
+	maxDumpBody = 64 << 10
+	// minSecretLength keeps short values like "true" from being redacted
+	// everywhere.
+	minSecretLength = 8
+)
+
+// secretPatterns match credentials whatever variable they came from.
+var secretPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?i)\b(authorization|private-token)(["']?\s*[:=]\s*["']?)((?:bearer|token|basic) )?[^\s"',]+`), "${1}${2}${3}" + redacted},
+	{regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{20,}|github_pat_[A-Za-z0-9_]{20,}|glpat-[A-Za-z0-9_-]{20,})`), redacted},
+	{regexp.MustCompile(`https://hooks\.slack\.com/[^\s"'<>]+`), "https://hooks.slack.com/" + redacted},
+	{regexp.MustCompile(`(?i)([?&](?:access_token|token|private_token|key|secret|password)=)[^&\s"'<>]+`), "${1}" + redacted},
+	{regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`), redacted},
+}
+
+// secretEnv matches the names of variables holding credentials.
+var secretEnv = regexp.MustCompile(`TOKEN|SECRET|PASSWORD|PRIVATE_KEY|WEBHOOK`)
+
+// redactor replaces known secrets in everything that gets logged.
+type redactor struct {
+	mu      sync.RWMutex
+	secrets []string
+}
+
+var secrets = &redactor{}
+
+// add registers a secret, values too short to be one are ignored.
+func (r *redactor) add(secret string) {
+	secret = strings.TrimSpace(secret)
+	if len(secret) < minSecretLength {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.secrets {
+		if s == secret {
+			return
+		}
+	}
+	r.secrets = append(r.secrets, secret)
+	// longest first, so a secret containing another is redacted as a whole
+	sort.Slice(r.secrets, func(i, j int) bool { return len(r.secrets[i]) > len(r.secrets[j]) })
+}
+
+// addEnv registers the values of the variables named like credentials.
+// Variables naming files or other variables are left alone.
+func (r *redactor) addEnv() {
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if secretEnv.MatchString(name) && !strings.HasSuffix(name, "_FILE") && !strings.HasSuffix(name, "_ENV") {
+			r.add(value)
+		}
+	}
+}
+
+func (r *redactor) redact(s string) string {
+	r.mu.RLock()
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	r.mu.RUnlock()
+	for _, p := range secretPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// redactAttr redacts the strings and errors of a log record, the message
+// included.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, secrets.redact(a.Value.String()))
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case error:
+			return slog.String(a.Key, secrets.redact(v.Error()))
+		case fmt.Stringer:
+			return slog.String(a.Key, secrets.redact(v.String()))
+		}
+	}
+	return a
+}
+
+// newLogger returns a logger writing text or json to w, debug messages only
+// if verbose.
+func newLogger(w io.Writer, format string, verbose bool) (*slog.Logger, error) {
+	level := slog.LevelInfo
+	if verbose {
+		level = slog.LevelDebug
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, use text or json", format)
+}
+
+type loggerKey struct{}
+
+// withLogger returns a context logging to l.
+func withLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// logger returns the logger of ctx, carrying the fields of the dependency
+// being checked, or the default one.
+func logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// dumpTransport logs every request and response with their bodies at debug
+// level, for --verbose runs.
+type dumpTransport struct {
+	base http.RoundTripper
+}
+
+func (t *dumpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	log := logger(req.Context())
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	log.Debug("http request",
+		"method", req.Method,
+		"url", req.URL.Redacted(),
+		"headers", dumpHeaders(req.Header),
+		"body", truncateBody(body),
+	)
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		log.Debug("http request failed", "method", req.Method, "url", req.URL.Redacted(), "error", err)
+		return nil, err
+	}
+	resp.Body = &dumpBody{ReadCloser: resp.Body, log: log.With(
+		"method", req.Method,
+		"url", req.URL.Redacted(),
+		"status", resp.Status,
+		"headers", dumpHeaders(resp.Header),
+	)}
+	return resp, nil
+}
+
+// dumpBody logs the start of a response body once it is closed, so streamed
+// bodies stay streamed.
+type dumpBody struct {
+	io.ReadCloser
+	log  *slog.Logger
+	buf  bytes.Buffer
+	once sync.Once
+}
+
+func (b *dumpBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if room := maxDumpBody + 1 - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:minInt(n, room)])
+	}
+	return n, err
+}
+
+func (b *dumpBody) Close() error {
+	b.once.Do(func() {
+		b.log.Debug("http response", "body", truncateBody(b.buf.Bytes()))
+	})
+	return b.ReadCloser.Close()
+}
+
+// dumpHeaders renders headers one per line with credentials redacted.
+func dumpHeaders(header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		switch http.CanonicalHeaderKey(name) {
+		case "Authorization", "Private-Token", "Cookie", "Set-Cookie", "Proxy-Authorization":
+			value = redacted
+		}
+		fmt.Fprintf(&b, "%s: %s\n", name, value)
+	}
+	return b.String()
+}
+
+func truncateBody(body []byte) string {
+	if len(body) > maxDumpBody {
+		return string(body[:maxDumpBody]) + "... (truncated)"
+	}
+	return string(body)
+}
@@ -3,16 +3,21 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/google/go-github/v53/github"
 	"golang.org/x/oauth2"
@@ -20,8 +25,9 @@ import (
 )
 
 type ChartVersion struct {
-	Version    string `yaml:"version"`
-	AppVersion string `yaml:"appVersion"`
+	Version    string    `yaml:"version"`
+	AppVersion string    `yaml:"appVersion"`
+	Created    time.Time `yaml:"created"`
 }
 
 type Chart struct {
@@ -33,141 +39,757 @@ type ChartIndex struct {
 	Entries map[string][]ChartVersion `yaml:"entries"`
 }
 
+// Dependency is an upstream app and chart tracked by the updater, configured
+// through the action inputs or listed in the config file. The yaml keys are
+// the ones of the workflow matrix.
+type Dependency struct {
+	Owner               string   `yaml:"github_user"`
+	Repo                string   `yaml:"github_repo"`
+	ChartIndexURL       string   `yaml:"chart_index_url"`
+	ChartName           string   `yaml:"chartName"`
+	ValuesChartName     string   `yaml:"valuesChartName"`
+	ChartVersion        string   `yaml:"chartVersion"`
+	ChartType           string   `yaml:"chartType"`
+	ReleaseRemoveString string   `yaml:"release_remove_string"`
+	SelfManagedImage    bool     `yaml:"self_managed_image"`
+	SelfManagedChart    bool     `yaml:"self_managed_chart"`
+	DockerTagPrefix     string   `yaml:"dockertagprefix"`
+	DockerTagSuffix     string   `yaml:"dockertagsuffix"`
+	DockerTagOverride   string   `yaml:"dockertagoverride"`
+	DockerImage         string   `yaml:"docker_image"`
+	ValuesImagePath     string   `yaml:"values_image_path"`
+	DigestMode          string   `yaml:"digest_pinning"`
+	DigestRefresh       bool     `yaml:"digest_refresh"`
+	Images              []string `yaml:"images"`
+	Platforms           []string `yaml:"platforms"`
+	PlatformPolicy      string   `yaml:"platform_policy"`
+
+	// Targets are resolved from the config for every run.
+	Targets DependencyTargets `yaml:"-"`
+	// Releases and ChartVersions are what upstream published, listed for
+	// every run, newest first.
+	Releases      []Release      `yaml:"-"`
+	ChartVersions []ChartVersion `yaml:"-"`
+	// ReleasesIncomplete is set if Releases stop before the deployed app
+	// version.
+	ReleasesIncomplete bool `yaml:"-"`
+}
+
+// majorUpdateNote is appended to the body of PRs proposing a new major version.
+const majorUpdateNote = "\n\n**Major update**, this may contain breaking changes."
+
+// breakingLabel is added to PRs proposing a new major version.
+const breakingLabel = "breaking"
+
+func dependencyFromEnv() Dependency {
+	dep := Dependency{
+		Owner:               os.Getenv("INPUT_GITHUB_USER"),
+		Repo:                os.Getenv("INPUT_GITHUB_REPO"),
+		ChartIndexURL:       os.Getenv("INPUT_CHART_INDEX_URL"),
+		ChartName:           os.Getenv("INPUT_CHART_NAME"),
+		ValuesChartName:     os.Getenv("INPUT_VALUES_CHART_NAME"),
+		ChartVersion:        os.Getenv("INPUT_CHART_VERSION"),
+		ChartType:           os.Getenv("INPUT_CHART_TYPE"),
+		ReleaseRemoveString: os.Getenv("INPUT_RELEASE_REMOVE_STRING"),
+		SelfManagedImage:    os.Getenv("INPUT_SELF_MANAGED_IMAGE") == "true",
+		SelfManagedChart:    os.Getenv("INPUT_SELF_MANAGED_CHART") == "true",
+		DockerTagPrefix:     os.Getenv("INPUT_DOCKERTAGPREFIX"),
+		DockerTagSuffix:     os.Getenv("INPUT_DOCKERTAGSUFFIX"),
+		DockerTagOverride:   os.Getenv("INPUT_DOCKERTAGOVERRIDE"),
+		DockerImage:         os.Getenv("INPUT_DOCKER_IMAGE"),
+		ValuesImagePath:     os.Getenv("INPUT_VALUES_IMAGE_PATH"),
+		DigestMode:          os.Getenv("INPUT_DIGEST_PINNING"),
+		DigestRefresh:       os.Getenv("INPUT_DIGEST_REFRESH") == "true",
+		Images:              splitList(os.Getenv("INPUT_IMAGES")),
+		Platforms:           splitList(os.Getenv("INPUT_PLATFORMS")),
+		PlatformPolicy:      os.Getenv("INPUT_PLATFORM_POLICY"),
+	}
+	if len(dep.Images) == 0 && dep.DockerImage != "" {
+		dep.Images = []string{dep.DockerImage}
+	}
+	return dep
+}
+
+// dockerTag turns an upstream release tag or chart appVersion into the docker
+// tag we deploy.
+func (d Dependency) dockerTag(version string) string {
+	version = strings.TrimPrefix(version, "v")
+	version = strings.Replace(version, d.ReleaseRemoveString, "", -1)
+	return d.DockerTagPrefix + version + d.DockerTagSuffix
+}
+
+// deployedAppVersion is the docker tag of the appVersion of the deployed
+// chart, empty if the chart index doesn't list it.
+func (d Dependency) deployedAppVersion() string {
+	for _, version := range d.ChartVersions {
+		if version.Version == d.ChartVersion {
+			return d.dockerTag(version.AppVersion)
+		}
+	}
+	return ""
+}
+
 func main() {
-	// outputFile := "output.txt"
-
-	owner := os.Getenv("INPUT_GITHUB_USER")
-	repo := os.Getenv("INPUT_GITHUB_REPO")
-	token := os.Getenv("INPUT_GITHUB_TOKEN")
-	chart_index_url := os.Getenv("INPUT_CHART_INDEX_URL")
-
-	chartName := os.Getenv("INPUT_CHART_NAME")
-	valuesChartName := os.Getenv("INPUT_VALUES_CHART_NAME")
-	oldChartVersion := os.Getenv("INPUT_CHART_VERSION")
-	// remoteChartName := os.Getenv("INPUT_REMOTE_CHART_NAME")
-	chartType := os.Getenv("INPUT_CHART_TYPE")
-	releaseRemoveString := os.Getenv("INPUT_RELEASE_REMOVE_STRING")
-
-	selfManagedImage := os.Getenv("INPUT_SELF_MANAGED_IMAGE")
-	selfManagedChart := os.Getenv("INPUT_SELF_MANAGED_CHART")
-	dockerTagPrefix := os.Getenv("INPUT_DOCKERTAGPREFIX")
-	dockerTagSuffix := os.Getenv("INPUT_DOCKERTAGSUFFIX")
-
-	var err error
-
-	app_version, err := getLatestReleaseTag(owner, repo, token)
-	chartInfo, err1 := getLatestChartVersion(chart_index_url, chartName)
-	if err1 != nil {
-		fmt.Println("error: ", err)
-	}
-
-	if err != nil {
-		fmt.Println("error: ", err)
-		if err.Error() == "failed to get latest tag: 404 Not Found" {
-			app_version = chartInfo.Version
-		}
-	}
-	app_version = strings.Replace(app_version, releaseRemoveString, "", -1)
-	app_version = dockerTagPrefix + app_version + dockerTagSuffix
-	fmt.Println("app version new src repo: " + app_version)
-
-	chart_app_version := strings.Replace(chartInfo.AppVersion, releaseRemoveString, "", -1)
-	chart_app_version = dockerTagPrefix + chart_app_version + dockerTagSuffix
-	fmt.Println("app version in chart: " + chart_app_version)
-	fmt.Println("chart version in src repo: " + chartInfo.Version)
-	fmt.Println("current chart version my repo: " + oldChartVersion)
-
-	fmt.Println(app_version)
-	fmt.Println(oldChartVersion + "compare" + chartInfo.Version)
-
-	// if compareVersions(chart_app_version, app_version) < 0 {
-	// 	info := chartName + " app_version not matching chart_app_version want: " + app_version
-	// 	slackWebhookURL := os.Getenv("SLACK_WEBHOOK_URL")
-	// 	if err := sendSlackNotification(slackWebhookURL, info); err != nil {
-	// 		fmt.Printf("Failed to send Slack notification: %v\n", err)
-	// 	}
-	// 	os.Exit(1)
-	// }
-	if compareVersions(chart_app_version, app_version) < 0 {
-		if selfManagedImage == "true" {
-			fmt.Println("new version found of self managed app found")
-
-			err := UpdateChartVersion(
-				chartName,
-				"loeken",
-				"docker-"+valuesChartName,
-				"version.yaml",
-				"env",
-				"version",
-				app_version,
-				"main",
-				token,
+	reportFormat := flag.String("report", os.Getenv("INPUT_REPORT"), "format of the run report, text or json")
+	reportFile := flag.String("report-file", os.Getenv("INPUT_REPORT_FILE"), "write the run report to this file instead of stdout")
+	logFormat := flag.String("log-format", os.Getenv("INPUT_LOG_FORMAT"), "format of the log, text or json")
+	verbose := flag.Bool("verbose", os.Getenv("INPUT_VERBOSE") == "true" || os.Getenv("RUNNER_DEBUG") == "1", "log debug messages and every HTTP request and response")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [history|behind [dependency...]]\n\nwithout a command the dependencies are checked, history and behind query the state store\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// a JSON report on stdout keeps stdout to itself, the log and the
+	// annotations go to stderr
+	report := os.Stdout
+	logOutput := os.Stdout
+	if *reportFormat == "json" && *reportFile == "" {
+		logOutput = os.Stderr
+	}
+
+	secrets.addEnv()
+	log, err := newLogger(logOutput, *logFormat, *verbose)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(exitError)
+	}
+	slog.SetDefault(log)
+
+	if *reportFormat != "" && *reportFormat != "text" && *reportFormat != "json" {
+		log.Error(fmt.Sprintf("unknown report format %q, use text or json", *reportFormat))
+		os.Exit(exitError)
+	}
+
+	auth, err := authFromEnv()
+	if err != nil {
+		log.Error("error reading credentials", "error", err)
+		os.Exit(exitError)
+	}
+
+	config, err := loadConfig(os.Getenv("INPUT_CONFIG_FILE"))
+	if err != nil {
+		log.Error("error loading config", "error", err)
+		os.Exit(exitError)
+	}
+
+	if _, err := config.pullRequestTemplate(); err != nil {
+		log.Error("error loading config", "error", err)
+		os.Exit(exitError)
+	}
+
+	notifications, err := newNotifications(config.Notifications)
+	if err != nil {
+		log.Error("error configuring notifications", "error", err)
+		os.Exit(exitError)
+	}
+	store, err := config.stateStore(context.Background(), auth)
+	if err != nil {
+		log.Error("error configuring the state store", "error", err)
+		os.Exit(exitError)
+	}
+	if flag.NArg() > 0 {
+		if err := query(context.Background(), store, report, *reportFormat, flag.Args()); err != nil {
+			log.Error("error querying the state", "error", err)
+			os.Exit(exitError)
+		}
+		return
+	}
+
+	// a single chart from the action inputs or everything in the config file
+	var deps []Dependency
+	if os.Getenv("INPUT_CHART_NAME") != "" {
+		deps = []Dependency{dependencyFromEnv()}
+	} else {
+		deps, err = config.dependencies()
+		if err != nil {
+			log.Error("error reading dependencies", "error", err)
+			os.Exit(exitError)
+		}
+	}
+
+	workers, err := intInput("INPUT_WORKERS", defaultWorkers)
+	if err != nil {
+		log.Error("invalid input", "error", err)
+		os.Exit(exitError)
+	}
+	hostConcurrency, err := intInput("INPUT_HOST_CONCURRENCY", defaultHostConcurrency)
+	if err != nil {
+		log.Error("invalid input", "error", err)
+		os.Exit(exitError)
+	}
+	if *verbose {
+		http.DefaultTransport = &dumpTransport{base: http.DefaultTransport}
+	}
+	http.DefaultTransport = newHostLimitTransport(http.DefaultTransport, hostConcurrency)
+
+	// charts sharing an index are served by a single download
+	for _, dep := range deps {
+		wantChartIndex(dep.ChartIndexURL, dep.ChartName)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	results := runDependencies(ctx, deps, workers, func(ctx context.Context, dep Dependency) DependencyResult {
+		return checkDependency(ctx, dep, auth, config)
+	})
+	// a state that can't be loaded isn't overwritten, the run notifies
+	// without de-duplication and keeps no history instead
+	var state *State
+	if store != nil {
+		if state, err = loadState(ctx, store); err != nil {
+			log.Error("not de-duplicating notifications or recording history", "error", err)
+		}
+	}
+	if state != nil {
+		state.record(results, time.Now().UTC().Truncate(time.Second))
+		state.refreshProposals(ctx, auth, results)
+	}
+	notifications.send(ctx, results, state)
+	if state != nil {
+		if err := saveState(ctx, store, state, results); err != nil {
+			log.Error("state not saved", "error", err)
+		}
+	}
+	stop()
+
+	if *reportFile != "" {
+		f, err := os.Create(*reportFile)
+		if err != nil {
+			log.Error("error writing report", "error", err)
+			os.Exit(exitError)
+		}
+		report = f
+	}
+	if err := writeReport(report, *reportFormat, results); err != nil {
+		log.Error("error writing report", "error", err)
+		os.Exit(exitError)
+	}
+	if *reportFile != "" {
+		if err := report.Close(); err != nil {
+			log.Error("error writing report", "error", err)
+			os.Exit(exitError)
+		}
+	}
+	annotate(logOutput, results)
+	if err := writeOutputs(results); err != nil {
+		log.Error("error writing outputs", "error", err)
+	}
+	if err := writeStepSummary(results); err != nil {
+		log.Error("error writing job summary", "error", err)
+	}
+	os.Exit(exitCode(results))
+}
+
+// checkDependency looks for new app and chart versions of a dependency and
+// proposes them.
+func checkDependency(ctx context.Context, dep Dependency, auth *Auth, config *Config) DependencyResult {
+	result := DependencyResult{Name: dep.ValuesChartName, ChartType: dep.ChartType, ChartVersion: dep.ChartVersion}
+	log := logger(ctx)
+
+	targets, err := config.targetsFor(dep)
+	if err != nil {
+		result.fail(PhaseResolve, err)
+		return result
+	}
+	dep.Targets = targets
+
+	// upstream repos are read with the credentials of this repo
+	token, err := auth.Token(dep.Targets.Values.Owner)
+	if err != nil {
+		result.fail(PhaseResolve, err)
+		return result
+	}
+
+	rules, err := config.versionRules(dep.ValuesChartName, dep.ChartType)
+	if err != nil {
+		result.fail(PhaseResolve, err)
+		return result
+	}
+
+	mergeWaitingUpdates(ctx, dep, auth, config, &result)
+
+	chartVersions, err := listChartVersions(dep.ChartIndexURL, dep.ChartName)
+	if err != nil {
+		result.fail(PhaseFetch, err)
+	}
+	dep.ChartVersions = chartVersions
+	if len(chartVersions) > 0 {
+		result.LatestChartVersion = chartVersions[0].Version
+		result.ChartAppVersion = chartVersions[0].AppVersion
+	}
+	result.DeployedAppVersion = dep.deployedAppVersion()
+
+	// every stable release is a candidate, repositories without releases
+	// fall back to their latest tag
+	var appCandidates []versionCandidate
+	var appReleases []*Release
+	if dep.DockerTagOverride != "" {
+		// the tag is pinned in the matrix, never propose anything newer
+		log.Info("app version pinned by dockertagoverride", "version", dep.DockerTagOverride)
+		appCandidates = append(appCandidates, versionCandidate{version: dep.DockerTagOverride})
+		appReleases = append(appReleases, nil)
+	} else {
+		// page back to the deployed version for the release notes of the PR
+		releases, complete, err := listReleases(dep.Owner, dep.Repo, token, func(release Release) bool {
+			return result.DeployedAppVersion == "" || compareVersions(comparableVersion(dep.dockerTag(release.TagName)), comparableVersion(result.DeployedAppVersion)) <= 0
+		})
+		// a missing repo is left to the tag and chart fallback below
+		if err != nil && !isNotFound(err) {
+			result.fail(PhaseFetch, err)
+		}
+		dep.Releases, dep.ReleasesIncomplete = releases, !complete
+		for i, release := range releases {
+			appCandidates = append(appCandidates, versionCandidate{version: dep.dockerTag(release.TagName), published: release.PublishedAt})
+			appReleases = append(appReleases, &releases[i])
+		}
+		if len(appCandidates) == 0 {
+			tag, err := getLatestReleaseTag(dep.Owner, dep.Repo, token)
+			switch {
+			case err != nil && isNotFound(err) && len(chartVersions) > 0:
+				// neither releases nor tags, go by the chart
+				log.Info("no releases or tags, using the chart version", "error", err)
+				tag = chartVersions[0].Version
+			case err != nil:
+				result.fail(PhaseFetch, err)
+			}
+			if tag != "" {
+				appCandidates = append(appCandidates, versionCandidate{version: dep.dockerTag(tag)})
+				appReleases = append(appReleases, nil)
+			}
+		}
+	}
+
+	for _, candidate := range appCandidates {
+		if dep.DockerTagOverride == "" {
+			result.Observed = append(result.Observed, ObservedVersion{Kind: "app", Version: candidate.version, Published: candidate.published})
+		}
+		if result.UpstreamAppVersion == "" || compareVersions(comparableVersion(candidate.version), comparableVersion(result.UpstreamAppVersion)) > 0 {
+			result.UpstreamAppVersion = candidate.version
+		}
+	}
+
+	appSelection := versionSelection{Latest: -1, Major: -1}
+	if len(chartVersions) > 0 {
+		// the newest published chart tells which app version we run
+		chart_app_version := dep.dockerTag(chartVersions[0].AppVersion)
+		log.Info("app version in chart", "version", chart_app_version)
+		result.AppVersion = chart_app_version
+
+		appSelection = selectVersion(chart_app_version, appCandidates, rules)
+		printSelection(ctx, dep.Repo, appSelection, rules.MinAge)
+
+		if appSelection.Latest >= 0 {
+			i := appSelection.Latest
+			log.Info("new app version upstream", "version", appCandidates[i].version)
+			result.NewAppVersion = appCandidates[i].version
+			result.AppUpdated = updateApp(ctx, dep, auth, config, &result, chart_app_version, appCandidates[i].version, appReleases[i], false)
+		}
+		if appSelection.Major >= 0 {
+			i := appSelection.Major
+			log.Info("new major app version upstream", "version", appCandidates[i].version)
+			result.NewMajorAppVersion = appCandidates[i].version
+			updateApp(ctx, dep, auth, config, &result, chart_app_version, appCandidates[i].version, appReleases[i], true)
+		}
+	}
+	if appSelection.Latest < 0 && appSelection.Major < 0 && dep.SelfManagedChart && dep.DigestMode != "" && dep.DigestRefresh {
+		// same tag as before, check whether it was re-pushed upstream
+		refreshImageDigest(ctx, dep, auth, config, &result)
+	}
+	subchartUpdate := false
+	if dep.SelfManagedChart && !result.AppUpdated {
+		// app updates bump the subcharts along, without one they are
+		// proposed on their own
+		subchartUpdate = updateSubcharts(ctx, dep, auth, config, &result)
+	}
+
+	chartCandidates := make([]versionCandidate, len(chartVersions))
+	for i, version := range chartVersions {
+		chartCandidates[i] = versionCandidate{version: version.Version, published: version.Created}
+		result.Observed = append(result.Observed, ObservedVersion{Kind: "chart", Version: version.Version, Published: version.Created})
+	}
+	chartSelection := selectVersion(dep.ChartVersion, chartCandidates, rules)
+	printSelection(ctx, dep.ChartName, chartSelection, rules.MinAge)
+	log.Info("current chart version", "version", dep.ChartVersion)
+
+	chartUpdate := false
+	if chartSelection.Latest >= 0 {
+		result.NewChartVersion = chartVersions[chartSelection.Latest].Version
+		chartUpdate = updateChart(ctx, dep, auth, config, &result, chartVersions[chartSelection.Latest], false)
+	}
+	if chartSelection.Major >= 0 {
+		result.NewMajorChartVersion = chartVersions[chartSelection.Major].Version
+		chartUpdate = updateChart(ctx, dep, auth, config, &result, chartVersions[chartSelection.Major], true) || chartUpdate
+	}
+	result.ChartUpdated = chartUpdate || subchartUpdate
+	if !chartUpdate {
+		log.Info("chart is up to date")
+	}
+	result.decide(appSelection, chartSelection)
+	return result
+}
+
+// updateApp proposes a new app version for self managed images and charts.
+// Major versions proposed separately are labelled as breaking and the docker
+// repo is left alone for them. It reports whether a change was proposed,
+// apps of charts managed upstream are never proposed here.
+func updateApp(ctx context.Context, dep Dependency, auth *Auth, config *Config, result *DependencyResult, currentVersion, newVersion string, release *Release, breaking bool) bool {
+	if !dep.SelfManagedImage && !dep.SelfManagedChart {
+		return false
+	}
+	// make sure the new images ship every platform we run on
+	log := logger(ctx)
+	held, note := checkPlatforms(ctx, dep.Images, newVersion, dep.Platforms, dep.PlatformPolicy)
+	if held {
+		log.Info("holding back, not all platforms are published yet", "version", newVersion)
+		result.HeldPlatforms = true
+		return false
+	}
+	proposed := len(result.Actions)
+	if breaking {
+		note += majorUpdateNote
+	}
+
+	if dep.SelfManagedImage && breaking {
+		log.Info("not bumping to a major version, merge the chart PR first", "repo", dep.Targets.Images.Repo, "version", newVersion)
+	} else if dep.SelfManagedImage {
+		log.Info("new version of self managed app found", "version", newVersion)
+
+		images := dep.Targets.Images
+		backend, _, err := targetBackend(ctx, auth, images)
+		err = withPhase(PhaseResolve, err)
+		if err == nil {
+			withRepoLock(images.Owner, images.Repo, func() {
+				err = UpdateChartVersion(
+					ctx,
+					backend,
+					images,
+					dep.ChartName,
+					newVersion,
+					resolveImageDigest(ctx, dep.DockerImage, newVersion, dep.DigestMode),
+					dep.Targets.Committer,
+				)
+			})
+		}
+		if err != nil {
+			result.fail(PhaseEdit, err)
+		} else {
+			result.proposed("app", images, newVersion, nil).Release = release.URL()
+		}
+	}
+	if dep.SelfManagedChart {
+		log.Info("new version of self managed chart found", "version", newVersion)
+
+		charts := dep.Targets.Charts
+		backend, client, err := targetBackend(ctx, auth, charts)
+		if err != nil {
+			result.fail(PhaseResolve, err)
+			return len(result.Actions) > proposed
+		}
+		body, err := newPullRequestBody(dep, config, dep.ChartName, extractVersion(currentVersion), extractVersion(newVersion), currentVersion, newVersion, note)
+		if err != nil {
+			result.fail(PhaseResolve, err)
+			return len(result.Actions) > proposed
+		}
+		var pr *github.PullRequest
+		withRepoLock(charts.Owner, charts.Repo, func() {
+			pr, err = UpdateHelmChartVersionsWithPR(
+				ctx,
+				backend,
+				charts,
+				dep.ChartName,
+				extractVersion(newVersion),
+				newVersion,
+				dep.ValuesImagePath,
+				dep.DockerImage,
+				dep.DigestMode,
+				release,
+				body,
+				dep.Targets.Committer,
 			)
 			if err != nil {
-				fmt.Println("error encountered: ", err)
+				result.fail(PhaseEdit, err)
+			} else {
+				result.proposed("app", charts, newVersion, pr).Release = release.URL()
 			}
-			info := chartName + " new version for image!"
-			slackWebhookURL := os.Getenv("SLACK_WEBHOOK_URL")
-			if err := sendSlackNotification(slackWebhookURL, info); err != nil {
-				fmt.Printf("Failed to send Slack notification: %v\n", err)
+			if breaking {
+				if err := labelPullRequest(ctx, client, charts.Owner, charts.Repo, pr, breakingLabel); err != nil {
+					result.fail(PhasePublish, err)
+				}
 			}
+		})
+		mergePolicy := config.findMergePolicy(dep.ValuesChartName, dep.ChartType)
+		if err := applyMergePolicy(ctx, client, charts.Owner, charts.Repo, pr, mergePolicy, getUpdateType(currentVersion, newVersion)); err != nil {
+			result.fail(PhasePublish, err)
 		}
-		if selfManagedChart == "true" {
-			fmt.Println("new version found of self managed chart found")
-
-			err4 := UpdateHelmChartVersionsWithPR(
-				chartName,
-				"loeken",
-				"helm-charts",
-				"charts/"+chartName+"/Chart.yaml",
-				extractVersion(app_version),
-				app_version,
-				"main",
-				token,
-			)
-			if err4 != nil {
-				fmt.Println("error encountered: ", err4)
+	}
+	return len(result.Actions) > proposed
+}
+
+// updateChart proposes a new chart version to the homelab and to the values
+// in this repo, either in PRs of its own or as part of a group. Major versions
+// proposed separately are labelled as breaking and never grouped. It reports
+// whether a change was proposed.
+func updateChart(ctx context.Context, dep Dependency, auth *Auth, config *Config, result *DependencyResult, chart ChartVersion, breaking bool) bool {
+	// the new chart deploys its appVersion, check those images too
+	log := logger(ctx)
+	held, note := checkPlatforms(ctx, dep.Images, dep.dockerTag(chart.AppVersion), dep.Platforms, dep.PlatformPolicy)
+	if held {
+		log.Info("holding back chart, not all platforms are published yet", "version", chart.Version)
+		result.HeldPlatforms = true
+		return false
+	}
+	if breaking {
+		note += majorUpdateNote
+	}
+	log.Info("new chart version found", "version", chart.Version)
+	proposed := len(result.Actions)
+
+	chartUpdateType := getUpdateType(dep.ChartVersion, chart.Version)
+	// group PRs live in the PR body, only the GitHub backend has them
+	groupable := dep.Targets.Homelab.github() && dep.Targets.Values.github()
+	if !breaking && groupable {
+		if group := config.findGroup(dep.ValuesChartName, dep.ChartType, chartUpdateType); group != nil {
+			return updateChartGroup(ctx, dep, auth, result, group, chart, note)
+		}
+	}
+
+	var labels []string
+	if breaking {
+		labels = append(labels, breakingLabel)
+	}
+	mergePolicy := config.findMergePolicy(dep.ValuesChartName, dep.ChartType)
+
+	// the release notes of the apps deployed by the current and the new chart
+	body, err := newPullRequestBody(dep, config, dep.ValuesChartName, dep.ChartVersion, extractVersion(chart.Version), dep.deployedAppVersion(), dep.dockerTag(chart.AppVersion), note)
+	if err != nil {
+		result.fail(PhaseResolve, err)
+		return false
+	}
+	body.Created = chart.Created
+
+	// update homelab
+	homelab := dep.Targets.Homelab
+	if backend, client, err := targetBackend(ctx, auth, homelab); err != nil {
+		result.fail(PhaseResolve, err)
+	} else {
+		var pr1 *github.PullRequest
+		withRepoLock(homelab.Owner, homelab.Repo, func() {
+			var err1 error
+			pr1, err1 = UpdateTargetRevision(ctx, backend, homelab, dep.ValuesChartName, extractVersion(chart.Version), body, dep.Targets.Committer)
+			if err1 != nil {
+				result.fail(PhaseEdit, err1)
+			} else {
+				result.proposed("chart", homelab, chart.Version, pr1)
+			}
+			if err := labelPullRequest(ctx, client, homelab.Owner, homelab.Repo, pr1, labels...); err != nil {
+				result.fail(PhasePublish, err)
 			}
-			// prMessage := fmt.Sprintf("updated helm charts: https://github.com/loeken/helm-charts/pulls")
-	
-			// // Send a Slack notification
-			// slackWebhookURL := os.Getenv("SLACK_WEBHOOK_URL") // Make sure this environment variable is set in your GitHub Action
-			// if err := sendSlackNotification(slackWebhookURL, prMessage); err != nil {
-			// 	fmt.Printf("Failed to send Slack notification: %v\n", err)
-			// }
-		}
-		
-	}
-	if compareVersions(oldChartVersion, chartInfo.Version) < 0 {
-		fmt.Println("new version found of chart")
-		
-		// update homelab
-		err1 := UpdateTargetRevision(valuesChartName, "loeken", "homelab", "deploy/argocd/bootstrap-" + chartType + "-apps/templates/"+valuesChartName+".yaml", extractVersion(chartInfo.Version), "main", token)
-		if err1 != nil {
-			fmt.Println("error encountered: ", err1)
-		}
-
-		// update values in this repo
-		fmt.Println("lets goo 2")
-		fmt.Println(valuesChartName, "loeken", "homelab-updater", "values-" + chartType + ".yaml", valuesChartName, "chartVersion", extractVersion(chartInfo.Version), "main", token)
-		err2 := UpdateChartVersionWithPR(valuesChartName, "loeken", "homelab-updater", "values-" + chartType + ".yaml", valuesChartName, "chartVersion", extractVersion(chartInfo.Version), "main", token)
-		if err2 != nil {
-			fmt.Println("error encountered: ", err2)
-		}
-
-		prMessage := fmt.Sprintf("Created pull request https://github.com/loeken/homelab/pulls & https://github.com/loeken/homelab-updater/pulls ")
-	
-		// Send a Slack notification
-		slackWebhookURL := os.Getenv("SLACK_WEBHOOK_URL") // Make sure this environment variable is set in your GitHub Action
-		if err := sendSlackNotification(slackWebhookURL, prMessage); err != nil {
-			fmt.Printf("Failed to send Slack notification: %v\n", err)
-		}
-		os.Exit(1)
+		})
+		if err := applyMergePolicy(ctx, client, homelab.Owner, homelab.Repo, pr1, mergePolicy, chartUpdateType); err != nil {
+			result.fail(PhasePublish, err)
+		}
+	}
+
+	// update values in this repo
+	values := dep.Targets.Values
+	if backend, client, err := targetBackend(ctx, auth, values); err != nil {
+		result.fail(PhaseResolve, err)
 	} else {
-		fmt.Println("chart is up2date")
+		var pr2 *github.PullRequest
+		withRepoLock(values.Owner, values.Repo, func() {
+			var err2 error
+			pr2, err2 = UpdateChartVersionWithPR(ctx, backend, values, dep.ValuesChartName, dep.ValuesChartName, "chartVersion", extractVersion(chart.Version), body, dep.Targets.Committer)
+			if err2 != nil {
+				result.fail(PhaseEdit, err2)
+			} else {
+				result.proposed("chart", values, chart.Version, pr2)
+			}
+			if err := labelPullRequest(ctx, client, values.Owner, values.Repo, pr2, labels...); err != nil {
+				result.fail(PhasePublish, err)
+			}
+		})
+		if err := applyMergePolicy(ctx, client, values.Owner, values.Repo, pr2, mergePolicy, chartUpdateType); err != nil {
+			result.fail(PhasePublish, err)
+		}
+	}
+	return len(result.Actions) > proposed
+}
+
+// mergeWaitingUpdates merges the update PRs of dep earlier runs left to
+// their checks under a direct merge policy.
+func mergeWaitingUpdates(ctx context.Context, dep Dependency, auth *Auth, config *Config, result *DependencyResult) {
+	policy := config.findMergePolicy(dep.ValuesChartName, dep.ChartType)
+	if policy == nil || policy.Mode != mergeModeDirect {
+		return
+	}
+	// the PRs to the charts repo are named after the chart
+	targets := []Target{dep.Targets.Homelab, dep.Targets.Values}
+	names := []string{dep.ValuesChartName, dep.ValuesChartName}
+	if dep.SelfManagedChart {
+		targets = append(targets, dep.Targets.Charts)
+		names = append(names, dep.ChartName)
+	}
+	seen := make(map[string]bool)
+	for i, t := range targets {
+		key := t.Owner + "/" + t.Repo + " " + names[i]
+		if !t.github() || seen[key] {
+			continue
+		}
+		seen[key] = true
+		_, client, err := targetBackend(ctx, auth, t)
+		if err != nil {
+			result.fail(PhaseResolve, err)
+			continue
+		}
+		if err := mergeWaitingPullRequests(ctx, client, t.Owner, t.Repo, names[i], policy); err != nil {
+			result.fail(PhasePublish, err)
+		}
+	}
+}
+
+// refreshImageDigest proposes the current digest of an unchanged tag to the
+// chart of a self managed image.
+func refreshImageDigest(ctx context.Context, dep Dependency, auth *Auth, config *Config, result *DependencyResult) {
+	charts := dep.Targets.Charts
+	backend, client, err := targetBackend(ctx, auth, charts)
+	if err != nil {
+		result.fail(PhaseResolve, err)
+		return
+	}
+	var pr *github.PullRequest
+	withRepoLock(charts.Owner, charts.Repo, func() {
+		pr, err = RefreshImageDigestWithPR(
+			ctx,
+			backend,
+			charts,
+			dep.ChartName,
+			dep.ValuesImagePath,
+			dep.DockerImage,
+			dep.DigestMode,
+			dep.Targets.Committer,
+		)
+	})
+	if err != nil {
+		result.fail(PhaseEdit, err)
+	} else if pr != nil {
+		result.proposed("digest", charts, "", pr)
+	}
+	mergePolicy := config.findMergePolicy(dep.ValuesChartName, dep.ChartType)
+	if err := applyMergePolicy(ctx, client, charts.Owner, charts.Repo, pr, mergePolicy, updateTypePatch); err != nil {
+		result.fail(PhasePublish, err)
+	}
+}
+
+// updateSubcharts proposes the outdated subcharts of a self managed chart.
+// It reports whether a change was proposed.
+func updateSubcharts(ctx context.Context, dep Dependency, auth *Auth, config *Config, result *DependencyResult) bool {
+	charts := dep.Targets.Charts
+	backend, client, err := targetBackend(ctx, auth, charts)
+	if err != nil {
+		result.fail(PhaseResolve, err)
+		return false
+	}
+	body, err := newPullRequestBody(dep, config, dep.ChartName, "", "", "", "", "")
+	if err != nil {
+		result.fail(PhaseResolve, err)
+		return false
+	}
+	proposed := len(result.Actions)
+	var pr *github.PullRequest
+	withRepoLock(charts.Owner, charts.Repo, func() {
+		var version string
+		pr, version, err = UpdateSubchartsWithPR(ctx, backend, charts, dep.ChartName, body, dep.Targets.Committer)
+		if err != nil {
+			result.fail(PhaseEdit, err)
+		} else if version != "" {
+			result.proposed("subcharts", charts, version, pr)
+		}
+	})
+	if len(result.Actions) == proposed {
+		return false
+	}
+	mergePolicy := config.findMergePolicy(dep.ValuesChartName, dep.ChartType)
+	if err := applyMergePolicy(ctx, client, charts.Owner, charts.Repo, pr, mergePolicy, updateTypePatch); err != nil {
+		result.fail(PhasePublish, err)
+	}
+	return true
+}
+
+// updateChartGroup adds a chart update to the group PRs in the homelab and in
+// this repo. Group PRs are left for review.
+func updateChartGroup(ctx context.Context, dep Dependency, auth *Auth, result *DependencyResult, group *UpdateGroup, chart ChartVersion, note string) bool {
+	newVersion := extractVersion(chart.Version)
+	member := GroupMember{Name: dep.ValuesChartName, OldVersion: dep.ChartVersion, NewVersion: newVersion, Note: note}
+
+	targets := []struct {
+		target Target
+		edit   func([]byte) ([]byte, error)
+	}{
+		{dep.Targets.Homelab, func(content []byte) ([]byte, error) {
+			return setTargetRevision(content, newVersion)
+		}},
+		{dep.Targets.Values, func(content []byte) ([]byte, error) {
+			return setValuesVersion(content, dep.ValuesChartName, "chartVersion", newVersion)
+		}},
+	}
+
+	var prs []*github.PullRequest
+	for _, target := range targets {
+		t := target.target
+		_, client, err := targetBackend(ctx, auth, t)
+		if err != nil {
+			result.fail(PhaseResolve, err)
+			continue
+		}
+		var pr *github.PullRequest
+		var groupMembers []GroupMember
+		withRepoLock(t.Owner, t.Repo, func() {
+			pr, groupMembers, err = updateGroupPR(ctx, client, t.Owner, t.Repo, t.Branch, group, member, dep.Targets.Committer, map[string]func([]byte) ([]byte, error){
+				t.Path: target.edit,
+			})
+		})
+		if err != nil {
+			result.fail(PhasePublish, err)
+			continue
+		}
+		if groupMembers == nil {
+			continue
+		}
+		prs = append(prs, pr)
+		result.proposed("group", t, chart.Version, pr)
+	}
+	return len(prs) > 0
+}
 
+// labelPullRequest adds labels to a GitHub PR, nothing happens without a
+// client, a PR or labels.
+func labelPullRequest(ctx context.Context, client *github.Client, owner, repo string, pr *github.PullRequest, labels ...string) error {
+	if client == nil || pr == nil || len(labels) == 0 {
+		return nil
 	}
+	_, _, err := client.Issues.AddLabelsToIssue(ctx, owner, repo, pr.GetNumber(), labels)
+	return err
+}
+
+// newGitHubClient returns a go-github client authenticated with token.
+func newGitHubClient(ctx context.Context, token string) *github.Client {
+	ts := oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: token},
+	)
+	return newGitHubClientWithTokenSource(ctx, ts)
+}
+
+// newGitHubClientWithTokenSource returns a go-github client authenticated
+// with the tokens of ts. It goes through the shared GitHub transport for
+// retries and caching.
+func newGitHubClientWithTokenSource(ctx context.Context, ts oauth2.TokenSource) *github.Client {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, newGitHubHTTPClient())
+	tc := oauth2.NewClient(ctx, ts)
+
+	return github.NewClient(tc)
 }
+
 func compareVersions(version1, version2 string) int {
 	parts1 := strings.Split(version1, ".")
 	parts2 := strings.Split(version2, ".")
@@ -201,54 +823,44 @@ func compareVersions(version1, version2 string) int {
 	return 0
 }
 
-func getLatestChartVersion(chartIndexURL, chartName string) (*ChartVersion, error) {
-
-	resp, err := http.Get(chartIndexURL)
+// listChartVersions returns the stable versions of a chart in the order of
+// the index, which is newest first.
+func listChartVersions(chartIndexURL, chartName string) ([]ChartVersion, error) {
+	versions, err := chartIndexEntries(chartIndexURL, chartName)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
+	// Collect the stable versions of the specified chart
+	var stable []ChartVersion
+	for _, version := range versions {
+		if !strings.Contains(version.Version, "alpha") && !strings.Contains(version.Version, "beta") {
+			strippedTag := strings.TrimPrefix(version.Version, "v")
 
-	var index ChartIndex
-	err = yaml.Unmarshal(body, &index)
-	if err != nil {
-		return nil, err
-	}
-
-	// Find the latest stable version of the specified chart
-	if versions, ok := index.Entries[chartName]; ok {
-		for _, version := range versions {
-			if !strings.Contains(version.Version, "alpha") && !strings.Contains(version.Version, "beta") {
-				strippedTag := strings.TrimPrefix(version.Version, "v")
-
-				parts := strings.Split(strippedTag, ".")
-				if len(parts) > 3 {
-					parts = parts[:3]
-				}
-				versionStr := strings.Join(parts, ".")
-				return &ChartVersion{Version: versionStr, AppVersion: version.AppVersion}, nil
+			parts := strings.Split(strippedTag, ".")
+			if len(parts) > 3 {
+				parts = parts[:3]
 			}
+			versionStr := strings.Join(parts, ".")
+
+			stable = append(stable, ChartVersion{Version: versionStr, AppVersion: version.AppVersion, Created: version.Created})
 		}
+	}
+	if len(stable) == 0 {
 		return nil, fmt.Errorf("no stable version found for chart %s", chartName)
 	}
-
-	return nil, fmt.Errorf("chart %s not found", chartName)
+	return stable, nil
 }
 func getLatestReleaseTag(owner, repo, token string) (string, error) {
 	// Try to get the latest release first
-	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/releases/latest", owner, repo)
+	url := fmt.Sprintf("%s/repos/%s/%s/releases/latest", githubAPIURL, owner, repo)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return "", err
 	}
-	req.SetBasicAuth("loeken", token)
+	req.Header.Set("Authorization", "token "+token)
 
-	client := &http.Client{}
+	client := newGitHubHTTPClient()
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", err
@@ -269,12 +881,12 @@ func getLatestReleaseTag(owner, repo, token string) (string, error) {
 		return strippedTag, nil
 	} else if resp.StatusCode == http.StatusNotFound {
 		// If no releases found, get the latest tag
-		url = fmt.Sprintf("https://api.github.com/repos/%s/%s/tags", owner, repo)
+		url = fmt.Sprintf("%s/repos/%s/%s/tags", githubAPIURL, owner, repo)
 		req, err = http.NewRequest("GET", url, nil)
 		if err != nil {
 			return "", err
 		}
-		req.SetBasicAuth("loeken", token)
+		req.Header.Set("Authorization", "token "+token)
 
 		resp, err = client.Do(req)
 		if err != nil {
@@ -283,7 +895,7 @@ func getLatestReleaseTag(owner, repo, token string) (string, error) {
 		defer resp.Body.Close()
 
 		if resp.StatusCode != http.StatusOK {
-			return "", fmt.Errorf("failed to get latest tag: %s", resp.Status)
+			return "", fmt.Errorf("failed to get latest tag: %w", newStatusError(resp, ""))
 		}
 
 		var tags []struct {
@@ -302,51 +914,19 @@ func getLatestReleaseTag(owner, repo, token string) (string, error) {
 		strippedTag := strings.TrimPrefix(tags[0].Name, "v")
 		return strippedTag, nil
 	} else {
-		return "", fmt.Errorf("failed to get latest release tag: %s", resp.Status)
+		return "", fmt.Errorf("failed to get latest release tag: %w", newStatusError(resp, ""))
 	}
 }
-func UpdateChartVersion(chartName, owner, repo, filename, parentBlock, subBlock, newVersion, branch, token string) error {
-
-	client := &http.Client{}
-
-	// GET request to fetch file contents
-	fmt.Printf(fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/%s", owner, repo, filename))
-	getReq, err := http.NewRequest("GET", fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/%s", owner, repo, filename), nil)
-	if err != nil {
-		return err
-	}
-
-	getReq.Header.Set("Authorization", "token "+token)
-
-	getResp, err := client.Do(getReq)
-	if err != nil {
-		return err
-	}
-	defer getResp.Body.Close()
-
-	getBody, err := ioutil.ReadAll(getResp.Body)
-	if err != nil {
-		return err
-	}
-
-	fmt.Println("GET request status: ", getResp.Status)
-	fmt.Println("GET request body: ", string(getBody))
-
-	// Unmarshal the response
-	getRespMap := make(map[string]interface{})
-	err = json.Unmarshal(getBody, &getRespMap)
-	if err != nil {
-		return err
-	}
-
-	// Decode content
-	decodedContent, err := base64.StdEncoding.DecodeString(getRespMap["content"].(string))
+// UpdateChartVersion sets env.version (and env.digest) in the version file of
+// a self managed docker image, straight on its base branch.
+func UpdateChartVersion(ctx context.Context, backend Backend, t Target, chartName, newVersion, digest string, committer *github.CommitAuthor) error {
+	content, err := backend.ReadFile(ctx, t, t.Path)
 	if err != nil {
 		return err
 	}
 
 	yamlMap := make(map[interface{}]interface{})
-	err = yaml.Unmarshal(decodedContent, &yamlMap)
+	err = yaml.Unmarshal(content, &yamlMap)
 	if err != nil {
 		return err
 	}
@@ -356,110 +936,44 @@ func UpdateChartVersion(chartName, owner, repo, filename, parentBlock, subBlock,
 		return fmt.Errorf("no env section found in the file")
 	}
 	env["version"] = newVersion
-
-	updatedContent, err := yaml.Marshal(yamlMap)
-	if err != nil {
-		return err
-	}
-	fmt.Println("sha of file:", getRespMap["sha"])
-	// Prepare request body for the PUT request
-	putReqBody := map[string]interface{}{
-		"message": "Update version to " + newVersion,
-		"content": base64.StdEncoding.EncodeToString(updatedContent),
-		"branch":  branch,
-		"sha":     getRespMap["sha"],
-		"committer": map[string]string{
-			"name":  "loeken",
-			"email": "loeken@internetz.me",
-		},
-	}
-	putReqBodyBytes, err := json.Marshal(putReqBody)
-	if err != nil {
-		return err
-	}
-
-	// PUT request to update file
-	putReq, err := http.NewRequest("PUT", fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/%s", owner, repo, filename), bytes.NewBuffer(putReqBodyBytes))
-	if err != nil {
-		return err
-	}
-
-	putReq.Header.Set("Accept", "application/vnd.github+json")
-	putReq.Header.Set("Authorization", "Bearer "+token)
-	putReq.Header.Set("X-GitHub-Api-Version", "2022-11-28")
-	putReq.Header.Set("Content-Type", "application/json")
-
-	putResp, err := client.Do(putReq)
-	if err != nil {
-		return err
+	if digest != "" {
+		env["digest"] = digest
+	} else {
+		delete(env, "digest")
 	}
-	defer putResp.Body.Close()
 
-	putBody, err := ioutil.ReadAll(putResp.Body)
+	updatedContent, err := yaml.Marshal(yamlMap)
 	if err != nil {
 		return err
 	}
-
-	fmt.Println("PUT request status: ", putResp.Status)
-	fmt.Println("PUT request body: ", string(putBody))
-
-	return nil
-}
-func UpdateChartVersionWithPR(chartName, owner, repo, filename, parentBlock, subBlock, newVersion, branch, token string) error {
-
-	fmt.Println(repo, chartName, filename, owner, branch)
-	ctx := context.Background()
-
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: token},
-	)
-	tc := oauth2.NewClient(ctx, ts)
-
-	client := github.NewClient(tc)
-
-	// Get the current contents of the file
-	fileContent, _, _, err := client.Repositories.GetContents(ctx, owner, repo, filename, &github.RepositoryContentGetOptions{
-		Ref: branch,
+	_, err = backend.Propose(ctx, t, Change{
+		Message:   "Update version to " + newVersion,
+		Files:     map[string][]byte{t.Path: updatedContent},
+		Committer: committer,
 	})
-	if err != nil {
-
-		fmt.Println("error getting file content:", err)
-		return err
-	}
-
-	// Decode the file content from base64
-	contentBytes, err := fileContent.GetContent()
-	if err != nil {
-		fmt.Printf("error decoding file content: %v", err)
-		return err
-	}
-
-	// Update the YAML value
-
-	// Convert contentBytes to a byte slice
-	content := []byte(contentBytes)
+	return withPhase(PhasePublish, err)
+}
 
+// setValuesVersion sets parentBlock.subBlock in a values file to newVersion.
+func setValuesVersion(content []byte, parentBlock, subBlock, newVersion string) ([]byte, error) {
 	// Unmarshal the YAML content into a map
 	//values := make(map[string]interface{})
 	values := make(map[interface{}]interface{})
 	if err := yaml.Unmarshal(content, &values); err != nil {
-		fmt.Printf("error unmarshalling YAML: %v", err)
-		return err
+		return nil, err
 	}
 
 	parent, ok := values[parentBlock]
     if !ok {
         // Handle the case where the parent block does not exist. You might want to create it or return an error.
-        fmt.Printf("Parent block %s does not exist in YAML\n", parentBlock)
-        return fmt.Errorf("parent block %s does not exist in YAML", parentBlock)
+        return nil, fmt.Errorf("parent block %s does not exist in YAML", parentBlock)
     }
 
     // Check if the parent is of type map[interface{}]interface{}
     parentMap, ok := parent.(map[interface{}]interface{})
     if !ok {
         // Handle the case where the parent block is not a map. This could indicate a malformed YAML or an unexpected structure.
-        fmt.Printf("Parent block %s is not a map\n", parentBlock)
-        return fmt.Errorf("parent block %s is not a map", parentBlock)
+        return nil, fmt.Errorf("parent block %s is not a map", parentBlock)
     }
 	parentMap[subBlock] = newVersion
 
@@ -470,84 +984,43 @@ func UpdateChartVersionWithPR(chartName, owner, repo, filename, parentBlock, sub
 	// Marshal the updated values back to YAML
 	updatedContent, err := yaml.Marshal(values)
 	if err != nil {
-		fmt.Printf("error marshalling YAML: %v", err)
-		return err
-	}
-	// fmt.Println(updatedContent)
-	// Create a new blob object for the updated content
-	newBlob, _, err := client.Git.CreateBlob(ctx, owner, repo, &github.Blob{
-		Content:  github.String(string(updatedContent)),
-		Encoding: github.String("utf-8"),
-	})
-	if err != nil {
-		fmt.Println("Error creating blob: ", err)
-		return err
+		return nil, err
 	}
-	fmt.Println("New blob SHA:", *newBlob.SHA)
+	return updatedContent, nil
+}
+func UpdateChartVersionWithPR(ctx context.Context, backend Backend, t Target, chartName, parentBlock, subBlock, newVersion string, body *PullRequestBody, committer *github.CommitAuthor) (*github.PullRequest, error) {
 
-	// Get the latest commit object for the branch
-	ref, _, err := client.Git.GetRef(ctx, owner, repo, fmt.Sprintf("refs/heads/%s", branch))
-	if err != nil {
-		fmt.Printf("error getting ref: %v", err)
-		return err
-	}
-	parentSHA := ref.Object.GetSHA()
-	// Create a new tree object with the updated file
-	newTree, _, err := client.Git.CreateTree(ctx, owner, repo, parentSHA, []*github.TreeEntry{
-		{
-			Path: github.String(fileContent.GetPath()),
-			Mode: github.String("100644"),
-			Type: github.String("blob"),
-			SHA:  newBlob.SHA,
-		},
-	})
+
+	// Get the current contents of the file
+	content, err := backend.ReadFile(ctx, t, t.Path)
 	if err != nil {
-		fmt.Printf("error creating tree: %v", err)
-		return err
+		return nil, err
 	}
 
-	// Create a new commit object with the updated tree object
-	newCommit, _, err := client.Git.CreateCommit(ctx, owner, repo, &github.Commit{
-		Message: github.String(fmt.Sprintf("Update %s to version %s", chartName, newVersion)),
-		Tree:    newTree,
-		Parents: []*github.Commit{{SHA: &parentSHA}},
-	})
+	// Update the YAML value
+	updatedContent, err := setValuesVersion(content, parentBlock, subBlock, newVersion)
 	if err != nil {
-		fmt.Printf("error creating commit: %v", err)
-		return err
+		return nil, err
 	}
 
-	// Create a new reference for the updated commit
-	newBranch := fmt.Sprintf("refs/heads/update-%s-to-%s", chartName, newVersion)
-	_, _, err = client.Git.CreateRef(ctx, owner, repo, &github.Reference{
-		Ref:    github.String(newBranch),
-		Object: &github.GitObject{SHA: newCommit.SHA},
-	})
+	description, err := body.render()
 	if err != nil {
-		fmt.Printf("error creating reference: %v", err)
-		return err
+		return nil, err
 	}
 
-	// Create a pull request with the changes
+	// Commit the file on a new branch and propose it
 	title := fmt.Sprintf("Update %s to version %s", chartName, newVersion)
-	body := fmt.Sprintf("Update %s to version %s", chartName, newVersion)
-	newPR, _, err := client.PullRequests.Create(ctx, owner, repo, &github.NewPullRequest{
-		Title: github.String(title),
-		Body:  github.String(body),
-		Head:  github.String(newBranch),
-		Base:  github.String(branch),
+	pr, err := backend.Propose(ctx, t, Change{
+		Branch:    fmt.Sprintf("update-%s-to-%s", chartName, newVersion),
+		Message:   title,
+		Title:     title,
+		Body:      description,
+		Files:     map[string][]byte{t.Path: updatedContent},
+		Committer: committer,
 	})
-	if err != nil {
-		fmt.Printf("failed to create pull request: %v", err)
-		return err
-	}
-
-	// Print the URL of the new pull request
-	fmt.Printf("Created pull request %s\n", newPR.GetHTMLURL())
-
-	return nil
+	return pr, withPhase(PhasePublish, err)
 }
-func updateYAMLContent(values map[interface{}]interface{}, newVersion string, appVersion string) {
+func updateYAMLContent(values map[interface{}]interface{}, newVersion string, appVersion string, changes []ArtifactHubChange) error {
 	// Update appVersion
 	values["appVersion"] = appVersion
 
@@ -555,11 +1028,17 @@ func updateYAMLContent(values map[interface{}]interface{}, newVersion string, ap
 	values["version"] = newVersion
 
 	// Update annotations
-	if annotations, ok := values["annotations"].(map[interface{}]interface{}); ok {
-		newVersion = strings.Replace(newVersion, "-", " ", -1)
-		updatedChanges := fmt.Sprintf("- kind: changed\n  description: updated to %s", newVersion)
-		annotations["artifacthub.io/changes"] = updatedChanges
+	annotations, ok := values["annotations"].(map[interface{}]interface{})
+	if !ok {
+		annotations = make(map[interface{}]interface{})
+		values["annotations"] = annotations
+	}
+	updatedChanges, err := renderChartChanges(changes)
+	if err != nil {
+		return err
 	}
+	annotations["artifacthub.io/changes"] = updatedChanges
+	return nil
 }
 func extractVersion(input string) string {
 	// Use regular expression to extract version patterns
@@ -581,166 +1060,280 @@ func extractVersion(input string) string {
 	return strings.Join(versionParts[:3], ".")
 }
 
-func UpdateHelmChartVersionsWithPR(chartName, owner, repo, filename, newVersion, appVersion, branch, token string) error {
-	ctx := context.Background()
-
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: token},
-	)
-	tc := oauth2.NewClient(ctx, ts)
-
-	client := github.NewClient(tc)
-
-	// Get the current contents of the file
-	fileContent, _, _, err := client.Repositories.GetContents(ctx, owner, repo, filename, &github.RepositoryContentGetOptions{
-		Ref: branch,
-	})
+// nextPatchVersion bumps the patch of a chart version, 1.2.3 to 1.2.4.
+func nextPatchVersion(version string) (string, error) {
+	parts := strings.Split(extractVersion(version), ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid chart version %q", version)
+	}
+	patch, err := strconv.Atoi(parts[2])
 	if err != nil {
-		fmt.Println("error getting file content:", err)
-		return err
+		return "", fmt.Errorf("invalid chart version %q", version)
 	}
+	parts[2] = strconv.Itoa(patch + 1)
+	return strings.Join(parts, "."), nil
+}
 
-	// Decode the file content from base64
-	contentBytes, err := fileContent.GetContent()
+func UpdateHelmChartVersionsWithPR(ctx context.Context, backend Backend, t Target, chartName, newVersion, appVersion, valuesImagePath, dockerImage, digestMode string, release *Release, body *PullRequestBody, committer *github.CommitAuthor) (*github.PullRequest, error) {
+	// Get the current contents of the file
+	content, err := backend.ReadFile(ctx, t, t.Path)
 	if err != nil {
-		fmt.Printf("error decoding file content: %v", err)
-		return err
+		return nil, err
 	}
 
-	// Convert contentBytes to a byte slice
-	content := []byte(contentBytes)
-
 	// Unmarshal the YAML content into a map
 	values := make(map[interface{}]interface{})
 	if err := yaml.Unmarshal(content, &values); err != nil {
-		fmt.Printf("error unmarshalling YAML: %v", err)
-		return err
+		return nil, err
+	}
+
+	// subchart updates bump the patch version, the chart may be past the app
+	if current := fmt.Sprint(values["version"]); compareVersions(newVersion, extractVersion(current)) <= 0 {
+		if newVersion, err = nextPatchVersion(current); err != nil {
+			return nil, err
+		}
+		body.Title = fmt.Sprintf("Update %s to version %s", chartName, newVersion)
+		body.NewVersion = newVersion
+	}
+
+	// Bump the subcharts in the dependencies block
+	lockPath, lock, depUpdates, err := updateChartLock(ctx, backend, t, values)
+	if err != nil {
+		return nil, err
 	}
 
 	// Update the specific blocks in the YAML
-	updateYAMLContent(values, newVersion, appVersion)
+	changes := buildChartChanges(appVersion, depUpdates, release)
+	if err := updateYAMLContent(values, newVersion, appVersion, changes); err != nil {
+		return nil, err
+	}
 
 	// Marshal the updated values back to YAML
 	updatedContent, err := yaml.Marshal(values)
 	if err != nil {
-		fmt.Printf("error marshalling YAML: %v", err)
-		return err
+		return nil, err
 	}
 
-	// Create a new blob object for the updated content
-	newBlob, _, err := client.Git.CreateBlob(ctx, owner, repo, &github.Blob{
-		Content:  github.String(string(updatedContent)),
-		Encoding: github.String("utf-8"),
-	})
-	if err != nil {
-		fmt.Println("Error creating blob: ", err)
-		return err
+	files := map[string][]byte{
+		t.Path: updatedContent,
+	}
+	if lock != nil {
+		files[lockPath] = lock
 	}
 
-	// Get the latest commit object for the branch
-	ref, _, err := client.Git.GetRef(ctx, owner, repo, fmt.Sprintf("refs/heads/%s", branch))
+	// Bump the image tag in values.yaml so the chart deploys the new image
+	valuesPath := path.Join(path.Dir(t.Path), "values.yaml")
+	updatedValues, err := updateChartValuesImage(ctx, backend, t, valuesPath, valuesImagePath, dockerImage, appVersion, digestMode)
 	if err != nil {
-		fmt.Printf("error getting ref: %v", err)
-		return err
+		return nil, err
+	}
+	if updatedValues != nil {
+		files[valuesPath] = updatedValues
 	}
-	parentSHA := ref.Object.GetSHA()
 
-	// Create a new tree object with the updated file
-	newTree, _, err := client.Git.CreateTree(ctx, owner, repo, parentSHA, []*github.TreeEntry{
-		{
-			Path: github.String(fileContent.GetPath()),
-			Mode: github.String("100644"),
-			Type: github.String("blob"),
-			SHA:  newBlob.SHA,
-		},
+	// Commit Chart.yaml and Chart.lock together and open the pull request
+	title := fmt.Sprintf("Update %s to version %s", chartName, newVersion)
+	body.Dependencies = depUpdates
+	description, err := body.render()
+	if err != nil {
+		return nil, err
+	}
+	newPR, err := backend.Propose(ctx, t, Change{
+		Branch:    fmt.Sprintf("update-%s-to-%s", chartName, newVersion),
+		Message:   title,
+		Title:     title,
+		Body:      description,
+		Files:     files,
+		Committer: committer,
 	})
+	return newPR, withPhase(PhasePublish, err)
+}
+
+// updateChartLock bumps the subcharts in the dependencies block of values,
+// the Chart.yaml at t.Path, and returns the path and content of the
+// Chart.lock to commit with it. The content is nil without dependencies.
+func updateChartLock(ctx context.Context, backend Backend, t Target, values map[interface{}]interface{}) (string, []byte, []DependencyUpdate, error) {
+	// version ranges keep the version of the existing Chart.lock
+	lockPath := path.Join(path.Dir(t.Path), "Chart.lock")
+	var oldLock *ChartLock
+	lockContent, err := backend.ReadFile(ctx, t, lockPath)
+	switch {
+	case err == nil:
+		oldLock = &ChartLock{}
+		if err := yaml.Unmarshal(lockContent, oldLock); err != nil {
+			return "", nil, nil, fmt.Errorf("error parsing %s: %v", lockPath, err)
+		}
+	case !isNotFound(err):
+		return "", nil, nil, err
+	}
+
+	deps, locked, updates, err := updateChartDependencies(ctx, values, oldLock)
+	if err != nil || len(deps) == 0 {
+		return lockPath, nil, updates, err
+	}
+	lock, err := generateChartLock(deps, locked)
 	if err != nil {
-		fmt.Printf("error creating tree: %v", err)
-		return err
+		return "", nil, nil, err
 	}
+	return lockPath, lock, updates, nil
+}
 
-	// Create a new commit object with the updated tree object
-	newCommit, _, err := client.Git.CreateCommit(ctx, owner, repo, &github.Commit{
-		Message: github.String(fmt.Sprintf("Update %s to version %s", chartName, newVersion)),
-		Tree:    newTree,
-		Parents: []*github.Commit{{SHA: &parentSHA}},
-	})
+// updateChartValuesImage bumps the image tag in a chart's values.yaml and
+// pins its digest if digestMode is set. An empty tag keeps the current tags
+// and only refreshes their digests. It returns the new content, or nil if
+// there is no values.yaml or nothing changed.
+func updateChartValuesImage(ctx context.Context, backend Backend, t Target, valuesPath, valuesImagePath, dockerImage, tag, digestMode string) ([]byte, error) {
+	valuesContent, err := backend.ReadFile(ctx, t, valuesPath)
+	if isNotFound(err) {
+		logger(ctx).Info("no values.yaml found", "path", valuesPath)
+		return nil, nil
+	}
 	if err != nil {
-		fmt.Printf("error creating commit: %v", err)
-		return err
+		return nil, err
 	}
 
-	// Create a new reference for the updated commit
-	newBranch := fmt.Sprintf("refs/heads/update-%s-to-%s", chartName, newVersion)
-	_, _, err = client.Git.CreateRef(ctx, owner, repo, &github.Reference{
-		Ref:    github.String(newBranch),
-		Object: &github.GitObject{SHA: newCommit.SHA},
-	})
+	edit, err := newValuesEdit(valuesContent)
 	if err != nil {
-		fmt.Printf("error creating reference: %v", err)
-		return err
+		return nil, err
 	}
 
-	// Create a pull request with the changes
-	title := fmt.Sprintf("Update %s to version %s", chartName, newVersion)
-	body := fmt.Sprintf("Update %s to version %s", chartName, newVersion)
-	newPR, _, err := client.PullRequests.Create(ctx, owner, repo, &github.NewPullRequest{
-		Title: github.String(title),
-		Body:  github.String(body),
-		Head:  github.String(newBranch),
-		Base:  github.String(branch),
-	})
+	locations, err := findValuesImageTags(&edit.root, valuesImagePath, dockerImage)
 	if err != nil {
-		fmt.Printf("failed to create pull request: %v", err)
-		return err
+		return nil, err
+	}
+	if len(locations) == 0 {
+		return nil, nil
 	}
 
+	digests := make(map[string]string)
+	var updatedTags []string
+	for _, location := range locations {
+		newTag := tag
+		if newTag == "" {
+			newTag = location.currentTag()
+		}
+		digest, ok := digests[newTag]
+		if !ok {
+			digest = resolveImageDigest(ctx, dockerImage, newTag, digestMode)
+			digests[newTag] = digest
+		}
+		if tag == "" && digest == "" {
+			// refreshing, keep the pinned digest if the tag can't be resolved
+			continue
+		}
+		if err := location.set(edit, newTag, digest, digestMode); err != nil {
+			return nil, fmt.Errorf("error updating %s in %s: %v", location.path, valuesPath, err)
+		}
+		updatedTags = append(updatedTags, location.path)
+	}
 
-	// Print the URL of the new pull request and send a notification to Slack
-	prMessage := fmt.Sprintf("Created pull request %s\n", newPR.GetHTMLURL())
-	fmt.Print(prMessage)
+	updatedValues := edit.bytes()
+	if bytes.Equal(valuesContent, updatedValues) {
+		return nil, nil
+	}
+	logger(ctx).Info("updated image tags in values.yaml", "paths", strings.Join(updatedTags, ", "))
+	return updatedValues, nil
+}
 
-	// Send a Slack notification
-	slackWebhookURL := os.Getenv("SLACK_WEBHOOK_URL") // Make sure this environment variable is set in your GitHub Action
-	if err := sendSlackNotification(slackWebhookURL, prMessage); err != nil {
-		fmt.Printf("Failed to send Slack notification: %v\n", err)
+// RefreshImageDigestWithPR re-resolves the digests of the tags a chart
+// currently deploys and opens a pull request if a tag was re-pushed upstream.
+func RefreshImageDigestWithPR(ctx context.Context, backend Backend, t Target, chartName, valuesImagePath, dockerImage, digestMode string, committer *github.CommitAuthor) (*github.PullRequest, error) {
+	valuesPath := path.Join(path.Dir(t.Path), "values.yaml")
+	updatedValues, err := updateChartValuesImage(ctx, backend, t, valuesPath, valuesImagePath, dockerImage, "", digestMode)
+	if err != nil {
+		return nil, err
+	}
+	if updatedValues == nil {
+		logger(ctx).Info("digests are up to date", "chart", chartName)
+		return nil, nil
 	}
 
-	return nil
+	sum := sha256.Sum256(updatedValues)
+	title := fmt.Sprintf("Refresh image digest of %s", chartName)
+	pr, err := backend.Propose(ctx, t, Change{
+		Branch:    fmt.Sprintf("refresh-%s-digest-%x", chartName, sum[:6]),
+		Message:   title,
+		Title:     title,
+		Body:      fmt.Sprintf("A tag of %s deployed by %s was re-pushed upstream, pinning the new digest", dockerImage, chartName),
+		Files:     map[string][]byte{valuesPath: updatedValues},
+		Committer: committer,
+	})
+	return pr, withPhase(PhasePublish, err)
 }
 
-func UpdateTargetRevision(chartName, owner, repo, filename, newVersion, branch, token string) error {
-	fmt.Println("foobar here")
-	fmt.Println(chartName, owner, repo, filename, newVersion, branch)
-	ctx := context.Background()
-
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: token},
-	)
-	tc := oauth2.NewClient(ctx, ts)
+// UpdateSubchartsWithPR proposes the outdated subcharts of the Chart.yaml at
+// t.Path with a regenerated Chart.lock. The chart gets a new patch version,
+// its appVersion stays. It returns the PR and the new chart version, or no
+// version if the subcharts are up to date.
+func UpdateSubchartsWithPR(ctx context.Context, backend Backend, t Target, chartName string, body *PullRequestBody, committer *github.CommitAuthor) (*github.PullRequest, string, error) {
+	content, err := backend.ReadFile(ctx, t, t.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	values := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return nil, "", fmt.Errorf("error parsing %s: %v", t.Path, err)
+	}
 
-	client := github.NewClient(tc)
+	lockPath, lock, depUpdates, err := updateChartLock(ctx, backend, t, values)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(depUpdates) == 0 {
+		logger(ctx).Info("subcharts are up to date", "chart", chartName)
+		return nil, "", nil
+	}
 
-	// Get the current contents of the file
-	fileContent, _, _, err := client.Repositories.GetContents(ctx, owner, repo, filename, &github.RepositoryContentGetOptions{
-		Ref: branch,
-	})
+	oldVersion := fmt.Sprint(values["version"])
+	newVersion, err := nextPatchVersion(oldVersion)
 	if err != nil {
-		return fmt.Errorf("error getting file content: %v", err)
+		return nil, "", err
+	}
+	appVersion := ""
+	if values["appVersion"] != nil {
+		appVersion = fmt.Sprint(values["appVersion"])
+	}
+	if err := updateYAMLContent(values, newVersion, appVersion, buildChartChanges("", depUpdates, nil)); err != nil {
+		return nil, "", err
+	}
+	updatedContent, err := yaml.Marshal(values)
+	if err != nil {
+		return nil, "", err
 	}
 
-	// Decode the file content from base64
-	contentBytes, err := fileContent.GetContent()
+	// the branch is named after the subchart versions, proposing them again
+	// finds it taken
+	sum := sha256.Sum256([]byte(fmt.Sprint(depUpdates)))
+	title := fmt.Sprintf("Update subcharts of %s", chartName)
+	body.Title = title
+	body.OldVersion, body.NewVersion = oldVersion, newVersion
+	body.Dependencies = depUpdates
+	description, err := body.render()
+	if err != nil {
+		return nil, "", err
+	}
+	pr, err := backend.Propose(ctx, t, Change{
+		Branch:    fmt.Sprintf("update-%s-subcharts-%x", chartName, sum[:6]),
+		Message:   title,
+		Title:     title,
+		Body:      description,
+		Files:     map[string][]byte{t.Path: updatedContent, lockPath: lock},
+		Committer: committer,
+	})
 	if err != nil {
-		return fmt.Errorf("error decoding file content: %v", err)
+		return nil, "", withPhase(PhasePublish, err)
 	}
-	content := []byte(contentBytes)
+	return pr, newVersion, nil
+}
 
+// setTargetRevision sets spec.source.targetRevision of an argocd application
+// template wrapped in a helm conditional.
+func setTargetRevision(content []byte, newVersion string) ([]byte, error) {
 	// Strip helm template wrappers and capture them
 	re := regexp.MustCompile(`(?s)({{.*?}})\n(.+?)\n({{.*?}})`)
 	matches := re.FindSubmatch(content)
 	if matches == nil || len(matches) < 4 {
-		return errors.New("couldn't find the expected YAML section")
+		return nil, errors.New("couldn't find the expected YAML section")
 	}
 	beginWrapper := matches[1] // {{ if .Values.certmanager.enabled }}
 	strippedContent := matches[2]
@@ -749,17 +1342,25 @@ func UpdateTargetRevision(chartName, owner, repo, filename, newVersion, branch,
 	// Unmarshal the stripped YAML content into a map
 	values := make(map[interface{}]interface{})
 	if err := yaml.Unmarshal(strippedContent, &values); err != nil {
-		return fmt.Errorf("error unmarshalling YAML: %v", err)
+		return nil, fmt.Errorf("error unmarshalling YAML: %v", err)
 	}
 
-	// Update the targetRevision
-	sourceBlock := values["spec"].(map[interface{}]interface{})["source"].(map[interface{}]interface{})
+	// Update the targetRevision, applications with several sources aren't
+	// supported
+	spec, ok := values["spec"].(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("no spec in the application")
+	}
+	sourceBlock, ok := spec["source"].(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("no spec.source in the application")
+	}
 	sourceBlock["targetRevision"] = newVersion
 
 	// Marshal the updated values back to YAML
 	updatedContent, err := yaml.Marshal(values)
 	if err != nil {
-		return fmt.Errorf("error marshalling YAML: %v", err)
+		return nil, fmt.Errorf("error marshalling YAML: %v", err)
 	}
 
 	// Re-add the wrappers to the updated content
@@ -768,97 +1369,34 @@ func UpdateTargetRevision(chartName, owner, repo, filename, newVersion, branch,
 	finalContent = append(finalContent, '\n')
 	finalContent = append(finalContent, endWrapper...)
 
-	// Create a new blob object for the updated content using the finalContent
-	newBlob, _, err := client.Git.CreateBlob(ctx, owner, repo, &github.Blob{
-		Content:  github.String(string(finalContent)),
-		Encoding: github.String("utf-8"),
-	})
-	if err != nil {
-		return fmt.Errorf("Error creating blob: %v", err)
-	}
-
-	// Get the latest commit object for the branch
-	ref, _, err := client.Git.GetRef(ctx, owner, repo, fmt.Sprintf("refs/heads/%s", branch))
-	if err != nil {
-		return fmt.Errorf("error getting ref: %v", err)
-	}
-	parentSHA := ref.Object.GetSHA()
+	return finalContent, nil
+}
+func UpdateTargetRevision(ctx context.Context, backend Backend, t Target, chartName, newVersion string, body *PullRequestBody, committer *github.CommitAuthor) (*github.PullRequest, error) {
 
-	// Create a new tree object with the updated file
-	newTree, _, err := client.Git.CreateTree(ctx, owner, repo, parentSHA, []*github.TreeEntry{
-		{
-			Path: github.String(fileContent.GetPath()),
-			Mode: github.String("100644"),
-			Type: github.String("blob"),
-			SHA:  newBlob.SHA,
-		},
-	})
+	// Get the current contents of the file
+	content, err := backend.ReadFile(ctx, t, t.Path)
 	if err != nil {
-		return fmt.Errorf("error creating tree: %v", err)
+		return nil, fmt.Errorf("error getting file content: %v", err)
 	}
-
-	// Create a new commit object with the updated tree object
-	newCommit, _, err := client.Git.CreateCommit(ctx, owner, repo, &github.Commit{
-		Message: github.String(fmt.Sprintf("Update %s to version %s", chartName, newVersion)),
-		Tree:    newTree,
-		Parents: []*github.Commit{{SHA: &parentSHA}},
-	})
+	finalContent, err := setTargetRevision(content, newVersion)
 	if err != nil {
-		return fmt.Errorf("error creating commit: %v", err)
+		return nil, err
 	}
 
-	// Create a new reference for the updated commit
-	newBranch := fmt.Sprintf("refs/heads/update-%s-to-%s", chartName, newVersion)
-	_, _, err = client.Git.CreateRef(ctx, owner, repo, &github.Reference{
-		Ref:    github.String(newBranch),
-		Object: &github.GitObject{SHA: newCommit.SHA},
-	})
+	description, err := body.render()
 	if err != nil {
-		return fmt.Errorf("error creating reference: %v", err)
+		return nil, err
 	}
 
-	// Create a pull request with the changes
+	// Commit the file on a new branch and propose it
 	title := fmt.Sprintf("Update %s to version %s", chartName, newVersion)
-	body := fmt.Sprintf("Update %s to version %s", chartName, newVersion)
-	newPR, _, err := client.PullRequests.Create(ctx, owner, repo, &github.NewPullRequest{
-		Title: github.String(title),
-		Body:  github.String(body),
-		Head:  github.String(newBranch),
-		Base:  github.String(branch),
+	pr, err := backend.Propose(ctx, t, Change{
+		Branch:    fmt.Sprintf("update-%s-to-%s", chartName, newVersion),
+		Message:   title,
+		Title:     title,
+		Body:      description,
+		Files:     map[string][]byte{t.Path: finalContent},
+		Committer: committer,
 	})
-	if err != nil {
-		return fmt.Errorf("failed to create pull request: %v", err)
-	}
-
-	// Print the URL of the new pull request
-	fmt.Printf("Created pull request %s\n", newPR.GetHTMLURL())
-
-	return nil
-}
-func sendSlackNotification(webhookURL, message string) error {
-	payload := map[string]string{"text": message}
-	jsonPayload, err := json.Marshal(payload)
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest("POST", webhookURL, bytes.NewBuffer(jsonPayload))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 300 {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("received non-2xx response: %d, body: %s", resp.StatusCode, body)
-	}
-
-	return nil
+	return pr, withPhase(PhasePublish, err)
 }
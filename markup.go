@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+// markup formats the parts of a notification for a notifier, every notifier
+// renders the event template with the funcs of its markup.
+type markup struct {
+	escape func(string) string
+	bold   func(string) string
+	code   func(string) string
+	link   func(url, text string) string
+}
+
+func identity(s string) string { return s }
+
+var (
+	plainMarkup = markup{
+		escape: identity,
+		bold:   identity,
+		code:   identity,
+		link:   func(url, text string) string { return text + " " + url },
+	}
+	markdownMarkup = markup{
+		escape: identity,
+		bold:   func(s string) string { return "**" + s + "**" },
+		code:   func(s string) string { return "`" + s + "`" },
+		link:   func(url, text string) string { return "[" + text + "](" + url + ")" },
+	}
+	// slackMarkup is Slack's mrkdwn, which only needs &, < and > escaped.
+	slackMarkup = markup{
+		escape: strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace,
+		bold:   func(s string) string { return "*" + s + "*" },
+		code:   func(s string) string { return "`" + s + "`" },
+		link:   func(url, text string) string { return "<" + url + "|" + text + ">" },
+	}
+	htmlMarkup = markup{
+		escape: html.EscapeString,
+		bold:   func(s string) string { return "<b>" + s + "</b>" },
+		code:   func(s string) string { return "<code>" + s + "</code>" },
+		link:   func(url, text string) string { return `<a href="` + url + `">` + text + "</a>" },
+	}
+)
+
+func (m markup) funcs() template.FuncMap {
+	return template.FuncMap{"bold": m.bold, "code": m.code, "link": m.link}
+}
+
+// escapeEvent escapes everything of e that came from outside, so the
+// template only adds trusted markup.
+func (m markup) escapeEvent(e Event) Event {
+	e.Dependency = m.escape(e.Dependency)
+	e.ChartType = m.escape(e.ChartType)
+	e.OldVersion = m.escape(e.OldVersion)
+	e.NewVersion = m.escape(e.NewVersion)
+	e.Release = m.escape(e.Release)
+	e.Error = m.escape(e.Error)
+	links := make([]Link, len(e.Links))
+	for i, l := range e.Links {
+		links[i] = Link{URL: m.escape(l.URL), Text: m.escape(l.Text)}
+	}
+	e.Links = links
+	return e
+}
+
+// plainBody renders a digest as plain text.
+func plainBody(n Notification) string {
+	var b strings.Builder
+	b.WriteString(n.Title)
+	for _, s := range n.Sections {
+		fmt.Fprintf(&b, "\n\n%s", s.Title)
+		for _, line := range s.Lines {
+			fmt.Fprintf(&b, "\n- %s", line)
+		}
+	}
+	return b.String()
+}
+
+// markdownBody renders the sections of a digest rendered in markdownMarkup.
+func markdownBody(n Notification) string {
+	var b strings.Builder
+	for i, s := range n.Sections {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		b.WriteString(markdownMarkup.bold(s.Title))
+		for _, line := range s.Lines {
+			fmt.Fprintf(&b, "\n- %s", line)
+		}
+	}
+	return b.String()
+}
+
+// htmlBody renders a digest with sections rendered in htmlMarkup.
+func htmlBody(n Notification) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<h3>%s</h3>", html.EscapeString(n.Title))
+	for _, s := range n.Sections {
+		fmt.Fprintf(&b, "<h4>%s</h4><ul>", html.EscapeString(s.Title))
+		for _, line := range s.Lines {
+			fmt.Fprintf(&b, "<li>%s</li>", line)
+		}
+		b.WriteString("</ul>")
+	}
+	return b.String()
+}
+
+// truncate cuts s to at most max bytes without splitting a character.
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	cut := max - len("...")
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + "..."
+}
+
+// chunkLines joins lines below max bytes per chunk, for backends limiting
+// the size of a block. Longer lines are cut.
+func chunkLines(lines []string, max int) []string {
+	var chunks []string
+	var current strings.Builder
+	for _, line := range lines {
+		line = truncate(line, max)
+		if current.Len() > 0 && current.Len()+1+len(line) > max {
+			chunks = append(chunks, current.String())
+			current.Reset()
+		}
+		if current.Len() > 0 {
+			current.WriteByte('\n')
+		}
+		current.WriteString(line)
+	}
+	if current.Len() > 0 {
+		chunks = append(chunks, current.String())
+	}
+	return chunks
+}
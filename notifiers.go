@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	notifierSlack   = "slack"
+	notifierDiscord = "discord"
+	notifierMatrix  = "matrix"
+	notifierNtfy    = "ntfy"
+	notifierGotify  = "gotify"
+	notifierSMTP    = "smtp"
+	notifierWebhook = "webhook"
+
+	defaultNtfyServer = "https://ntfy.sh"
+	defaultSMTPPort   = 587
+	// limits of Slack Block Kit and Discord embeds
+	slackMaxHeader        = 150
+	slackMaxSection       = 3000
+	slackMaxBlocks        = 50
+	discordMaxContent     = 2000
+	discordMaxDescription = 4096
+	discordMaxEmbeds      = 10
+
+	discordColorUpdate  = 0x2ecc71
+	discordColorFailure = 0xe74c3c
+)
+
+// newNotifier returns the backend of c, errNotConfigured if its webhook or
+// token isn't set.
+func newNotifier(c NotifierConfig) (Notifier, error) {
+	switch c.Type {
+	case notifierSlack, notifierDiscord, notifierWebhook:
+		webhookEnv := c.URLEnv
+		if webhookEnv == "" && c.Type == notifierSlack {
+			webhookEnv = defaultSlackWebhookEnv
+		}
+		webhook := c.URL
+		if webhook == "" {
+			webhook = secretFromEnv(webhookEnv)
+		}
+		secrets.add(webhook)
+		if webhook == "" {
+			return nil, fmt.Errorf("%w: no url or urlEnv", errNotConfigured)
+		}
+		switch c.Type {
+		case notifierSlack:
+			return &slackNotifier{webhook: webhook}, nil
+		case notifierDiscord:
+			return &discordNotifier{webhook: webhook}, nil
+		}
+		return &webhookNotifier{url: webhook}, nil
+	case notifierMatrix:
+		token := secretFromEnv(c.TokenEnv)
+		if c.Server == "" || c.Room == "" {
+			return nil, fmt.Errorf("server and room are required")
+		}
+		if token == "" {
+			return nil, fmt.Errorf("%w: no token in tokenEnv", errNotConfigured)
+		}
+		return &matrixNotifier{server: strings.TrimSuffix(c.Server, "/"), room: c.Room, token: token}, nil
+	case notifierNtfy:
+		if c.Topic == "" {
+			return nil, fmt.Errorf("topic is required")
+		}
+		server := c.Server
+		if server == "" {
+			server = defaultNtfyServer
+		}
+		return &ntfyNotifier{server: strings.TrimSuffix(server, "/"), topic: c.Topic, token: secretFromEnv(c.TokenEnv), priority: c.Priority}, nil
+	case notifierGotify:
+		token := secretFromEnv(c.TokenEnv)
+		if c.Server == "" {
+			return nil, fmt.Errorf("server is required")
+		}
+		if token == "" {
+			return nil, fmt.Errorf("%w: no token in tokenEnv", errNotConfigured)
+		}
+		return &gotifyNotifier{server: strings.TrimSuffix(c.Server, "/"), token: token, priority: c.Priority}, nil
+	case notifierSMTP:
+		if c.Host == "" || c.From == "" || len(c.To) == 0 {
+			return nil, fmt.Errorf("host, from and to are required")
+		}
+		port := c.Port
+		if port == 0 {
+			port = defaultSMTPPort
+		}
+		password := secretFromEnv(c.PasswordEnv)
+		if c.Username != "" && password == "" {
+			return nil, fmt.Errorf("%w: no password in passwordEnv", errNotConfigured)
+		}
+		return &smtpNotifier{host: c.Host, port: port, username: c.Username, password: password, from: c.From, to: c.To}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier type %q", c.Type)
+}
+
+// slackNotifier posts to a Slack incoming webhook, the digest as Block Kit
+// sections.
+type slackNotifier struct {
+	webhook string
+}
+
+func (n *slackNotifier) markup() markup { return slackMarkup }
+
+func (n *slackNotifier) Notify(ctx context.Context, notification Notification) error {
+	blocks := []map[string]interface{}{{
+		"type": "header",
+		"text": map[string]string{"type": "plain_text", "text": truncate(notification.Title, slackMaxHeader)},
+	}}
+	for _, section := range notification.Sections {
+		title := slackMarkup.bold(slackMarkup.escape(section.Title))
+		if section.Failure {
+			title = ":x: " + title
+		}
+		lines := []string{title}
+		for _, line := range section.Lines {
+			lines = append(lines, "• "+line)
+		}
+		for _, chunk := range chunkLines(lines, slackMaxSection) {
+			blocks = append(blocks, map[string]interface{}{
+				"type": "section",
+				"text": map[string]string{"type": "mrkdwn", "text": chunk},
+			})
+		}
+	}
+	if len(blocks) > slackMaxBlocks {
+		blocks = append(blocks[:slackMaxBlocks-1], map[string]interface{}{
+			"type":     "context",
+			"elements": []map[string]string{{"type": "mrkdwn", "text": "more in the job summary"}},
+		})
+	}
+	return postJSON(ctx, http.MethodPost, n.webhook, nil, map[string]interface{}{
+		"text":   notification.Title,
+		"blocks": blocks,
+	})
+}
+
+// discordNotifier posts to a Discord webhook, an embed per section.
+type discordNotifier struct {
+	webhook string
+}
+
+func (n *discordNotifier) markup() markup { return markdownMarkup }
+
+func (n *discordNotifier) Notify(ctx context.Context, notification Notification) error {
+	var embeds []map[string]interface{}
+	for _, section := range notification.Sections {
+		color := discordColorUpdate
+		if section.Failure {
+			color = discordColorFailure
+		}
+		for _, chunk := range chunkLines(bulletLines(section.Lines), discordMaxDescription) {
+			embeds = append(embeds, map[string]interface{}{
+				"title":       section.Title,
+				"description": chunk,
+				"color":       color,
+			})
+		}
+	}
+	if len(embeds) > discordMaxEmbeds {
+		embeds = embeds[:discordMaxEmbeds]
+	}
+	return postJSON(ctx, http.MethodPost, n.webhook, nil, map[string]interface{}{
+		"content": truncate(markdownMarkup.bold(notification.Title), discordMaxContent),
+		"embeds":  embeds,
+	})
+}
+
+// matrixNotifier sends the digest as HTML to a Matrix room through the
+// client server API, with the plain text for clients without HTML.
+type matrixNotifier struct {
+	server string
+	room   string
+	token  string
+}
+
+func (n *matrixNotifier) markup() markup { return htmlMarkup }
+
+// matrixTxn keeps the transaction ids of a run apart.
+var matrixTxn int64
+
+func (n *matrixNotifier) Notify(ctx context.Context, notification Notification) error {
+	txn := fmt.Sprintf("homelab-updater-%d-%d", time.Now().UnixNano(), atomic.AddInt64(&matrixTxn, 1))
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s", n.server, url.PathEscape(n.room), txn)
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+n.token)
+	return postJSON(ctx, http.MethodPut, endpoint, header, map[string]string{
+		"msgtype":        "m.text",
+		"body":           notification.Text,
+		"format":         "org.matrix.custom.html",
+		"formatted_body": htmlBody(notification),
+	})
+}
+
+// ntfyNotifier publishes the digest as markdown to an ntfy topic.
+type ntfyNotifier struct {
+	server   string
+	topic    string
+	token    string
+	priority int
+}
+
+func (n *ntfyNotifier) markup() markup { return markdownMarkup }
+
+func (n *ntfyNotifier) Notify(ctx context.Context, notification Notification) error {
+	header := http.Header{}
+	header.Set("Title", notification.Title)
+	header.Set("Markdown", "yes")
+	if n.priority != 0 {
+		header.Set("Priority", strconv.Itoa(n.priority))
+	}
+	if n.token != "" {
+		header.Set("Authorization", "Bearer "+n.token)
+	}
+	return post(ctx, http.MethodPost, n.server+"/"+url.PathEscape(n.topic), header, []byte(markdownBody(notification)))
+}
+
+// gotifyNotifier pushes the digest as markdown with an application token of
+// Gotify.
+type gotifyNotifier struct {
+	server   string
+	token    string
+	priority int
+}
+
+func (n *gotifyNotifier) markup() markup { return markdownMarkup }
+
+func (n *gotifyNotifier) Notify(ctx context.Context, notification Notification) error {
+	header := http.Header{}
+	header.Set("X-Gotify-Key", n.token)
+	return postJSON(ctx, http.MethodPost, n.server+"/message", header, map[string]interface{}{
+		"title":    notification.Title,
+		"message":  markdownBody(notification),
+		"priority": n.priority,
+		"extras": map[string]interface{}{
+			"client::display": map[string]string{"contentType": "text/markdown"},
+		},
+	})
+}
+
+// smtpNotifier mails the digest as plain text and HTML, with STARTTLS if the
+// server offers it.
+type smtpNotifier struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+func (n *smtpNotifier) markup() markup { return htmlMarkup }
+
+func (n *smtpNotifier) Notify(ctx context.Context, notification Notification) error {
+	boundary := fmt.Sprintf("homelab-updater-%d", time.Now().UnixNano())
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", notification.Title))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", boundary)
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain", notification.Text},
+		{"text/html", htmlBody(notification)},
+	} {
+		fmt.Fprintf(&msg, "--%s\r\n", boundary)
+		fmt.Fprintf(&msg, "Content-Type: %s; charset=utf-8\r\n\r\n", part.contentType)
+		msg.WriteString(strings.ReplaceAll(part.body, "\n", "\r\n"))
+		msg.WriteString("\r\n")
+	}
+	fmt.Fprintf(&msg, "--%s--\r\n", boundary)
+
+	var auth smtp.Auth
+	if n.username != "" {
+		auth = smtp.PlainAuth("", n.username, n.password, n.host)
+	}
+	return smtp.SendMail(net.JoinHostPort(n.host, strconv.Itoa(n.port)), auth, n.from, n.to, []byte(msg.String()))
+}
+
+// bulletLines prefixes lines as a markdown list.
+func bulletLines(lines []string) []string {
+	bullets := make([]string, len(lines))
+	for i, line := range lines {
+		bullets[i] = "- " + line
+	}
+	return bullets
+}
+
+// webhookNotifier posts the notification with its events as JSON.
+type webhookNotifier struct {
+	url string
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	return postJSON(ctx, http.MethodPost, n.url, nil, notification)
+}
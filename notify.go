@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Event kinds besides the kinds of Action.
+const eventError = "error"
+
+const (
+	notifyTimeout = 30 * time.Second
+	// defaultSlackWebhookEnv is the Slack webhook used without a
+	// notifications section in the config.
+	defaultSlackWebhookEnv = "SLACK_WEBHOOK_URL"
+)
+
+// defaultEventTemplate renders the line of an event if neither the notifier
+// nor the notifications section bring their own template.
+const defaultEventTemplate = `{{bold .Dependency}} ` +
+	`{{if eq .Kind "error"}}{{.Error}}` +
+	`{{else}}{{.Kind}} {{with .OldVersion}}{{code .}} → {{end}}{{code .NewVersion}}` +
+	`{{with .Release}} {{link . "release notes"}}{{end}}` +
+	`{{range .Links}} {{link .URL .Text}}{{end}}{{end}}` +
+	`{{if .Reminder}} (reminder){{end}}`
+
+// Sections of a digest besides the chart types.
+const (
+	sectionOther    = "Other"
+	sectionFailures = "Failures"
+)
+
+// errNotConfigured is returned for notifiers lacking their credentials, they
+// are skipped.
+var errNotConfigured = errors.New("not configured")
+
+// NotificationConfig configures where events are sent.
+type NotificationConfig struct {
+	// Notifiers are the backends events can be sent to.
+	Notifiers []NotifierConfig `yaml:"notifiers"`
+	// Routes decide which events go to which notifiers, every matching route
+	// applies. Without routes every event goes to every notifier.
+	Routes []NotificationRoute `yaml:"routes"`
+	// Template is a text/template over an Event rendering its line in the
+	// digest. bold, code and link format for the notifier.
+	Template string `yaml:"template"`
+	// RemindAfter sends events announced before again once they are this
+	// old, e.g. "7d". Without it, and with a state store, every event is
+	// announced once.
+	RemindAfter string `yaml:"remindAfter"`
+}
+
+// NotifierConfig configures a notification backend. Secrets are read from
+// the variables named by the *Env fields.
+type NotifierConfig struct {
+	// Name is what routes refer to, the type if empty.
+	Name string `yaml:"name"`
+	// Type is slack, discord, matrix, ntfy, gotify, smtp or webhook.
+	Type string `yaml:"type"`
+	// URL is the webhook of slack, discord and webhook notifiers.
+	URL    string `yaml:"url"`
+	URLEnv string `yaml:"urlEnv"`
+	// Server is the homeserver of matrix and the server of ntfy and gotify.
+	Server string `yaml:"server"`
+	// Room is the matrix room id, Topic the ntfy topic.
+	Room  string `yaml:"room"`
+	Topic string `yaml:"topic"`
+	// TokenEnv holds the access token of matrix, ntfy and gotify.
+	TokenEnv string `yaml:"tokenEnv"`
+	// Priority of ntfy and gotify messages.
+	Priority int `yaml:"priority"`
+	// Host, Port, Username, PasswordEnv, From and To configure smtp.
+	Host        string   `yaml:"host"`
+	Port        int      `yaml:"port"`
+	Username    string   `yaml:"username"`
+	PasswordEnv string   `yaml:"passwordEnv"`
+	From        string   `yaml:"from"`
+	To          []string `yaml:"to"`
+	// Template overrides the template of the notifications section.
+	Template string `yaml:"template"`
+}
+
+// NotificationRoute sends the events it matches to its notifiers.
+type NotificationRoute struct {
+	// Events are kinds of events: app, chart, digest, group or error.
+	// Empty matches every kind.
+	Events []string `yaml:"events"`
+	// Dependencies and ChartTypes select the dependencies like in MergePolicy.
+	Dependencies []string `yaml:"dependencies"`
+	ChartTypes   []string `yaml:"chartTypes"`
+	// Notifiers are names of notifiers, empty sends to all of them.
+	Notifiers []string `yaml:"notifiers"`
+}
+
+func (r NotificationRoute) matches(e Event) bool {
+	return matchesAny(r.Events, e.Kind) && matchesAny(r.Dependencies, e.Dependency) && matchesAny(r.ChartTypes, e.ChartType)
+}
+
+// Event is something that happened to a dependency worth a notification.
+type Event struct {
+	// Kind is app, chart, digest, group or error.
+	Kind       string `json:"kind"`
+	Dependency string `json:"dependency"`
+	ChartType  string `json:"chartType,omitempty"`
+	OldVersion string `json:"oldVersion,omitempty"`
+	NewVersion string `json:"newVersion,omitempty"`
+	// Release links the release notes of a new app version.
+	Release string `json:"release,omitempty"`
+	Links   []Link `json:"links,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// Reminder is set on events announced before.
+	Reminder bool `json:"reminder,omitempty"`
+}
+
+// Link is a pull request of an event.
+type Link struct {
+	URL  string `json:"url"`
+	Text string `json:"text"`
+}
+
+// Notification is the digest of a run sent to a notifier.
+type Notification struct {
+	Title string `json:"title"`
+	// Text is the whole digest as plain text.
+	Text string `json:"text"`
+	// Sections hold the lines of the events in the markup of the notifier,
+	// updates by chart type and failures last.
+	Sections []NotificationSection `json:"sections"`
+	Events   []Event               `json:"events"`
+}
+
+// NotificationSection is a titled list of event lines.
+type NotificationSection struct {
+	Title   string   `json:"title"`
+	Lines   []string `json:"lines"`
+	Failure bool     `json:"failure,omitempty"`
+}
+
+// Notifier sends notifications to a chat, push service or mailbox.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// markedUp is implemented by notifiers formatting more than plain text.
+type markedUp interface {
+	markup() markup
+}
+
+// namedNotifier is a configured notifier with its templates, rendering in
+// its markup and in plain text.
+type namedNotifier struct {
+	name     string
+	notifier Notifier
+	markup   markup
+	template *template.Template
+	plain    *template.Template
+}
+
+// Notifications routes events to the configured notifiers.
+type Notifications struct {
+	notifiers   []namedNotifier
+	routes      []NotificationRoute
+	remindAfter time.Duration
+}
+
+// newNotifications sets up the notifiers of config. Notifiers without their
+// credentials are skipped. Without notifiers the Slack webhook in
+// SLACK_WEBHOOK_URL gets every event.
+func newNotifications(config NotificationConfig) (*Notifications, error) {
+	configs := config.Notifiers
+	if len(configs) == 0 {
+		configs = []NotifierConfig{{Type: notifierSlack}}
+	}
+
+	defaultTemplate := config.Template
+	if defaultTemplate == "" {
+		defaultTemplate = defaultEventTemplate
+	}
+
+	n := &Notifications{routes: config.Routes}
+	if config.RemindAfter != "" {
+		var err error
+		if n.remindAfter, err = parseAge(config.RemindAfter); err != nil {
+			return nil, fmt.Errorf("invalid remindAfter %q: %v", config.RemindAfter, err)
+		}
+	}
+	names := make(map[string]bool)
+	for _, c := range configs {
+		name := c.Name
+		if name == "" {
+			name = c.Type
+		}
+		if names[name] {
+			return nil, fmt.Errorf("notifier %s is configured twice, give them a name", name)
+		}
+		names[name] = true
+
+		text := c.Template
+		if text == "" {
+			text = defaultTemplate
+		}
+		plain, err := template.New(name).Funcs(plainMarkup.funcs()).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing template of notifier %s: %v", name, err)
+		}
+
+		notifier, err := newNotifier(c)
+		if errors.Is(err, errNotConfigured) {
+			slog.Debug("skipping notifier", "notifier", name, "reason", err)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("notifier %s: %v", name, err)
+		}
+		nn := namedNotifier{name: name, notifier: notifier, markup: plainMarkup, template: plain, plain: plain}
+		if m, ok := notifier.(markedUp); ok {
+			nn.markup = m.markup()
+			nn.template = template.Must(template.New(name).Funcs(nn.markup.funcs()).Parse(text))
+		}
+		n.notifiers = append(n.notifiers, nn)
+	}
+
+	for _, route := range config.Routes {
+		for _, name := range route.Notifiers {
+			if !names[name] {
+				return nil, fmt.Errorf("route refers to unknown notifier %s", name)
+			}
+		}
+	}
+	return n, nil
+}
+
+// routed reports whether e goes to the notifier name.
+func (n *Notifications) routed(name string, e Event) bool {
+	if len(n.routes) == 0 {
+		return true
+	}
+	for _, route := range n.routes {
+		if route.matches(e) && (len(route.Notifiers) == 0 || contains(route.Notifiers, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// send sends every notifier a single digest of the events of a run routed
+// to it. With a state, events announced before are left out until they are
+// due for a reminder, and the state is updated with what was sent. Failed
+// notifications are logged, they don't fail the run.
+func (n *Notifications) send(ctx context.Context, results []DependencyResult, state *State) {
+	if n == nil {
+		return
+	}
+	var events []Event
+	for _, result := range results {
+		events = append(events, resultEvents(result)...)
+	}
+
+	log := logger(ctx)
+	now := time.Now().UTC().Truncate(time.Second)
+	// events of the checked dependencies gone since the last run are
+	// forgotten, they are news again if they come back
+	var notified []NotifiedEvent
+	if state != nil {
+		notified = state.others(results)
+	}
+	for _, nn := range n.notifiers {
+		var routed []Event
+		var known []NotifiedEvent
+		for _, e := range events {
+			if !n.routed(nn.name, e) {
+				continue
+			}
+			if state != nil {
+				if record := state.notified(nn.name, e); record != nil {
+					if n.remindAfter == 0 || now.Sub(record.SentAt) < n.remindAfter {
+						known = append(known, *record)
+						continue
+					}
+					e.Reminder = true
+				}
+			}
+			routed = append(routed, e)
+		}
+		notified = append(notified, known...)
+		if len(routed) == 0 {
+			continue
+		}
+
+		notification, err := nn.digest(routed)
+		if err == nil {
+			err = nn.notifier.Notify(ctx, notification)
+		}
+		if err != nil {
+			log.Warn("failed to send notification", "notifier", nn.name, "error", err)
+			// keep what was sent before, the rest is tried again next run
+			if state != nil {
+				for _, e := range routed {
+					if record := state.notified(nn.name, e); record != nil {
+						notified = append(notified, *record)
+					}
+				}
+			}
+			continue
+		}
+		for _, e := range routed {
+			notified = append(notified, NotifiedEvent{Notifier: nn.name, Dependency: e.Dependency, Kind: e.Kind, Version: e.stateVersion(), SentAt: now})
+		}
+	}
+	if state != nil {
+		state.Notified = notified
+	}
+}
+
+// digest renders events into sections, the updates by chart type with core
+// and optional first, the failures last.
+func (nn namedNotifier) digest(events []Event) (Notification, error) {
+	var updates, failures int
+	var titles []string
+	sections := make(map[string]*NotificationSection)
+	plainSections := make(map[string]*NotificationSection)
+	for _, e := range events {
+		title := sectionTitle(e.ChartType)
+		if e.Kind == eventError {
+			title = sectionFailures
+			failures++
+		} else {
+			updates++
+		}
+		if sections[title] == nil {
+			titles = append(titles, title)
+			sections[title] = &NotificationSection{Title: title, Failure: e.Kind == eventError}
+			plainSections[title] = &NotificationSection{Title: title, Failure: e.Kind == eventError}
+		}
+
+		line, err := renderEvent(nn.template, nn.markup, e)
+		if err != nil {
+			return Notification{}, err
+		}
+		sections[title].Lines = append(sections[title].Lines, line)
+		line, err = renderEvent(nn.plain, plainMarkup, e)
+		if err != nil {
+			return Notification{}, err
+		}
+		plainSections[title].Lines = append(plainSections[title].Lines, line)
+	}
+	sort.SliceStable(titles, func(i, j int) bool { return sectionRank(titles[i]) < sectionRank(titles[j]) })
+
+	n := Notification{
+		Title:  fmt.Sprintf("homelab-updater: %s, %s", plural(updates, "update"), plural(failures, "failure")),
+		Events: events,
+	}
+	plain := Notification{Title: n.Title}
+	for _, title := range titles {
+		n.Sections = append(n.Sections, *sections[title])
+		plain.Sections = append(plain.Sections, *plainSections[title])
+	}
+	n.Text = plainBody(plain)
+	return n, nil
+}
+
+func renderEvent(tmpl *template.Template, m markup, e Event) (string, error) {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, m.escapeEvent(e)); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// sectionTitle is the section of the updates of a chart type.
+func sectionTitle(chartType string) string {
+	if chartType == "" {
+		return sectionOther
+	}
+	return strings.ToUpper(chartType[:1]) + chartType[1:]
+}
+
+// sectionRank orders core and optional before the other chart types and the
+// failures last.
+func sectionRank(title string) int {
+	switch title {
+	case "Core":
+		return 0
+	case "Optional":
+		return 1
+	case sectionFailures:
+		return 3
+	}
+	return 2
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return "1 " + word
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
+
+// resultEvents turns the actions and errors of a result into events. Actions
+// of a kind proposing the same version to several repos make one event.
+func resultEvents(r DependencyResult) []Event {
+	var events []Event
+	index := make(map[[2]string]int)
+	for _, action := range r.Actions {
+		key := [2]string{action.Kind, action.Version}
+		i, ok := index[key]
+		if !ok {
+			e := Event{Kind: action.Kind, Dependency: r.Name, ChartType: r.ChartType, NewVersion: action.Version, Release: action.Release}
+			switch action.Kind {
+			case "app":
+				e.OldVersion = r.AppVersion
+			case "chart", "group":
+				e.OldVersion = r.ChartVersion
+			}
+			i = len(events)
+			index[key] = i
+			events = append(events, e)
+		}
+		if action.PullRequest != "" {
+			// owner/repo#number, the number is the last element of the URL
+			text := action.Target + "#" + path.Base(action.PullRequest)
+			events[i].Links = append(events[i].Links, Link{URL: action.PullRequest, Text: text})
+		}
+	}
+	for _, err := range r.Errors {
+		events = append(events, Event{Kind: eventError, Dependency: r.Name, ChartType: r.ChartType, Error: secrets.redact(err.Error())})
+	}
+	return events
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// secretFromEnv returns the value of the variable name, registered for
+// redaction.
+func secretFromEnv(name string) string {
+	if name == "" {
+		return ""
+	}
+	value := strings.TrimSpace(os.Getenv(name))
+	secrets.add(value)
+	return value
+}
+
+// postJSON sends payload as JSON with the extra headers and fails on
+// anything but 2xx.
+func postJSON(ctx context.Context, method, url string, header http.Header, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "application/json")
+	return post(ctx, method, url, header, body)
+}
+
+// post sends body with header and fails on anything but 2xx.
+func post(ctx context.Context, method, url string, header http.Header, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		content, _ := ioutil.ReadAll(resp.Body)
+		return newStatusError(resp, strings.TrimSpace(string(content)))
+	}
+	return nil
+}
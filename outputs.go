@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// updateAvailable reports whether a newer app or chart version was found.
+func (r DependencyResult) updateAvailable() bool {
+	return r.NewAppVersion != "" || r.NewMajorAppVersion != "" || r.NewChartVersion != "" || r.NewMajorChartVersion != ""
+}
+
+// latestAppVersion is the newest app version found, the current one without
+// an update.
+func (r DependencyResult) latestAppVersion() string {
+	if r.NewAppVersion != "" {
+		return r.NewAppVersion
+	}
+	return r.AppVersion
+}
+
+// latestChartVersion is the newest chart version found, the current one
+// without an update.
+func (r DependencyResult) latestChartVersion() string {
+	if r.NewChartVersion != "" {
+		return r.NewChartVersion
+	}
+	return r.ChartVersion
+}
+
+// writeOutputs appends the results to the step outputs in $GITHUB_OUTPUT.
+// A run over a single chart gets its versions as outputs of their own,
+// every run gets results as JSON.
+func writeOutputs(results []DependencyResult) error {
+	filename := os.Getenv("GITHUB_OUTPUT")
+	if filename == "" {
+		return nil
+	}
+
+	outputs := [][2]string{}
+	if len(results) == 1 {
+		r := results[0]
+		outputs = append(outputs,
+			[2]string{"app_version", r.AppVersion},
+			[2]string{"latest_app_release", r.latestAppVersion()},
+			[2]string{"latest_release", r.latestAppVersion()},
+			[2]string{"major_app_release", r.NewMajorAppVersion},
+			[2]string{"chart_version", r.ChartVersion},
+			[2]string{"latest_chart_release", r.latestChartVersion()},
+			[2]string{"major_chart_release", r.NewMajorChartVersion},
+		)
+	}
+
+	updateAvailable := false
+	var pullRequests []string
+	for _, r := range results {
+		updateAvailable = updateAvailable || r.updateAvailable()
+		pullRequests = append(pullRequests, r.PullRequests...)
+	}
+	resultsJSON, err := json.Marshal(reportRecords(results))
+	if err != nil {
+		return err
+	}
+	outputs = append(outputs,
+		[2]string{"update_available", fmt.Sprint(updateAvailable)},
+		[2]string{"pull_requests", strings.Join(pullRequests, "\n")},
+		[2]string{"results", string(resultsJSON)},
+	)
+
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	for _, output := range outputs {
+		if _, err := f.WriteString(formatOutput(output[0], output[1])); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// formatOutput renders name=value, multiline values between a random
+// delimiter as GitHub asks for.
+func formatOutput(name, value string) string {
+	if !strings.ContainsAny(value, "\r\n") {
+		return name + "=" + value + "\n"
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	delimiter := "EOF_" + hex.EncodeToString(b)
+	return fmt.Sprintf("%s<<%s\n%s\n%s\n", name, delimiter, value, delimiter)
+}
+
+// writeStepSummary appends the results as a markdown table to
+// $GITHUB_STEP_SUMMARY.
+func writeStepSummary(results []DependencyResult) error {
+	filename := os.Getenv("GITHUB_STEP_SUMMARY")
+	if filename == "" {
+		return nil
+	}
+
+	var b strings.Builder
+	b.WriteString("## homelab-updater\n\n")
+	b.WriteString("| dependency | app | chart | pull requests | status |\n")
+	b.WriteString("| --- | --- | --- | --- | --- |\n")
+	for _, r := range results {
+		status := "up to date"
+		switch {
+		case len(r.Errors) > 0:
+			var messages []string
+			for _, err := range r.Errors {
+				messages = append(messages, secrets.redact(err.Error()))
+			}
+			status = ":x: " + strings.Join(messages, "<br>")
+		case r.updateAvailable():
+			status = "update available"
+		}
+		var links []string
+		for i, url := range r.PullRequests {
+			links = append(links, fmt.Sprintf("[#%d](%s)", i+1, url))
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s |\n",
+			markdownCell(r.Name),
+			markdownCell(summaryVersions(r.AppVersion, r.NewAppVersion, r.NewMajorAppVersion)),
+			markdownCell(summaryVersions(r.ChartVersion, r.NewChartVersion, r.NewMajorChartVersion)),
+			strings.Join(links, " "),
+			markdownCell(status),
+		)
+	}
+
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(b.String()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// summaryVersions renders current → new (major), just current without an
+// update.
+func summaryVersions(current, newVersion, major string) string {
+	text := current
+	if newVersion != "" {
+		text += " → " + newVersion
+	}
+	if major != "" {
+		text += " (major " + major + ")"
+	}
+	return text
+}
+
+// markdownCell keeps text from breaking out of its table cell.
+func markdownCell(text string) string {
+	text = strings.ReplaceAll(text, "|", "\\|")
+	return strings.ReplaceAll(text, "\n", " ")
+}
+
+// annotate prints workflow commands, so failed checks show up as errors and
+// updates that couldn't be edited or published as warnings on the run.
+func annotate(w io.Writer, results []DependencyResult) {
+	for _, r := range results {
+		for _, err := range r.Errors {
+			level := "error"
+			if phase := phaseOf(err); phase == PhaseEdit || phase == PhasePublish {
+				level = "warning"
+			}
+			fmt.Fprintf(w, "::%s title=%s::%s\n", level, escapeProperty(r.Name), escapeData(secrets.redact(err.Error())))
+		}
+	}
+}
+
+// escapeData escapes the message of a workflow command.
+func escapeData(s string) string {
+	s = strings.ReplaceAll(s, "%", "%25")
+	s = strings.ReplaceAll(s, "\r", "%0D")
+	return strings.ReplaceAll(s, "\n", "%0A")
+}
+
+// escapeProperty escapes a property of a workflow command.
+func escapeProperty(s string) string {
+	s = escapeData(s)
+	s = strings.ReplaceAll(s, ":", "%3A")
+	return strings.ReplaceAll(s, ",", "%2C")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// platformPolicyHold skips updates whose images miss a platform.
+	platformPolicyHold = "hold"
+	// platformPolicyAnnotate proposes the update anyway and flags the
+	// missing platforms in the PR body.
+	platformPolicyAnnotate = "annotate"
+)
+
+// splitList splits a comma or newline separated action input.
+func splitList(input string) []string {
+	var items []string
+	for _, item := range strings.FieldsFunc(input, func(r rune) bool {
+		return r == ',' || r == '\n'
+	}) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// platformMatches reports whether a published platform satisfies a wanted
+// one. "linux/arm64" is satisfied by "linux/arm64/v8", "linux/arm/v7" only by
+// itself.
+func platformMatches(published, wanted string) bool {
+	return published == wanted || strings.HasPrefix(published, wanted+"/")
+}
+
+// findMissingPlatforms returns, per image, the wanted platforms that are not
+// published at tag. Images whose tag doesn't exist yet (e.g. our own images
+// that are built after the update) are skipped.
+func findMissingPlatforms(ctx context.Context, images []string, tag string, platforms []string) (map[string][]string, error) {
+	registry := newRegistryClient()
+	missing := make(map[string][]string)
+
+	for _, image := range images {
+		published, err := registry.getPlatforms(image, tag)
+		if errors.Is(err, errManifestNotFound) {
+			logger(ctx).Info("image is not published yet, skipping platform check", "image", image, "tag", tag)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, wanted := range platforms {
+			found := false
+			for _, p := range published {
+				if platformMatches(p, wanted) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				missing[image] = append(missing[image], wanted)
+			}
+		}
+	}
+
+	return missing, nil
+}
+
+// checkPlatforms verifies that every image is published for all platforms at
+// tag. It returns whether the update has to be held back and a note for the
+// PR body when the policy is to annotate instead.
+func checkPlatforms(ctx context.Context, images []string, tag string, platforms []string, policy string) (bool, string) {
+	if len(platforms) == 0 || len(images) == 0 {
+		return false, ""
+	}
+
+	missing, err := findMissingPlatforms(ctx, images, tag, platforms)
+	if err != nil {
+		// don't block updates because a registry is flaky
+		logger(ctx).Warn("could not verify platforms", "tag", tag, "error", err)
+		return false, ""
+	}
+	if len(missing) == 0 {
+		return false, ""
+	}
+
+	var lines []string
+	for _, image := range images {
+		if m, ok := missing[image]; ok {
+			lines = append(lines, fmt.Sprintf("- `%s:%s` is missing %s", image, tag, strings.Join(m, ", ")))
+		}
+	}
+	for _, image := range images {
+		if m, ok := missing[image]; ok {
+			logger(ctx).Info("missing platforms", "image", image, "tag", tag, "platforms", strings.Join(m, ", "))
+		}
+	}
+
+	if policy == platformPolicyAnnotate {
+		return false, "\n\n**Warning: not all platforms are published**\n" + strings.Join(lines, "\n")
+	}
+	return true, ""
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/v53/github"
+)
+
+const (
+	// defaultWorkers is the number of dependencies checked at the same time.
+	defaultWorkers = 4
+	// defaultHostConcurrency is the number of requests in flight per host.
+	defaultHostConcurrency = 2
+)
+
+// DependencyResult is the outcome of checking a single dependency.
+type DependencyResult struct {
+	Name                 string
+	ChartType            string
+	ChartVersion         string
+	NewChartVersion      string
+	NewMajorChartVersion string
+	AppVersion           string
+	NewAppVersion        string
+	NewMajorAppVersion   string
+	AppUpdated           bool
+	ChartUpdated         bool
+	// LatestChartVersion and UpstreamAppVersion are the newest versions
+	// published, whatever the rules say. ChartAppVersion is the appVersion
+	// of the newest chart.
+	LatestChartVersion string
+	ChartAppVersion    string
+	UpstreamAppVersion string
+	// DeployedAppVersion is the appVersion of the deployed chart.
+	DeployedAppVersion string
+	// HeldPlatforms is set if an update waits for images of all platforms.
+	HeldPlatforms bool
+	// Observed are the app and chart versions published upstream.
+	Observed []ObservedVersion
+	Decision string
+	Reason   string
+	Actions  []Action
+	// PullRequests links the pull requests opened or updated for it.
+	PullRequests []string
+	// Errors are typed by the phase they happened in, see PhaseError.
+	Errors []error
+}
+
+// proposed records a change proposed to t and its pull request, if one was
+// opened. The action returned is good until the next one is recorded.
+func (r *DependencyResult) proposed(kind string, t Target, version string, pr *github.PullRequest) *Action {
+	url := pr.GetHTMLURL()
+	r.Actions = append(r.Actions, Action{Kind: kind, Target: t.Owner + "/" + t.Repo, Version: version, PullRequest: url})
+	if url != "" {
+		r.PullRequests = append(r.PullRequests, url)
+	}
+	return &r.Actions[len(r.Actions)-1]
+}
+
+// fail records an error of phase, errors typed already keep their phase.
+func (r *DependencyResult) fail(phase Phase, err error) {
+	err = withPhase(phase, err)
+	slog.Error("error encountered", "dependency", r.Name, "error", err)
+	r.Errors = append(r.Errors, err)
+}
+
+// exitCode is 1 if any check failed, 2 if updates were proposed and 0 if
+// everything is up to date. INPUT_UPDATES_EXIT_CODE replaces 2, the action
+// sets it to 0 so proposing updates doesn't fail the job.
+func exitCode(results []DependencyResult) int {
+	code := exitUpToDate
+	for _, r := range results {
+		if len(r.Errors) > 0 {
+			return exitError
+		}
+		if r.AppUpdated || r.ChartUpdated {
+			code = exitUpdated
+		}
+	}
+	if code == exitUpdated {
+		if updated, err := strconv.Atoi(os.Getenv("INPUT_UPDATES_EXIT_CODE")); err == nil {
+			return updated
+		}
+	}
+	return code
+}
+
+// intInput reads a positive number from an action input.
+func intInput(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s has to be a positive number, got %q", name, value)
+	}
+	return n, nil
+}
+
+// runDependencies checks all dependencies with at most workers at a time and
+// returns the results in the order of deps. Dependencies not started before
+// ctx is cancelled report the context error.
+func runDependencies(ctx context.Context, deps []Dependency, workers int, check func(context.Context, Dependency) DependencyResult) []DependencyResult {
+	results := make([]DependencyResult, len(deps))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(deps); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = runDependency(ctx, deps[i], check)
+			}
+		}()
+	}
+
+	for i := range deps {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			results[i] = DependencyResult{Name: deps[i].ValuesChartName, ChartVersion: deps[i].ChartVersion, Errors: []error{ctx.Err()}}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// runDependency runs check and turns a panic into an error of this
+// dependency instead of taking the whole run down.
+func runDependency(ctx context.Context, dep Dependency, check func(context.Context, Dependency) DependencyResult) (result DependencyResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = DependencyResult{Name: dep.ValuesChartName, ChartVersion: dep.ChartVersion, Errors: []error{fmt.Errorf("panic: %v", r)}}
+		}
+	}()
+	if err := ctx.Err(); err != nil {
+		return DependencyResult{Name: dep.ValuesChartName, ChartVersion: dep.ChartVersion, Errors: []error{err}}
+	}
+	ctx = withLogger(ctx, logger(ctx).With("dependency", dep.ValuesChartName))
+	return check(ctx, dep)
+}
+
+// formatReport renders the results as one line per dependency.
+func formatReport(results []DependencyResult) string {
+	lines := []string{"report:"}
+	for _, r := range results {
+		line := fmt.Sprintf("%s: chart %s", r.Name, r.ChartVersion)
+		if r.NewChartVersion != "" {
+			line += " -> " + r.NewChartVersion
+		}
+		if r.NewMajorChartVersion != "" {
+			line += " (major " + r.NewMajorChartVersion + ")"
+		}
+		if r.AppVersion != "" {
+			line += ", app " + r.AppVersion
+			if r.NewAppVersion != "" {
+				line += " -> " + r.NewAppVersion
+			}
+			if r.NewMajorAppVersion != "" {
+				line += " (major " + r.NewMajorAppVersion + ")"
+			}
+		}
+		for _, url := range r.PullRequests {
+			line += "\n  " + url
+		}
+		lines = append(lines, line)
+	}
+
+	// every error in one place, by phase
+	var failures []string
+	for _, phase := range []Phase{PhaseResolve, PhaseFetch, PhaseEdit, PhasePublish, ""} {
+		for _, r := range results {
+			for _, err := range r.Errors {
+				if phaseOf(err) == phase {
+					failures = append(failures, r.Name+": "+secrets.redact(err.Error()))
+				}
+			}
+		}
+	}
+	if len(failures) > 0 {
+		lines = append(lines, "errors:")
+		lines = append(lines, failures...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// hostLimitTransport limits the number of requests in flight per host, so a
+// run over many dependencies doesn't hammer a single registry or API.
+type hostLimitTransport struct {
+	base  http.RoundTripper
+	limit int
+
+	mu    sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+func newHostLimitTransport(base http.RoundTripper, limit int) *hostLimitTransport {
+	return &hostLimitTransport{base: base, limit: limit, hosts: make(map[string]chan struct{})}
+}
+
+func (t *hostLimitTransport) semaphore(host string) chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sem, ok := t.hosts[host]
+	if !ok {
+		sem = make(chan struct{}, t.limit)
+		t.hosts[host] = sem
+	}
+	return sem
+}
+
+// RoundTrip waits for a free slot of the host. The slot is released once the
+// response headers arrived, bodies that are never closed can't block others.
+func (t *hostLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	sem := t.semaphore(req.URL.Host)
+	select {
+	case sem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	defer func() { <-sem }()
+	return t.base.RoundTrip(req)
+}
+
+// repoLocks serialises the writes to a repository, creating branches and PRs
+// concurrently races on the refs.
+var repoLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: make(map[string]*sync.Mutex)}
+
+// lockRepo locks owner/repo for writing and returns the unlock function.
+func lockRepo(owner, repo string) func() {
+	repoLocks.Lock()
+	lock, ok := repoLocks.locks[owner+"/"+repo]
+	if !ok {
+		lock = &sync.Mutex{}
+		repoLocks.locks[owner+"/"+repo] = lock
+	}
+	repoLocks.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// withRepoLock runs fn with owner/repo locked. The lock is released even if
+// fn panics, runDependency recovers from that and other workers go on.
+func withRepoLock(owner, repo string, fn func()) {
+	unlock := lockRepo(owner, repo)
+	defer unlock()
+	fn()
+}
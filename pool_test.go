@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPanicReleasesRepoLock(t *testing.T) {
+	deps := []Dependency{{ValuesChartName: "a"}, {ValuesChartName: "b"}, {ValuesChartName: "c"}}
+	done := make(chan []DependencyResult)
+	go func() {
+		done <- runDependencies(context.Background(), deps, 2, func(ctx context.Context, dep Dependency) DependencyResult {
+			withRepoLock("owner", "homelab", func() {
+				panic("edit failed")
+			})
+			return DependencyResult{Name: dep.ValuesChartName}
+		})
+	}()
+
+	select {
+	case results := <-done:
+		for _, r := range results {
+			if len(r.Errors) != 1 || !strings.Contains(r.Errors[0].Error(), "edit failed") {
+				t.Errorf("%s: got errors %v, want the panic", r.Name, r.Errors)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("workers blocked on the repo lock")
+	}
+}
+
+func TestSetTargetRevision(t *testing.T) {
+	wrap := func(body string) []byte {
+		return []byte("{{ if .Values.app.enabled }}\n" + body + "\n{{ end }}")
+	}
+	tests := []struct {
+		name    string
+		content []byte
+		wantErr bool
+	}{
+		{"source", wrap("spec:\n  source:\n    targetRevision: 1.0.0"), false},
+		{"sources", wrap("spec:\n  sources:\n  - targetRevision: 1.0.0"), true},
+		{"no spec", wrap("metadata:\n  name: app"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := setTargetRevision(tt.content, "2.0.0")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(got), "targetRevision: 2.0.0") || !strings.HasPrefix(string(got), "{{ if .Values.app.enabled }}\n") {
+				t.Errorf("got %s", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// maxReleaseNotes is how many releases between the current and the new
+	// version a PR body lists, the newest first.
+	maxReleaseNotes = 10
+	// maxReleaseNotesLength cuts the notes of a single release.
+	maxReleaseNotesLength = 4000
+	// maxPullRequestBody stays below the 65536 characters GitHub accepts.
+	maxPullRequestBody = 65000
+)
+
+// defaultPullRequestTemplate renders the body of update PRs unless the
+// config brings its own pullRequestTemplate.
+const defaultPullRequestTemplate = `{{.Title}}
+{{- range .Dependencies}}
+- dependency {{.Name}} {{.OldVersion}} -> {{.NewVersion}}
+{{- end}}
+{{- if not .Created.IsZero}}
+
+Chart {{.NewVersion}} was published {{.Created.Format "2006-01-02"}}.
+{{- end}}
+{{- with .Compare}}
+
+[Compare {{$.OldTag}}...{{$.NewTag}}]({{.}})
+{{- end}}
+{{- with .Highlights}}
+
+:warning: **Breaking changes and deprecations**
+{{range .}}
+- {{.}}
+{{- end}}
+{{- end}}
+{{- with .Releases}}
+
+### Release notes
+{{- range .}}
+
+<details>
+<summary>{{.Tag}}{{if not .Published.IsZero}} ({{.Published.Format "2006-01-02"}}){{end}}{{if .Breaking}} :warning: breaking{{end}}</summary>
+
+{{.Notes}}
+{{- with .URL}}
+
+[Release notes]({{.}})
+{{- end}}
+</details>
+{{- end}}
+{{- if $.OlderReleases}}
+
+{{$.OlderReleases}} older releases are not listed.
+{{- end}}
+{{- end}}
+{{- with .AllReleases}}
+
+Not every release since the deployed version could be listed, see [all releases]({{.}}).
+{{- end}}
+{{- .Note}}`
+
+// PullRequestBody is what the PR template renders.
+type PullRequestBody struct {
+	Title      string
+	Dependency string
+	// OldVersion and NewVersion are the versions the PR updates between,
+	// of the chart for chart updates.
+	OldVersion string
+	NewVersion string
+	// Created is when the new chart was published to its index, zero for app
+	// updates.
+	Created time.Time
+	// Compare links the upstream changes between OldTag and NewTag.
+	Compare string
+	OldTag  string
+	NewTag  string
+	// Releases are the upstream releases after the deployed app version up
+	// to the new one, newest first.
+	Releases      []ReleaseNotes
+	OlderReleases int
+	// AllReleases links the upstream releases if Releases may be missing
+	// some before the deployed version.
+	AllReleases string
+	// Highlights are the lines of the release notes mentioning breaking
+	// changes or deprecations.
+	Highlights   []string
+	Dependencies []DependencyUpdate
+	// Note holds the platform and major update notes.
+	Note string
+
+	template *template.Template
+}
+
+// ReleaseNotes is an upstream release listed in a PR body.
+type ReleaseNotes struct {
+	Tag       string
+	Name      string
+	URL       string
+	Published time.Time
+	// Notes are the release notes with breaking changes highlighted.
+	Notes    string
+	Breaking bool
+}
+
+// pullRequestTemplate parses the pullRequestTemplate of the config.
+func (c *Config) pullRequestTemplate() (*template.Template, error) {
+	text := c.PullRequestTemplate
+	if text == "" {
+		text = defaultPullRequestTemplate
+	}
+	tmpl, err := template.New("pullRequestTemplate").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pullRequestTemplate: %v", err)
+	}
+	return tmpl, nil
+}
+
+// newPullRequestBody describes an update of dep from oldVersion to
+// newVersion, with the upstream releases of the app between oldApp and
+// newApp.
+func newPullRequestBody(dep Dependency, config *Config, name, oldVersion, newVersion, oldApp, newApp, note string) (*PullRequestBody, error) {
+	tmpl, err := config.pullRequestTemplate()
+	if err != nil {
+		return nil, err
+	}
+	body := &PullRequestBody{
+		Title:      fmt.Sprintf("Update %s to version %s", name, newVersion),
+		Dependency: name,
+		OldVersion: oldVersion,
+		NewVersion: newVersion,
+		Note:       note,
+		template:   tmpl,
+	}
+	if newApp == "" || oldApp == newApp {
+		return body, nil
+	}
+
+	// tags are matched by version, "1.2" deploys the release v1.2.0 as well
+	oldTag, newTag := "", ""
+	reached := oldApp == ""
+	for _, release := range dep.Releases {
+		tag := dep.dockerTag(release.TagName)
+		version := comparableVersion(tag)
+		switch {
+		case tag == oldApp:
+			oldTag = release.TagName
+		case tag == newApp:
+			newTag = release.TagName
+		case body.OldTag == "" && oldApp != "" && compareVersions(version, comparableVersion(oldApp)) == 0:
+			body.OldTag = release.TagName
+		case body.NewTag == "" && compareVersions(version, comparableVersion(newApp)) == 0:
+			body.NewTag = release.TagName
+		}
+		if compareVersions(version, comparableVersion(newApp)) > 0 {
+			continue
+		}
+		if oldApp != "" && compareVersions(version, comparableVersion(oldApp)) <= 0 {
+			reached = true
+			continue
+		}
+		if len(body.Releases) == maxReleaseNotes {
+			body.OlderReleases++
+			continue
+		}
+		notes, highlights := highlightReleaseNotes(quoteReleaseNotes(release.Body, dep.Owner, dep.Repo))
+		for _, h := range highlights {
+			body.Highlights = append(body.Highlights, fmt.Sprintf("`%s` %s", release.TagName, h))
+		}
+		body.Releases = append(body.Releases, ReleaseNotes{
+			Tag:       release.TagName,
+			Name:      release.Name,
+			URL:       release.HTMLURL,
+			Published: release.PublishedAt,
+			Notes:     truncate(notes, maxReleaseNotesLength),
+			Breaking:  len(highlights) > 0,
+		})
+	}
+	// an exact match wins over one by version
+	if oldTag != "" {
+		body.OldTag = oldTag
+	}
+	if newTag != "" {
+		body.NewTag = newTag
+	}
+	if !reached && dep.ReleasesIncomplete {
+		body.AllReleases = fmt.Sprintf("https://github.com/%s/%s/releases", dep.Owner, dep.Repo)
+	}
+	if body.OldTag != "" && body.NewTag != "" {
+		body.Compare = fmt.Sprintf("https://github.com/%s/%s/compare/%s...%s", dep.Owner, dep.Repo, body.OldTag, body.NewTag)
+	}
+	return body, nil
+}
+
+// render renders the PR body with the template of the config.
+func (b *PullRequestBody) render() (string, error) {
+	var out strings.Builder
+	if err := b.template.Execute(&out, b); err != nil {
+		return "", fmt.Errorf("error rendering pullRequestTemplate: %v", err)
+	}
+	return truncate(out.String(), maxPullRequestBody), nil
+}
+
+var (
+	mentionRe  = regexp.MustCompile(`(^|[^\w/` + "`" + `])@([A-Za-z0-9][A-Za-z0-9-]*)`)
+	issueRefRe = regexp.MustCompile(`(^|[\s(\[])#(\d+)\b`)
+)
+
+// quoteReleaseNotes keeps upstream notes from pinging the people they
+// mention and points their issue references back to the upstream repo.
+func quoteReleaseNotes(notes, owner, repo string) string {
+	notes = mentionRe.ReplaceAllString(notes, "${1}@<!-- -->${2}")
+	return issueRefRe.ReplaceAllString(notes, "${1}"+owner+"/"+repo+"#${2}")
+}
+
+// breakingRe matches the lines of release notes reviewers shouldn't miss.
+var breakingRe = regexp.MustCompile(`(?i)\bbreaking\b|deprecat`)
+
+// highlightReleaseNotes marks the lines of notes mentioning breaking changes
+// or deprecations, and the bullets below such a heading, and returns them
+// without markdown. Code blocks are left alone.
+func highlightReleaseNotes(notes string) (string, []string) {
+	lines := strings.Split(strings.TrimSpace(strings.Replace(notes, "\r\n", "\n", -1)), "\n")
+	var highlights []string
+	fenced, section := false, false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") {
+			fenced = !fenced
+			continue
+		}
+		if fenced {
+			continue
+		}
+		if m := releaseHeadingRe.FindStringSubmatch(trimmed); m != nil {
+			section = breakingRe.MatchString(m[1])
+			if section {
+				lines[i] = strings.Replace(line, m[1], ":warning: "+m[1], 1)
+			}
+			continue
+		}
+		line = strings.TrimRight(line, " \t")
+		bullet := releaseBulletRe.FindStringSubmatch(line)
+		if !breakingRe.MatchString(line) && (!section || bullet == nil) {
+			continue
+		}
+		text := trimmed
+		if bullet != nil {
+			text = bullet[1]
+		}
+		prefix := line[:len(line)-len(text)]
+		text = strings.TrimSpace(strings.Replace(text, "**", "", -1))
+		lines[i] = prefix + ":warning: **" + text + "**"
+		highlights = append(highlights, markdownLinkRe.ReplaceAllString(text, "$1"))
+	}
+	return strings.Join(lines, "\n"), highlights
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuoteReleaseNotes(t *testing.T) {
+	tests := []struct {
+		name  string
+		notes string
+		want  string
+	}{
+		{"mention", "thanks @alice!", "thanks @<!-- -->alice!"},
+		{"mention at the start", "@bob fixed it", "@<!-- -->bob fixed it"},
+		{"email", "mail dev@example.com", "mail dev@example.com"},
+		{"code", "run `@latest`", "run `@latest`"},
+		{"issue", "fixes #123", "fixes owner/repo#123"},
+		{"issue in parentheses", "a fix (#45)", "a fix (owner/repo#45)"},
+		{"issue at the start", "#7 is fixed", "owner/repo#7 is fixed"},
+		{"qualified issue", "see other/repo#9", "see other/repo#9"},
+		{"anchor", "see [docs](https://example.com/#123)", "see [docs](https://example.com/#123)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quoteReleaseNotes(tt.notes, "owner", "repo"); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHighlightReleaseNotes(t *testing.T) {
+	tests := []struct {
+		name       string
+		notes      string
+		want       string
+		highlights []string
+	}{
+		{
+			name:  "nothing to highlight",
+			notes: "## Changes\n- faster startup\n",
+			want:  "## Changes\n- faster startup",
+		},
+		{
+			name:       "breaking line",
+			notes:      "- **Breaking:** drop the v1 API\n- faster startup",
+			want:       "- :warning: **Breaking: drop the v1 API**\n- faster startup",
+			highlights: []string{"Breaking: drop the v1 API"},
+		},
+		{
+			name:       "deprecation with a link",
+			notes:      "The [old config](https://example.com) is deprecated",
+			want:       ":warning: **The [old config](https://example.com) is deprecated**",
+			highlights: []string{"The old config is deprecated"},
+		},
+		{
+			name:       "breaking section",
+			notes:      "## Breaking Changes\n- rename foo\n* drop bar\n\n## Fixes\n- fix baz",
+			want:       "## :warning: Breaking Changes\n- :warning: **rename foo**\n* :warning: **drop bar**\n\n## Fixes\n- fix baz",
+			highlights: []string{"rename foo", "drop bar"},
+		},
+		{
+			name:  "fenced block",
+			notes: "```\n# breaking\n- deprecated\n```\n- ok",
+			want:  "```\n# breaking\n- deprecated\n```\n- ok",
+		},
+		{
+			name:       "windows line endings",
+			notes:      "- breaking change\r\n- ok\r\n",
+			want:       "- :warning: **breaking change**\n- ok",
+			highlights: []string{"breaking change"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, highlights := highlightReleaseNotes(tt.notes)
+			if got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+			if !reflect.DeepEqual(highlights, tt.highlights) {
+				t.Errorf("highlights %q, want %q", highlights, tt.highlights)
+			}
+		})
+	}
+}
+
+func TestNewPullRequestBody(t *testing.T) {
+	published := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	releases := []Release{
+		{TagName: "v1.3.0", HTMLURL: "https://github.com/owner/repo/releases/tag/v1.3.0", PublishedAt: published, Body: "- faster"},
+		{TagName: "v1.2.1", HTMLURL: "https://github.com/owner/repo/releases/tag/v1.2.1", Body: "## Breaking\n- drop foo, thanks @alice (#12)"},
+		{TagName: "v1.2.0", Body: "- initial"},
+		{TagName: "v1.1.0"},
+	}
+	tests := []struct {
+		name       string
+		dep        Dependency
+		oldApp     string
+		newApp     string
+		tags       []string
+		compare    string
+		highlights []string
+		all        string
+	}{
+		{
+			name:       "releases in between",
+			dep:        Dependency{Owner: "owner", Repo: "repo", Releases: releases},
+			oldApp:     "1.2.0",
+			newApp:     "1.3.0",
+			tags:       []string{"v1.3.0", "v1.2.1"},
+			compare:    "https://github.com/owner/repo/compare/v1.2.0...v1.3.0",
+			highlights: []string{"`v1.2.1` drop foo, thanks @<!-- -->alice (owner/repo#12)"},
+		},
+		{
+			name:       "tags matched by version",
+			dep:        Dependency{Owner: "owner", Repo: "repo", Releases: releases},
+			oldApp:     "1.2",
+			newApp:     "1.3",
+			tags:       []string{"v1.3.0", "v1.2.1"},
+			compare:    "https://github.com/owner/repo/compare/v1.2.0...v1.3.0",
+			highlights: []string{"`v1.2.1` drop foo, thanks @<!-- -->alice (owner/repo#12)"},
+		},
+		{
+			name:   "no app update",
+			dep:    Dependency{Owner: "owner", Repo: "repo", Releases: releases},
+			oldApp: "1.3.0",
+			newApp: "1.3.0",
+		},
+		{
+			name:       "incomplete list",
+			dep:        Dependency{Owner: "owner", Repo: "repo", Releases: releases[:2], ReleasesIncomplete: true},
+			oldApp:     "1.1.0",
+			newApp:     "1.3.0",
+			tags:       []string{"v1.3.0", "v1.2.1"},
+			highlights: []string{"`v1.2.1` drop foo, thanks @<!-- -->alice (owner/repo#12)"},
+			all:        "https://github.com/owner/repo/releases",
+		},
+		{
+			name:       "complete list without the deployed release",
+			dep:        Dependency{Owner: "owner", Repo: "repo", Releases: releases[:2]},
+			oldApp:     "1.1.0",
+			newApp:     "1.3.0",
+			tags:       []string{"v1.3.0", "v1.2.1"},
+			highlights: []string{"`v1.2.1` drop foo, thanks @<!-- -->alice (owner/repo#12)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := newPullRequestBody(tt.dep, &Config{}, "app", "1.0.0", "1.1.0", tt.oldApp, tt.newApp, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var tags []string
+			for _, r := range body.Releases {
+				tags = append(tags, r.Tag)
+			}
+			if !reflect.DeepEqual(tags, tt.tags) {
+				t.Errorf("releases %v, want %v", tags, tt.tags)
+			}
+			if body.Compare != tt.compare {
+				t.Errorf("compare %q, want %q", body.Compare, tt.compare)
+			}
+			if !reflect.DeepEqual(body.Highlights, tt.highlights) {
+				t.Errorf("highlights %q, want %q", body.Highlights, tt.highlights)
+			}
+			if body.AllReleases != tt.all {
+				t.Errorf("all releases %q, want %q", body.AllReleases, tt.all)
+			}
+			if _, err := body.render(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestPullRequestBodyRender(t *testing.T) {
+	var releases []Release
+	for i := 20; i > 0; i-- {
+		releases = append(releases, Release{TagName: fmt.Sprintf("v1.%d.0", i), Body: strings.Repeat("x", 2*maxReleaseNotesLength)})
+	}
+	dep := Dependency{Owner: "owner", Repo: "repo", Releases: releases}
+	body, err := newPullRequestBody(dep, &Config{}, "app", "1.0.0", "2.0.0", "1.0.0", "1.20.0", "\n\nnote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Releases) != maxReleaseNotes || body.OlderReleases != 10 {
+		t.Fatalf("%d releases, %d older", len(body.Releases), body.OlderReleases)
+	}
+	for _, r := range body.Releases {
+		if len(r.Notes) > maxReleaseNotesLength {
+			t.Errorf("%s has %d characters of notes", r.Tag, len(r.Notes))
+		}
+	}
+	out, err := body.render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "Update app to version 2.0.0\n") || !strings.Contains(out, "10 older releases are not listed.") {
+		t.Errorf("unexpected body:\n%s", out)
+	}
+
+	// long templates are cut at the limit GitHub accepts
+	body.template, err = (&Config{PullRequestTemplate: "{{range .Releases}}{{.Notes}}{{.Notes}}{{end}}"}).pullRequestTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = body.render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) > maxPullRequestBody {
+		t.Errorf("body has %d characters, want at most %d", len(out), maxPullRequestBody)
+	}
+}
+
+func TestListReleasesPages(t *testing.T) {
+	var pages []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := r.URL.Query().Get("page")
+		pages = append(pages, page)
+		switch page {
+		case "":
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?page=2>; rel="next", <%s%s?page=3>; rel="last"`, "http://"+r.Host, r.URL.Path, "http://"+r.Host, r.URL.Path))
+			fmt.Fprint(w, `[{"tag_name":"v3.0.0"},{"tag_name":"v3.0.0-rc.1","prerelease":true}]`)
+		case "2":
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?page=3>; rel="next"`, "http://"+r.Host, r.URL.Path))
+			fmt.Fprint(w, `[{"tag_name":"v2.0.0"}]`)
+		default:
+			fmt.Fprint(w, `[{"tag_name":"v1.0.0"}]`)
+		}
+	}))
+	defer server.Close()
+	t.Setenv("INPUT_CACHE_DIR", t.TempDir())
+	defer func(url string) { githubAPIURL = url }(githubAPIURL)
+	githubAPIURL = server.URL
+
+	until := func(version string) func(Release) bool {
+		return func(r Release) bool { return compareVersions(comparableVersion(r.TagName), version) <= 0 }
+	}
+
+	releases, complete, err := listReleases("owner", "repo", "token", until("2.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(releases) != 2 || !complete || !reflect.DeepEqual(pages, []string{"", "2"}) {
+		t.Errorf("%d releases, complete %v, pages %q", len(releases), complete, pages)
+	}
+
+	pages = nil
+	releases, complete, err = listReleases("owner", "repo", "token", until("0.1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(releases) != 3 || !complete || len(pages) != 3 {
+		t.Errorf("%d releases, complete %v, pages %q", len(releases), complete, pages)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// registryTimeout bounds a single registry request, including reading the
+// tag list of a repository.
+const registryTimeout = time.Minute
+
+// registryClient talks to an OCI distribution (docker v2) registry. It
+// handles the anonymous bearer token challenge most public registries
+// (docker hub, ghcr.io, quay.io) answer with.
+type registryClient struct {
+	client *http.Client
+	tokens map[string]string
+}
+
+func newRegistryClient() *registryClient {
+	return &registryClient{
+		client: &http.Client{Timeout: registryTimeout},
+		tokens: make(map[string]string),
+	}
+}
+
+// splitOCIReference splits a reference like "oci://registry-1.docker.io/bitnamicharts"
+// or "ghcr.io/org/image" into the registry host and the repository path.
+func splitOCIReference(ref string) (string, string) {
+	ref = strings.TrimPrefix(ref, "oci://")
+	ref = strings.TrimSuffix(ref, "/")
+
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) == 1 || (!strings.ContainsAny(parts[0], ".:") && parts[0] != "localhost") {
+		// docker hub shorthand such as "nextcloud" or "loeken/jellyfin"
+		if len(parts) == 1 {
+			return "registry-1.docker.io", "library/" + ref
+		}
+		return "registry-1.docker.io", ref
+	}
+	if parts[0] == "docker.io" || parts[0] == "index.docker.io" {
+		parts[0] = "registry-1.docker.io"
+		if !strings.Contains(parts[1], "/") {
+			parts[1] = "library/" + parts[1]
+		}
+	}
+	return parts[0], parts[1]
+}
+
+// get performs a GET against the registry.
+func (r *registryClient) get(host, path string, accept []string) (*http.Response, error) {
+	return r.request("GET", host, path, accept)
+}
+
+// request performs a request against the registry, answering a bearer
+// challenge once if the registry asks for one.
+func (r *registryClient) request(method, host, path string, accept []string) (*http.Response, error) {
+	url := fmt.Sprintf("https://%s/v2/%s", host, path)
+
+	do := func() (*http.Response, error) {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range accept {
+			req.Header.Add("Accept", a)
+		}
+		if token, ok := r.tokens[host]; ok {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return r.client.Do(req)
+	}
+
+	resp, err := do()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	token, err := r.fetchToken(challenge)
+	if err != nil {
+		return nil, err
+	}
+	r.tokens[host] = token
+
+	return do()
+}
+
+var challengeParamRe = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// fetchToken requests an anonymous pull token for a "Bearer realm=...,service=...,scope=..." challenge.
+func (r *registryClient) fetchToken(challenge string) (string, error) {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return "", fmt.Errorf("unsupported registry auth challenge: %q", challenge)
+	}
+
+	params := make(map[string]string)
+	for _, m := range challengeParamRe.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	realm, ok := params["realm"]
+	if !ok {
+		return "", fmt.Errorf("registry auth challenge has no realm: %q", challenge)
+	}
+
+	query := url.Values{}
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	if scope, ok := params["scope"]; ok {
+		query.Set("scope", scope)
+	}
+
+	resp, err := r.client.Get(realm + "?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get registry token: %s", resp.Status)
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", err
+	}
+	if tokenResp.Token != "" {
+		return tokenResp.Token, nil
+	}
+	return tokenResp.AccessToken, nil
+}
+
+// listTags returns all tags of a repository in the registry.
+func (r *registryClient) listTags(host, repository string) ([]string, error) {
+	resp, err := r.get(host, repository+"/tags/list", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to list tags of %s/%s: %s %s", host, repository, resp.Status, body)
+	}
+
+	var tagList struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tagList); err != nil {
+		return nil, err
+	}
+	return tagList.Tags, nil
+}
+
+// manifestMediaTypes are accepted when resolving a tag, the index/list types
+// come first so multi-arch images resolve to their manifest list digest.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// getManifestDigest resolves a tag of an image to the digest of its manifest
+// list (or plain manifest for single arch images).
+func (r *registryClient) getManifestDigest(image, tag string) (string, error) {
+	host, repository := splitOCIReference(image)
+
+	// HEAD requests don't count against the docker hub pull limit
+	resp, err := r.request("HEAD", host, repository+"/manifests/"+tag, manifestMediaTypes)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to resolve %s:%s: %s", image, tag, resp.Status)
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+
+	// Not every registry sends the digest header, hash the manifest ourselves
+	resp, err = r.get(host, repository+"/manifests/"+tag, manifestMediaTypes)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to resolve %s:%s: %s", image, tag, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(body)), nil
+}
+
+// errManifestNotFound is returned when a tag doesn't exist in the registry.
+var errManifestNotFound = errors.New("manifest not found")
+
+// getPlatforms returns the platforms ("os/arch" or "os/arch/variant") an
+// image is published for at tag.
+func (r *registryClient) getPlatforms(image, tag string) ([]string, error) {
+	host, repository := splitOCIReference(image)
+
+	resp, err := r.get(host, repository+"/manifests/"+tag, manifestMediaTypes)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errManifestNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get manifest of %s:%s: %s", image, tag, resp.Status)
+	}
+
+	var manifest struct {
+		MediaType string `json:"mediaType"`
+		Manifests []struct {
+			Platform struct {
+				OS           string `json:"os"`
+				Architecture string `json:"architecture"`
+				Variant      string `json:"variant"`
+			} `json:"platform"`
+		} `json:"manifests"`
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return nil, err
+	}
+
+	// A manifest list / image index carries the platforms of all its entries
+	if len(manifest.Manifests) > 0 {
+		var platforms []string
+		for _, m := range manifest.Manifests {
+			// attestation manifests are listed as unknown/unknown
+			if m.Platform.OS == "" || m.Platform.OS == "unknown" {
+				continue
+			}
+			platforms = append(platforms, formatPlatform(m.Platform.OS, m.Platform.Architecture, m.Platform.Variant))
+		}
+		return platforms, nil
+	}
+
+	// A single manifest, the platform is only recorded in the image config
+	configResp, err := r.get(host, repository+"/blobs/"+manifest.Config.Digest, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer configResp.Body.Close()
+	if configResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get image config of %s:%s: %s", image, tag, configResp.Status)
+	}
+
+	var config struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+		Variant      string `json:"variant"`
+	}
+	if err := json.NewDecoder(configResp.Body).Decode(&config); err != nil {
+		return nil, err
+	}
+	return []string{formatPlatform(config.OS, config.Architecture, config.Variant)}, nil
+}
+
+func formatPlatform(os, arch, variant string) string {
+	if variant != "" {
+		return os + "/" + arch + "/" + variant
+	}
+	return os + "/" + arch
+}
+
+var stableSemverRe = regexp.MustCompile(`^v?\d+\.\d+\.\d+$`)
+
+// listOCIChartVersions returns the stable versions of a chart published to
+// an OCI registry, e.g. oci://registry-1.docker.io/bitnamicharts, highest
+// first.
+func listOCIChartVersions(repository, chartName string) ([]string, error) {
+	host, path := splitOCIReference(repository)
+
+	tags, err := newRegistryClient().listTags(host, path+"/"+chartName)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []string
+	for _, tag := range tags {
+		// helm stores "+" as "_" in OCI tags
+		tag = strings.Replace(tag, "_", "+", -1)
+		if stableSemverRe.MatchString(tag) {
+			versions = append(versions, strings.TrimPrefix(tag, "v"))
+		}
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("no stable version found for chart %s in %s", chartName, repository)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return compareVersions(versions[i], versions[j]) > 0
+	})
+	return versions, nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"time"
+)
+
+// PendingVersion is a version that is held back because it was published
+// less than the minimum release age ago.
+type PendingVersion struct {
+	Version   string
+	Published time.Time
+}
+
+// isOldEnough reports whether something published at published is at least
+// minAge old. Unknown publish dates never hold anything back.
+func isOldEnough(published time.Time, minAge time.Duration) bool {
+	if minAge == 0 || published.IsZero() {
+		return true
+	}
+	return time.Since(published) >= minAge
+}
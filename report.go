@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Decisions taken for a dependency.
+const (
+	decisionUpToDate = "up-to-date"
+	decisionUpdate   = "update"
+	decisionHeld     = "held"
+	decisionError    = "error"
+)
+
+// Action is a change proposed for a dependency.
+type Action struct {
+	// Kind is app, chart, digest, subcharts or group.
+	Kind        string `json:"kind"`
+	Target      string `json:"target"`
+	Version     string `json:"version,omitempty"`
+	PullRequest string `json:"pullRequest,omitempty"`
+	// Release links the release notes of a new app version.
+	Release string `json:"release,omitempty"`
+}
+
+// decide sets the decision and its reason once a check is done.
+func (r *DependencyResult) decide(app, chart versionSelection) {
+	switch {
+	case len(r.Errors) > 0:
+		r.Decision, r.Reason = decisionError, r.Errors[0].Error()
+	case r.AppUpdated || r.ChartUpdated:
+		var proposed []string
+		for _, action := range r.Actions {
+			proposed = append(proposed, action.Kind+" "+action.Version)
+		}
+		r.Decision, r.Reason = decisionUpdate, "proposed "+strings.Join(proposed, ", ")
+	case r.HeldPlatforms:
+		r.Decision, r.Reason = decisionHeld, "not all platforms are published yet"
+	default:
+		// newer apps of charts managed upstream wait for a chart shipping them
+		var held []string
+		for _, version := range []string{r.NewAppVersion, r.NewMajorAppVersion} {
+			if version != "" {
+				held = append(held, "app "+version+" (not proposed)")
+			}
+		}
+		for _, selection := range []versionSelection{app, chart} {
+			for _, pending := range selection.Pending {
+				held = append(held, pending.Version+" (too new)")
+			}
+			held = append(held, selection.Skipped...)
+		}
+		if len(held) > 0 {
+			r.Decision, r.Reason = decisionHeld, "held back "+strings.Join(held, ", ")
+		} else {
+			r.Decision, r.Reason = decisionUpToDate, "no newer version"
+		}
+	}
+}
+
+// reportVersions are the versions of an app or chart.
+type reportVersions struct {
+	Current       string `json:"current"`
+	Latest        string `json:"latest,omitempty"`
+	Proposed      string `json:"proposed,omitempty"`
+	ProposedMajor string `json:"proposedMajor,omitempty"`
+	AppVersion    string `json:"appVersion,omitempty"`
+}
+
+type reportError struct {
+	Phase   Phase  `json:"phase,omitempty"`
+	Message string `json:"message"`
+}
+
+// reportRecord is the outcome of a dependency in the JSON report.
+type reportRecord struct {
+	Name     string         `json:"name"`
+	Chart    reportVersions `json:"chart"`
+	App      reportVersions `json:"app"`
+	Decision string         `json:"decision"`
+	Reason   string         `json:"reason"`
+	Actions  []Action       `json:"actions,omitempty"`
+	Errors   []reportError  `json:"errors,omitempty"`
+}
+
+// Report is the JSON report of a run.
+type Report struct {
+	GeneratedAt  time.Time      `json:"generatedAt"`
+	ExitCode     int            `json:"exitCode"`
+	Dependencies []reportRecord `json:"dependencies"`
+}
+
+func reportRecords(results []DependencyResult) []reportRecord {
+	records := make([]reportRecord, 0, len(results))
+	for _, r := range results {
+		record := reportRecord{
+			Name: r.Name,
+			Chart: reportVersions{
+				Current:       r.ChartVersion,
+				Latest:        r.LatestChartVersion,
+				Proposed:      r.NewChartVersion,
+				ProposedMajor: r.NewMajorChartVersion,
+				AppVersion:    r.ChartAppVersion,
+			},
+			App: reportVersions{
+				Current:       r.DeployedAppVersion,
+				Latest:        r.UpstreamAppVersion,
+				Proposed:      r.NewAppVersion,
+				ProposedMajor: r.NewMajorAppVersion,
+			},
+			Decision: r.Decision,
+			Reason:   secrets.redact(r.Reason),
+			Actions:  r.Actions,
+		}
+		if record.Decision == "" && len(r.Errors) > 0 {
+			// the check didn't get to a decision
+			record.Decision, record.Reason = decisionError, secrets.redact(r.Errors[0].Error())
+		}
+		for _, err := range r.Errors {
+			record.Errors = append(record.Errors, reportError{Phase: phaseOf(err), Message: secrets.redact(err.Error())})
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// writeReport writes the results in format, text or json.
+func writeReport(w io.Writer, format string, results []DependencyResult) error {
+	switch format {
+	case "", "text":
+		_, err := fmt.Fprintln(w, formatReport(results))
+		return err
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(Report{
+			GeneratedAt:  time.Now().UTC(),
+			ExitCode:     exitCode(results),
+			Dependencies: reportRecords(results),
+		})
+	}
+	return fmt.Errorf("unknown report format %q, use text or json", format)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestUpstreamAppUpdateIsNotProposed(t *testing.T) {
+	// a chart managed upstream whose app is ahead of the chart's appVersion
+	dep := Dependency{ValuesChartName: "grafana", ChartType: "optional"}
+	result := DependencyResult{Name: "grafana", ChartVersion: "7.0.0", AppVersion: "10.0.0", NewAppVersion: "10.1.0"}
+	result.AppUpdated = updateApp(context.Background(), dep, nil, &Config{}, &result, "10.0.0", "10.1.0", nil, false)
+	result.decide(versionSelection{Latest: -1, Major: -1}, versionSelection{Latest: -1, Major: -1})
+
+	if result.AppUpdated {
+		t.Error("AppUpdated is set without a proposed change")
+	}
+	if code := exitCode([]DependencyResult{result}); code != exitUpToDate {
+		t.Errorf("exit code %d, want %d", code, exitUpToDate)
+	}
+	if result.Decision != decisionHeld || result.Reason != "held back app 10.1.0 (not proposed)" {
+		t.Errorf("decision %s: %s", result.Decision, result.Reason)
+	}
+}
+
+func TestReportRedactsErrors(t *testing.T) {
+	secrets.add("s3cr3t-webhook-value")
+	result := DependencyResult{Name: "grafana", Errors: []error{withPhase(PhaseFetch, errors.New("GET https://example.com/?x=s3cr3t-webhook-value: 500"))}}
+	result.decide(versionSelection{Latest: -1, Major: -1}, versionSelection{Latest: -1, Major: -1})
+
+	var out strings.Builder
+	if err := writeReport(&out, "json", []DependencyResult{result}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeReport(&out, "text", []DependencyResult{result}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "s3cr3t") {
+		t.Errorf("report leaks the secret:\n%s", out.String())
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/go-github/v53/github"
+)
+
+const (
+	stateStoreFile   = "file"
+	stateStoreBranch = "branch"
+
+	defaultStateBranch = "homelab-updater-state"
+	defaultStateFile   = "state.json"
+	// maxStateSaves is how often a save racing other runs is tried.
+	maxStateSaves = 3
+)
+
+// StateConfig configures where the updater remembers what it did and saw
+// between runs. Without a store every run starts from scratch.
+type StateConfig struct {
+	// Store is file for a local JSON file, e.g. kept by actions/cache, or
+	// branch for a file committed to a branch of the values repo.
+	Store string `yaml:"store"`
+	// Path of the file, state.json in the cache dir or on the branch by
+	// default.
+	Path string `yaml:"path"`
+	// Branch holds the file of the branch store, homelab-updater-state by
+	// default. It is created from the default branch if it doesn't exist.
+	Branch string `yaml:"branch"`
+}
+
+// StateStore keeps the state document.
+type StateStore interface {
+	// Load returns the stored document, nil if nothing was stored yet.
+	Load(ctx context.Context) ([]byte, error)
+	Save(ctx context.Context, content []byte) error
+}
+
+// State is what the updater remembers between runs.
+type State struct {
+	// Notified are the events announced and still current.
+	Notified []NotifiedEvent `json:"notified,omitempty"`
+	// History is kept by dependency name.
+	History map[string]*History `json:"history,omitempty"`
+
+	// loaded is the document the state was read from, unchanged state
+	// isn't saved again.
+	loaded []byte
+}
+
+// NotifiedEvent records an event sent to a notifier.
+type NotifiedEvent struct {
+	Notifier   string `json:"notifier"`
+	Dependency string `json:"dependency"`
+	Kind       string `json:"kind"`
+	// Version is the new version, the error message for errors.
+	Version string    `json:"version"`
+	SentAt  time.Time `json:"sentAt"`
+}
+
+// notified returns the record of e sent to notifier, nil if it wasn't.
+func (s *State) notified(notifier string, e Event) *NotifiedEvent {
+	for i, record := range s.Notified {
+		if record.Notifier == notifier && record.Dependency == e.Dependency && record.Kind == e.Kind && record.Version == e.stateVersion() {
+			return &s.Notified[i]
+		}
+	}
+	return nil
+}
+
+// others returns the records of the dependencies not checked in results,
+// runs of a matrix check a dependency each.
+func (s *State) others(results []DependencyResult) []NotifiedEvent {
+	return s.records(results, false)
+}
+
+// records returns the records of the dependencies checked in results, or of
+// the others.
+func (s *State) records(results []DependencyResult, checked bool) []NotifiedEvent {
+	names := make(map[string]bool)
+	for _, r := range results {
+		names[r.Name] = true
+	}
+	var records []NotifiedEvent
+	for _, record := range s.Notified {
+		if names[record.Dependency] == checked {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// stateVersion tells events of the same kind apart.
+func (e Event) stateVersion() string {
+	if e.Kind == eventError {
+		return e.Error
+	}
+	return e.NewVersion
+}
+
+// stateStore returns the store configured in the config, nil without one.
+func (c *Config) stateStore(ctx context.Context, auth *Auth) (StateStore, error) {
+	switch c.State.Store {
+	case "":
+		return nil, nil
+	case stateStoreFile:
+		path := c.State.Path
+		if path == "" {
+			dir := os.Getenv("INPUT_CACHE_DIR")
+			if dir == "" {
+				dir = defaultCacheDir
+			}
+			path = filepath.Join(dir, defaultStateFile)
+		}
+		return &fileStateStore{path: path}, nil
+	case stateStoreBranch:
+		// the values repo of the core charts is the repo of the updater
+		targets, err := c.targetsFor(Dependency{ChartType: "core"})
+		if err != nil {
+			return nil, err
+		}
+		t := targets.Values
+		t.Branch = c.State.Branch
+		if t.Branch == "" {
+			t.Branch = defaultStateBranch
+		}
+		t.Path = c.State.Path
+		if t.Path == "" {
+			t.Path = defaultStateFile
+		}
+		backend, client, err := targetBackend(ctx, auth, t)
+		if err != nil {
+			return nil, err
+		}
+		return &branchStateStore{backend: backend, client: client, target: t, committer: targets.Committer}, nil
+	}
+	return nil, fmt.Errorf("unknown state store %q, use file or branch", c.State.Store)
+}
+
+// loadState reads the state from store, an empty state if nothing was
+// stored yet.
+func loadState(ctx context.Context, store StateStore) (*State, error) {
+	content, err := store.Load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error loading state: %v", err)
+	}
+	state := &State{loaded: content}
+	if len(content) == 0 {
+		return state, nil
+	}
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil, fmt.Errorf("error reading state: %v", err)
+	}
+	return state, nil
+}
+
+// saveState writes the records and history of the dependencies in results to
+// store if they changed. Runs saving at the same time make it fail, it then merges
+// with the state saved in between and tries again.
+func saveState(ctx context.Context, store StateStore, state *State, results []DependencyResult) error {
+	var err error
+	for attempt := 0; attempt < maxStateSaves; attempt++ {
+		if attempt > 0 {
+			fresh, loadErr := loadState(ctx, store)
+			if loadErr != nil {
+				return loadErr
+			}
+			fresh.Notified = append(fresh.others(results), state.records(results, true)...)
+			for _, r := range results {
+				if h, ok := state.History[r.Name]; ok {
+					fresh.history(r.Name)
+					fresh.History[r.Name] = h
+				}
+			}
+			state = fresh
+		}
+
+		var content []byte
+		content, err = json.MarshalIndent(state, "", "  ")
+		if err != nil {
+			return err
+		}
+		content = append(content, '\n')
+		if bytes.Equal(content, state.loaded) {
+			return nil
+		}
+		if err = store.Save(ctx, content); err == nil {
+			return nil
+		}
+		logger(ctx).Warn("error saving state, merging and retrying", "error", err)
+	}
+	return fmt.Errorf("error saving state: %v", err)
+}
+
+// fileStateStore keeps the state in a local file.
+type fileStateStore struct {
+	path string
+}
+
+func (s *fileStateStore) Load(ctx context.Context) ([]byte, error) {
+	content, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return content, err
+}
+
+func (s *fileStateStore) Save(ctx context.Context, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	// a run cancelled while writing leaves the old state intact
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// branchStateStore commits the state to a branch of a target.
+type branchStateStore struct {
+	backend   Backend
+	client    *github.Client
+	target    Target
+	committer *github.CommitAuthor
+}
+
+func (s *branchStateStore) Load(ctx context.Context) ([]byte, error) {
+	content, err := s.backend.ReadFile(ctx, s.target, s.target.Path)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return content, err
+}
+
+func (s *branchStateStore) Save(ctx context.Context, content []byte) error {
+	change := Change{
+		Message:   "Update homelab-updater state",
+		Files:     map[string][]byte{s.target.Path: content},
+		Committer: s.committer,
+	}
+	_, err := s.backend.Propose(ctx, s.target, change)
+	if isNotFound(err) && s.client != nil {
+		// first run, branch off the default branch
+		if err := s.createBranch(ctx); err != nil {
+			return err
+		}
+		_, err = s.backend.Propose(ctx, s.target, change)
+	}
+	return err
+}
+
+func (s *branchStateStore) createBranch(ctx context.Context) error {
+	t := s.target
+	repo, _, err := s.client.Repositories.Get(ctx, t.Owner, t.Repo)
+	if err != nil {
+		return err
+	}
+	base, _, err := s.client.Git.GetRef(ctx, t.Owner, t.Repo, "refs/heads/"+repo.GetDefaultBranch())
+	if err != nil {
+		return err
+	}
+	_, _, err = s.client.Git.CreateRef(ctx, t.Owner, t.Repo, &github.Reference{
+		Ref:    github.String("refs/heads/" + t.Branch),
+		Object: &github.GitObject{SHA: base.Object.SHA},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating branch %s: %v", t.Branch, err)
+	}
+	logger(ctx).Info("created state branch", "repo", t.Owner+"/"+t.Repo, "branch", t.Branch)
+	return nil
+}
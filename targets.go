@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/google/go-github/v53/github"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultBranch is the base branch of targets that don't set one.
+const defaultBranch = "main"
+
+// Targets are the repositories the updater writes to. Repo and Path are
+// templates over the Dependency, e.g. "charts/{{.ChartName}}/Chart.yaml".
+type Targets struct {
+	// Owner is the owner of every target that doesn't set its own. It
+	// defaults to githubUser of the values files.
+	Owner string `yaml:"owner"`
+	// Backend, Server and TokenEnv apply to every target that doesn't set
+	// its own, see Target.
+	Backend  string `yaml:"backend"`
+	Server   string `yaml:"server"`
+	TokenEnv string `yaml:"tokenEnv"`
+	// Homelab holds the Argo CD applications, its repo defaults to githubRepo
+	// of the values files.
+	Homelab Target `yaml:"homelab"`
+	// Values holds the values files with the chart versions, by default the
+	// repo the workflow runs in.
+	Values Target `yaml:"values"`
+	// Charts holds the self managed helm charts.
+	Charts Target `yaml:"charts"`
+	// Images holds the version files of the self managed docker images.
+	Images Target `yaml:"images"`
+	// Committer is the identity of the commits. Without it GitHub uses the
+	// user or app the token belongs to.
+	Committer *Committer `yaml:"committer"`
+}
+
+// Target is a file in a repository the updater proposes changes to.
+type Target struct {
+	Owner  string `yaml:"owner"`
+	Repo   string `yaml:"repo"`
+	Branch string `yaml:"branch"`
+	Path   string `yaml:"path"`
+	// Backend is github (default) to propose pull requests through the
+	// GitHub API, gitea, forgejo or gitlab to propose them to a self hosted
+	// forge, or git to push update branches from a local repository.
+	Backend string `yaml:"backend"`
+	// Server is the URL of a Gitea, Forgejo or GitLab instance.
+	Server string `yaml:"server"`
+	// TokenEnv names the variable with the token for Server, by default
+	// INPUT_FORGE_TOKEN. The git backend sends it to https remotes, without
+	// it github.com remotes get the GitHub token of the owner.
+	TokenEnv string `yaml:"tokenEnv"`
+	// Remote is the git remote, a URL, a path or the name of a remote of
+	// Dir. It defaults to origin with a Dir and to the GitHub repo without.
+	Remote string `yaml:"remote"`
+	// Dir is a checkout of the target, e.g. "." for the repo the workflow
+	// runs in. Without it the remote is fetched into the cache dir.
+	Dir string `yaml:"dir"`
+}
+
+// Committer is a commit identity.
+type Committer struct {
+	Name  string `yaml:"name"`
+	Email string `yaml:"email"`
+}
+
+// DependencyTargets are the targets resolved for a single dependency.
+type DependencyTargets struct {
+	Homelab   Target
+	Values    Target
+	Charts    Target
+	Images    Target
+	Committer *github.CommitAuthor
+}
+
+// URL returns the link to the pull requests of the target repo, or the
+// remote update branches are pushed to.
+func (t Target) URL() string {
+	server := strings.TrimSuffix(t.Server, "/")
+	switch t.Backend {
+	case backendGit:
+		return t.Remote
+	case backendGitea, backendForgejo:
+		return fmt.Sprintf("%s/%s/%s/pulls", server, t.Owner, t.Repo)
+	case backendGitLab:
+		return fmt.Sprintf("%s/%s/%s/-/merge_requests", server, t.Owner, t.Repo)
+	}
+	return fmt.Sprintf("https://github.com/%s/%s/pulls", t.Owner, t.Repo)
+}
+
+// github reports whether t is proposed to through the GitHub API.
+func (t Target) github() bool {
+	return t.Backend == "" || t.Backend == backendGitHub
+}
+
+// resolve fills the unset fields of t from defaults and renders the
+// templates for dep.
+func (t Target) resolve(defaults Target, dep Dependency) (Target, error) {
+	if t.Owner == "" {
+		t.Owner = defaults.Owner
+	}
+	if t.Repo == "" {
+		t.Repo = defaults.Repo
+	}
+	if t.Branch == "" {
+		t.Branch = defaults.Branch
+	}
+	if t.Path == "" {
+		t.Path = defaults.Path
+	}
+	if t.Backend == "" {
+		t.Backend = defaults.Backend
+	}
+	if t.Server == "" {
+		t.Server = defaults.Server
+	}
+	if t.TokenEnv == "" {
+		t.TokenEnv = defaults.TokenEnv
+	}
+
+	var err error
+	if t.Repo, err = renderTargetTemplate(t.Repo, dep); err != nil {
+		return t, err
+	}
+	if t.Path, err = renderTargetTemplate(t.Path, dep); err != nil {
+		return t, err
+	}
+	if t.Remote, err = renderTargetTemplate(t.Remote, dep); err != nil {
+		return t, err
+	}
+	if t.Owner == "" || t.Repo == "" {
+		return t, fmt.Errorf("no owner or repo configured for %s", t.Path)
+	}
+	if t.Backend == backendGit && t.Remote == "" {
+		if t.Dir != "" {
+			t.Remote = "origin"
+		} else {
+			t.Remote = fmt.Sprintf("https://github.com/%s/%s.git", t.Owner, t.Repo)
+		}
+	}
+	return t, nil
+}
+
+func renderTargetTemplate(text string, dep Dependency) (string, error) {
+	tmpl, err := template.New("target").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid target template %q: %v", text, err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, dep); err != nil {
+		return "", fmt.Errorf("invalid target template %q: %v", text, err)
+	}
+	return b.String(), nil
+}
+
+// targetsFor resolves the targets of dep. Unset owners and repos fall back to
+// githubUser and githubRepo of the values files and to the repository the
+// workflow runs in.
+func (c *Config) targetsFor(dep Dependency) (DependencyTargets, error) {
+	valuesFile := "values-" + dep.ChartType + ".yaml"
+	githubUser, githubRepo := readGitHubRepo(valuesFile, "values-core.yaml")
+
+	// GITHUB_REPOSITORY is owner/repo of the workflow
+	workflowOwner, workflowRepo := "", ""
+	if parts := strings.SplitN(os.Getenv("GITHUB_REPOSITORY"), "/", 2); len(parts) == 2 {
+		workflowOwner, workflowRepo = parts[0], parts[1]
+	}
+
+	owner := c.Targets.Owner
+	if owner == "" {
+		owner = githubUser
+	}
+	if owner == "" {
+		owner = workflowOwner
+	}
+
+	defaults := map[string]Target{
+		"homelab": {Owner: owner, Repo: githubRepo, Branch: defaultBranch, Path: "deploy/argocd/bootstrap-{{.ChartType}}-apps/templates/{{.ValuesChartName}}.yaml", Backend: c.Targets.Backend, Server: c.Targets.Server, TokenEnv: c.Targets.TokenEnv},
+		"values":  {Owner: owner, Repo: workflowRepo, Branch: defaultBranch, Path: "values-{{.ChartType}}.yaml", Backend: c.Targets.Backend, Server: c.Targets.Server, TokenEnv: c.Targets.TokenEnv},
+		"charts":  {Owner: owner, Repo: "helm-charts", Branch: defaultBranch, Path: "charts/{{.ChartName}}/Chart.yaml", Backend: c.Targets.Backend, Server: c.Targets.Server, TokenEnv: c.Targets.TokenEnv},
+		"images":  {Owner: owner, Repo: "docker-{{.ValuesChartName}}", Branch: defaultBranch, Path: "version.yaml", Backend: c.Targets.Backend, Server: c.Targets.Server, TokenEnv: c.Targets.TokenEnv},
+	}
+
+	var targets DependencyTargets
+	var err error
+	if targets.Homelab, err = c.Targets.Homelab.resolve(defaults["homelab"], dep); err != nil {
+		return targets, err
+	}
+	if targets.Values, err = c.Targets.Values.resolve(defaults["values"], dep); err != nil {
+		return targets, err
+	}
+	if targets.Charts, err = c.Targets.Charts.resolve(defaults["charts"], dep); err != nil {
+		return targets, err
+	}
+	if targets.Images, err = c.Targets.Images.resolve(defaults["images"], dep); err != nil {
+		return targets, err
+	}
+	if committer := c.Targets.Committer; committer != nil {
+		targets.Committer = &github.CommitAuthor{Name: github.String(committer.Name), Email: github.String(committer.Email)}
+	}
+	return targets, nil
+}
+
+// readGitHubRepo returns githubUser and githubRepo of the first values file
+// carrying them.
+func readGitHubRepo(filenames ...string) (string, string) {
+	for _, filename := range filenames {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			continue
+		}
+		var values struct {
+			GitHubUser string `yaml:"githubUser"`
+			GitHubRepo string `yaml:"githubRepo"`
+		}
+		if err := yaml.Unmarshal(content, &values); err != nil {
+			continue
+		}
+		if values.GitHubUser != "" || values.GitHubRepo != "" {
+			return values.GitHubUser, values.GitHubRepo
+		}
+	}
+	return "", ""
+}
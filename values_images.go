@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// digestModeTag pins images as "tag@sha256:..." in the tag field.
+	digestModeTag = "tag"
+	// digestModeField keeps the tag and writes the digest to a digest field
+	// next to it.
+	digestModeField = "field"
+)
+
+// imageTagLocation points at an image tag inside a chart's values.yaml.
+type imageTagLocation struct {
+	path string
+	// block is the mapping holding key.
+	block *yaml.Node
+	key   string
+}
+
+// mappingEntry returns the key and value nodes of key in a mapping, nil if
+// it has no such key.
+func mappingEntry(block *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if block == nil || block.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(block.Content); i += 2 {
+		if block.Content[i].Value == key {
+			return block.Content[i], block.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// currentTag returns the tag stored at the location without a pinned digest.
+func (l imageTagLocation) currentTag() string {
+	_, value := mappingEntry(l.block, l.key)
+	return strings.SplitN(value.Value, "@", 2)[0]
+}
+
+// set writes tag (and digest according to digestMode) to the location.
+func (l imageTagLocation) set(e *valuesEdit, tag, digest, digestMode string) error {
+	key, value := mappingEntry(l.block, l.key)
+	digestKey, digestValue := mappingEntry(l.block, "digest")
+	switch {
+	case digest != "" && digestMode == digestModeTag:
+		return e.replace(key, value, tag+"@"+digest)
+	case digest != "" && digestMode == digestModeField:
+		if err := e.replace(key, value, tag); err != nil {
+			return err
+		}
+		if digestKey != nil {
+			return e.replace(digestKey, digestValue, digest)
+		}
+		return e.insertAfter(l.block, key, value, "digest", digest)
+	default:
+		if err := e.replace(key, value, tag); err != nil {
+			return err
+		}
+		if digestMode == digestModeField && digestKey != nil {
+			// don't leave the digest of the previous tag behind
+			return e.remove(l.block, digestKey, digestValue)
+		}
+		return nil
+	}
+}
+
+// findValuesImageTags locates the image tags in a chart's values.yaml. If
+// imagePath is set (e.g. "image.tag" or "image") only that location is used,
+// otherwise every repository/tag pair whose repository matches dockerImage is
+// returned. Without a docker image the top level image block is used.
+func findValuesImageTags(values *yaml.Node, imagePath, dockerImage string) ([]imageTagLocation, error) {
+	if values.Kind == yaml.DocumentNode && len(values.Content) > 0 {
+		values = values.Content[0]
+	}
+	if imagePath != "" {
+		keys := strings.Split(imagePath, ".")
+		parent := values
+		for i, key := range keys[:len(keys)-1] {
+			_, next := mappingEntry(parent, key)
+			if next == nil || next.Kind != yaml.MappingNode {
+				return nil, fmt.Errorf("block %s does not exist in values.yaml", strings.Join(keys[:i+1], "."))
+			}
+			parent = next
+		}
+
+		last := keys[len(keys)-1]
+		_, value := mappingEntry(parent, last)
+		if value == nil {
+			return nil, fmt.Errorf("key %s does not exist in values.yaml", imagePath)
+		}
+		if value.Kind == yaml.MappingNode {
+			if _, tag := mappingEntry(value, "tag"); tag == nil {
+				return nil, fmt.Errorf("key %s.tag does not exist in values.yaml", imagePath)
+			}
+			return []imageTagLocation{{path: imagePath + ".tag", block: value, key: "tag"}}, nil
+		}
+		return []imageTagLocation{{path: imagePath, block: parent, key: last}}, nil
+	}
+
+	if dockerImage == "" {
+		_, image := mappingEntry(values, "image")
+		if _, tag := mappingEntry(image, "tag"); tag == nil {
+			return nil, nil
+		}
+		return []imageTagLocation{{path: "image.tag", block: image, key: "tag"}}, nil
+	}
+
+	locations := findMatchingImageTags(values, "", dockerImage)
+	sort.Slice(locations, func(i, j int) bool {
+		return locations[i].path < locations[j].path
+	})
+	return locations, nil
+}
+
+// findMatchingImageTags walks the values looking for maps carrying both a
+// repository and a tag key whose repository refers to dockerImage.
+func findMatchingImageTags(node *yaml.Node, prefix, dockerImage string) []imageTagLocation {
+	var locations []imageTagLocation
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		_, repository := mappingEntry(node, "repository")
+		_, tag := mappingEntry(node, "tag")
+		if repository != nil && repository.Kind == yaml.ScalarNode && tag != nil {
+			registry := ""
+			if _, r := mappingEntry(node, "registry"); r != nil && r.Kind == yaml.ScalarNode {
+				registry = r.Value
+			}
+			if imageMatches(repository.Value, registry, dockerImage) {
+				locations = append(locations, imageTagLocation{path: strings.TrimPrefix(prefix+".tag", "."), block: node, key: "tag"})
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			locations = append(locations, findMatchingImageTags(node.Content[i+1], prefix+"."+node.Content[i].Value, dockerImage)...)
+		}
+	case yaml.SequenceNode:
+		for i, value := range node.Content {
+			locations = append(locations, findMatchingImageTags(value, fmt.Sprintf("%s[%d]", prefix, i), dockerImage)...)
+		}
+	}
+
+	return locations
+}
+
+// imageMatches reports whether a values.yaml repository (optionally split into
+// registry and repository like the bitnami charts do) refers to dockerImage.
+func imageMatches(repository, registry, dockerImage string) bool {
+	if registry != "" {
+		repository = registry + "/" + repository
+	}
+
+	repoHost, repoPath := splitOCIReference(repository)
+	imageHost, imagePath := splitOCIReference(dockerImage)
+	return repoHost == imageHost && repoPath == imagePath
+}
+
+// resolveImageDigest looks up the digest of image:tag if digest pinning is
+// enabled. Images that can't be resolved (e.g. not built yet) fall back to
+// the plain tag.
+func resolveImageDigest(ctx context.Context, dockerImage, tag, digestMode string) string {
+	if digestMode == "" || dockerImage == "" {
+		return ""
+	}
+	digest, err := newRegistryClient().getManifestDigest(dockerImage, tag)
+	if err != nil {
+		logger(ctx).Warn("could not resolve digest, using the tag only", "image", dockerImage, "tag", tag, "error", err)
+		return ""
+	}
+	return digest
+}
+
+// valuesEdit edits single lines of a values.yaml. Everything else, comments
+// and the order of the keys included, stays as it is.
+type valuesEdit struct {
+	root  yaml.Node
+	lines []string
+	// replaced holds the replacements by line, removed and inserted the
+	// lines dropped and the ones added after a line, all 1-based.
+	replaced map[int][]valuesReplacement
+	removed  map[int]bool
+	inserted map[int][]string
+}
+
+// valuesReplacement replaces the runes start to end of a line.
+type valuesReplacement struct {
+	start, end int
+	text       string
+}
+
+func newValuesEdit(content []byte) (*valuesEdit, error) {
+	e := &valuesEdit{
+		lines:    strings.Split(string(content), "\n"),
+		replaced: make(map[int][]valuesReplacement),
+		removed:  make(map[int]bool),
+		inserted: make(map[int][]string),
+	}
+	if err := yaml.Unmarshal(content, &e.root); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// replace sets the scalar value of key to text, in the quoting style it had.
+func (e *valuesEdit) replace(key, value *yaml.Node, text string) error {
+	if value.Kind != yaml.ScalarNode || value.Line > len(e.lines) {
+		return fmt.Errorf("line %d: %s is not a single value", key.Line, key.Value)
+	}
+	if value.Value == text {
+		return nil
+	}
+	if value.Style == 0 && value.Tag == "!!null" && value.Value == "" {
+		// "key:" without a value, add one after the colon
+		line := []rune(e.lines[key.Line-1])
+		colon := key.Column - 1 + len([]rune(key.Value))
+		for colon < len(line) && line[colon] != ':' {
+			colon++
+		}
+		if colon == len(line) {
+			return fmt.Errorf("line %d: no value for %s", key.Line, key.Value)
+		}
+		e.replaced[key.Line] = append(e.replaced[key.Line], valuesReplacement{colon + 1, colon + 1, " " + renderScalar(value, text)})
+		return nil
+	}
+
+	line := []rune(e.lines[value.Line-1])
+	start := value.Column - 1
+	end, err := scalarEnd(line, start, value.Style)
+	if err != nil {
+		return fmt.Errorf("line %d: %v", value.Line, err)
+	}
+	e.replaced[value.Line] = append(e.replaced[value.Line], valuesReplacement{start, end, renderScalar(value, text)})
+	return nil
+}
+
+// insertAfter adds "key: text" to block on the line after the entry of
+// after, indented like it.
+func (e *valuesEdit) insertAfter(block, after, afterValue *yaml.Node, key, text string) error {
+	if block.Style&yaml.FlowStyle != 0 || afterValue.Line != after.Line {
+		return fmt.Errorf("line %d: can't add %s next to %s", after.Line, key, after.Value)
+	}
+	line := strings.Repeat(" ", after.Column-1) + key + ": " + renderScalar(&yaml.Node{}, text)
+	e.inserted[after.Line] = append(e.inserted[after.Line], line)
+	return nil
+}
+
+// remove drops the line of key from block.
+func (e *valuesEdit) remove(block, key, value *yaml.Node) error {
+	if block.Style&yaml.FlowStyle != 0 || value.Line != key.Line {
+		return fmt.Errorf("line %d: can't remove %s", key.Line, key.Value)
+	}
+	e.removed[key.Line] = true
+	return nil
+}
+
+// bytes returns the edited values.yaml.
+func (e *valuesEdit) bytes() []byte {
+	var out []string
+	for i, line := range e.lines {
+		n := i + 1
+		if replacements := e.replaced[n]; len(replacements) > 0 {
+			// right to left, so the columns of the others stay valid
+			sort.Slice(replacements, func(a, b int) bool { return replacements[a].start > replacements[b].start })
+			runes := []rune(line)
+			for _, r := range replacements {
+				runes = append(runes[:r.start:r.start], append([]rune(r.text), runes[r.end:]...)...)
+			}
+			line = string(runes)
+		}
+		if !e.removed[n] {
+			out = append(out, line)
+		}
+		out = append(out, e.inserted[n]...)
+	}
+	return []byte(strings.Join(out, "\n"))
+}
+
+// scalarEnd returns where the scalar starting at start of line ends.
+func scalarEnd(line []rune, start int, style yaml.Style) (int, error) {
+	switch style {
+	case yaml.DoubleQuotedStyle:
+		for i := start + 1; i < len(line); i++ {
+			switch line[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1, nil
+			}
+		}
+	case yaml.SingleQuotedStyle:
+		for i := start + 1; i < len(line); i++ {
+			if line[i] == '\'' {
+				if i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					continue
+				}
+				return i + 1, nil
+			}
+		}
+	case 0, yaml.FlowStyle:
+		end := start
+		for end < len(line) && !strings.ContainsRune(",]}", line[end]) {
+			if line[end] == '#' && end > start && (line[end-1] == ' ' || line[end-1] == '\t') {
+				break
+			}
+			end++
+		}
+		for end > start && strings.ContainsRune(" \t\r", line[end-1]) {
+			end--
+		}
+		return end, nil
+	}
+	return 0, fmt.Errorf("can't edit a multi-line value")
+}
+
+// renderScalar renders value in the quoting style of node. Plain values
+// yaml would read as something else than a string are quoted.
+func renderScalar(node *yaml.Node, value string) string {
+	switch node.Style {
+	case yaml.DoubleQuotedStyle:
+		return strconv.Quote(value)
+	case yaml.SingleQuotedStyle:
+		return "'" + strings.Replace(value, "'", "''", -1) + "'"
+	}
+	out, err := yaml.Marshal(value)
+	if err != nil {
+		return strconv.Quote(value)
+	}
+	return strings.TrimSuffix(string(out), "\n")
+}
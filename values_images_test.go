@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+const testValues = `# Default values for nextcloud.
+image:
+  repository: nextcloud # upstream image
+  tag: "27.0.0"
+  pullPolicy: IfNotPresent
+
+# the cron sidecar
+cron:
+  image:
+    registry: docker.io
+    repository: library/nextcloud
+    tag: 27.0.0-fpm   # keep in sync
+    digest: sha256:old
+
+metrics:
+  image: {repository: xperimental/nextcloud-exporter, tag: '0.6.0'}
+`
+
+func TestUpdateChartValuesImage(t *testing.T) {
+	target := Target{Owner: "owner", Repo: "charts", Branch: "main", Path: "charts/nextcloud/Chart.yaml"}
+	tests := []struct {
+		name        string
+		values      string
+		imagePath   string
+		dockerImage string
+		tag         string
+		want        string
+	}{
+		{
+			name:        "every matching image",
+			values:      testValues,
+			dockerImage: "nextcloud",
+			tag:         "27.1.0",
+			want: `# Default values for nextcloud.
+image:
+  repository: nextcloud # upstream image
+  tag: "27.1.0"
+  pullPolicy: IfNotPresent
+
+# the cron sidecar
+cron:
+  image:
+    registry: docker.io
+    repository: library/nextcloud
+    tag: 27.1.0   # keep in sync
+    digest: sha256:old
+
+metrics:
+  image: {repository: xperimental/nextcloud-exporter, tag: '0.6.0'}
+`,
+		},
+		{
+			name:      "image path in a flow mapping",
+			values:    testValues,
+			imagePath: "metrics.image",
+			tag:       "27.1.0",
+			want: `# Default values for nextcloud.
+image:
+  repository: nextcloud # upstream image
+  tag: "27.0.0"
+  pullPolicy: IfNotPresent
+
+# the cron sidecar
+cron:
+  image:
+    registry: docker.io
+    repository: library/nextcloud
+    tag: 27.0.0-fpm   # keep in sync
+    digest: sha256:old
+
+metrics:
+  image: {repository: xperimental/nextcloud-exporter, tag: '27.1.0'}
+`,
+		},
+		{
+			name:   "top level image without a docker image",
+			values: "image:\n  repository: nextcloud\n  tag:\n",
+			tag:    "27.1.0",
+			want:   "image:\n  repository: nextcloud\n  tag: 27.1.0\n",
+		},
+		{
+			name:   "plain tag read as a number is quoted",
+			values: "image:\n  repository: nextcloud\n  tag: 27.0\n",
+			tag:    "27.1",
+			want:   "image:\n  repository: nextcloud\n  tag: \"27.1\"\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &memBackend{files: map[string]string{"charts/nextcloud/values.yaml": tt.values}}
+			got, err := updateChartValuesImage(context.Background(), backend, target, "charts/nextcloud/values.yaml", tt.imagePath, tt.dockerImage, tt.tag, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("up to date", func(t *testing.T) {
+		backend := &memBackend{files: map[string]string{"charts/nextcloud/values.yaml": testValues}}
+		got, err := updateChartValuesImage(context.Background(), backend, target, "charts/nextcloud/values.yaml", "image.tag", "", "27.0.0", "")
+		if err != nil || got != nil {
+			t.Errorf("got %q, %v", got, err)
+		}
+	})
+	t.Run("no values.yaml", func(t *testing.T) {
+		got, err := updateChartValuesImage(context.Background(), &memBackend{}, target, "charts/nextcloud/values.yaml", "", "nextcloud", "27.1.0", "")
+		if err != nil || got != nil {
+			t.Errorf("got %q, %v", got, err)
+		}
+	})
+	t.Run("read error", func(t *testing.T) {
+		backend := &failingBackend{err: &StatusError{Method: "GET", URL: "values.yaml", StatusCode: 500, Status: "500 Internal Server Error"}}
+		if _, err := updateChartValuesImage(context.Background(), backend, target, "charts/nextcloud/values.yaml", "", "nextcloud", "27.1.0", ""); err == nil {
+			t.Error("no error for a failing read")
+		}
+	})
+	t.Run("missing image path", func(t *testing.T) {
+		backend := &memBackend{files: map[string]string{"charts/nextcloud/values.yaml": testValues}}
+		if _, err := updateChartValuesImage(context.Background(), backend, target, "charts/nextcloud/values.yaml", "server.image", "", "27.1.0", ""); err == nil {
+			t.Error("no error for a missing image path")
+		}
+	})
+}
+
+// failingBackend fails every read.
+type failingBackend struct {
+	memBackend
+	err error
+}
+
+func (b *failingBackend) ReadFile(ctx context.Context, t Target, path string) ([]byte, error) {
+	return nil, b.err
+}
+
+func TestImageTagLocationSet(t *testing.T) {
+	tests := []struct {
+		name       string
+		digest     string
+		digestMode string
+		imagePath  string
+		want       string
+	}{
+		{
+			name:       "tag mode",
+			digest:     "sha256:new",
+			digestMode: digestModeTag,
+			imagePath:  "image",
+			want: `# Default values for nextcloud.
+image:
+  repository: nextcloud # upstream image
+  tag: "27.1.0@sha256:new"
+  pullPolicy: IfNotPresent
+`,
+		},
+		{
+			name:       "field mode adds the digest",
+			digest:     "sha256:new",
+			digestMode: digestModeField,
+			imagePath:  "image",
+			want: `# Default values for nextcloud.
+image:
+  repository: nextcloud # upstream image
+  tag: "27.1.0"
+  digest: sha256:new
+  pullPolicy: IfNotPresent
+`,
+		},
+		{
+			name:       "field mode replaces the digest",
+			digest:     "sha256:new",
+			digestMode: digestModeField,
+			imagePath:  "cron.image",
+			want: `# the cron sidecar
+cron:
+  image:
+    registry: docker.io
+    repository: library/nextcloud
+    tag: 27.1.0   # keep in sync
+    digest: sha256:new
+`,
+		},
+		{
+			name:       "field mode drops a stale digest",
+			digestMode: digestModeField,
+			imagePath:  "cron.image",
+			want: `# the cron sidecar
+cron:
+  image:
+    registry: docker.io
+    repository: library/nextcloud
+    tag: 27.1.0   # keep in sync
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := `# Default values for nextcloud.
+image:
+  repository: nextcloud # upstream image
+  tag: "27.0.0"
+  pullPolicy: IfNotPresent
+`
+			if tt.imagePath == "cron.image" {
+				values = `# the cron sidecar
+cron:
+  image:
+    registry: docker.io
+    repository: library/nextcloud
+    tag: 27.0.0-fpm   # keep in sync
+    digest: sha256:old
+`
+			}
+			edit, err := newValuesEdit([]byte(values))
+			if err != nil {
+				t.Fatal(err)
+			}
+			locations, err := findValuesImageTags(&edit.root, tt.imagePath, "")
+			if err != nil || len(locations) != 1 {
+				t.Fatalf("locations %+v, %v", locations, err)
+			}
+			if err := locations[0].set(edit, "27.1.0", tt.digest, tt.digestMode); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(edit.bytes()); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindValuesImageTags(t *testing.T) {
+	edit, err := newValuesEdit([]byte(`image:
+  registry: ghcr.io
+  repository: linuxserver/sonarr
+  tag: "4.0.0"
+sidecars:
+- image:
+    repository: ghcr.io/linuxserver/sonarr
+    tag: 4.0.0
+- image:
+    repository: linuxserver/sonarr
+    tag: 4.0.0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	locations, err := findValuesImageTags(&edit.root, "", "ghcr.io/linuxserver/sonarr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, location := range locations {
+		paths = append(paths, location.path)
+	}
+	// the last sidecar is on Docker Hub
+	want := []string{"image.tag", "sidecars[0].image.tag"}
+	if len(paths) != len(want) || paths[0] != want[0] || paths[1] != want[1] {
+		t.Errorf("paths %v, want %v", paths, want)
+	}
+}
+
+func TestValuesEditMultiLine(t *testing.T) {
+	edit, err := newValuesEdit([]byte("image:\n  tag: |\n    4.0.0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	locations, err := findValuesImageTags(&edit.root, "image.tag", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := locations[0].set(edit, "4.1.0", "", ""); err == nil {
+		t.Error("no error for a block scalar")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// comparator is a single version comparison like ">=1.2.0".
+type comparator struct {
+	op      string
+	version string
+}
+
+// versionConstraint is a list of alternatives ("||") each of which is a list
+// of comparators that all have to match.
+type versionConstraint [][]comparator
+
+var (
+	// pre-release and build suffixes like the "-0" of helm's "~1.2.0-0" are
+	// accepted, versions are compared by their numeric part
+	comparatorRe     = regexp.MustCompile(`^(>=|<=|!=|>|<|=|~|\^)?\s*v?([0-9xX*]+(?:\.[0-9xX*]+)*)(?:-[0-9A-Za-z.-]+)?(?:\+[0-9A-Za-z.-]+)?$`)
+	numericVersionRe = regexp.MustCompile(`(\d+(?:\.\d+)*)`)
+)
+
+// parseConstraint parses constraints like "<5", ">=1.2.0 <1.3.0", "1.2.x",
+// "~1.2", "^2.0.0" or "1.2.3 || 1.2.5".
+func parseConstraint(constraint string) (versionConstraint, error) {
+	var c versionConstraint
+
+	for _, alternative := range strings.Split(constraint, "||") {
+		var comparators []comparator
+
+		// allow both "> 1.0" and ">1.0, <2.0"
+		fields := strings.Fields(strings.Replace(alternative, ",", " ", -1))
+		for i := 0; i < len(fields); i++ {
+			field := fields[i]
+			if strings.Trim(field, "<>=!~^") == "" && i+1 < len(fields) {
+				field += fields[i+1]
+				i++
+			}
+
+			m := comparatorRe.FindStringSubmatch(field)
+			if m == nil {
+				return nil, fmt.Errorf("invalid version constraint %q", field)
+			}
+			expanded, err := expandComparator(m[1], m[2])
+			if err != nil {
+				return nil, err
+			}
+			comparators = append(comparators, expanded...)
+		}
+
+		if len(comparators) == 0 {
+			return nil, fmt.Errorf("empty version constraint in %q", constraint)
+		}
+		c = append(c, comparators)
+	}
+
+	return c, nil
+}
+
+// expandComparator turns wildcards, tilde and caret ranges into plain
+// comparators.
+func expandComparator(op, version string) ([]comparator, error) {
+	parts := strings.Split(version, ".")
+	var fixed []int
+	for _, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q", version)
+		}
+		fixed = append(fixed, n)
+	}
+
+	lower := joinVersion(fixed)
+	partial := len(fixed) < len(parts) || (op == "" && len(fixed) < 3)
+
+	switch {
+	case len(fixed) == 0:
+		// "*" matches everything
+		return []comparator{{op: ">=", version: "0"}}, nil
+	case op == "~":
+		upper := bumpVersion(fixed, minInt(len(fixed)-1, 1))
+		if len(fixed) == 1 {
+			upper = bumpVersion(fixed, 0)
+		}
+		return []comparator{{op: ">=", version: lower}, {op: "<", version: upper}}, nil
+	case op == "^":
+		// bump the first non zero component
+		i := 0
+		for i < len(fixed)-1 && fixed[i] == 0 {
+			i++
+		}
+		return []comparator{{op: ">=", version: lower}, {op: "<", version: bumpVersion(fixed, i)}}, nil
+	case partial && (op == "" || op == "="):
+		return []comparator{{op: ">=", version: lower}, {op: "<", version: bumpVersion(fixed, len(fixed)-1)}}, nil
+	case partial && op == ">":
+		return []comparator{{op: ">=", version: bumpVersion(fixed, len(fixed)-1)}}, nil
+	case partial && op == "<=":
+		return []comparator{{op: "<", version: bumpVersion(fixed, len(fixed)-1)}}, nil
+	case op == "":
+		return []comparator{{op: "=", version: lower}}, nil
+	}
+	return []comparator{{op: op, version: lower}}, nil
+}
+
+func joinVersion(parts []int) string {
+	s := make([]string, len(parts))
+	for i, p := range parts {
+		s[i] = strconv.Itoa(p)
+	}
+	return strings.Join(s, ".")
+}
+
+// bumpVersion increments component i and drops everything after it.
+func bumpVersion(parts []int, i int) string {
+	bumped := append([]int{}, parts[:i+1]...)
+	bumped[i]++
+	return joinVersion(bumped)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// comparableVersion reduces a version like "v1.2.3-alpine" to its numeric
+// part "1.2.3" so compareVersions can deal with it.
+func comparableVersion(version string) string {
+	return numericVersionRe.FindString(version)
+}
+
+// matches reports whether version satisfies the constraint.
+func (c versionConstraint) matches(version string) bool {
+	version = comparableVersion(version)
+	for _, alternative := range c {
+		matched := true
+		for _, comp := range alternative {
+			cmp := compareVersions(version, comp.version)
+			switch comp.op {
+			case ">=":
+				matched = cmp >= 0
+			case "<=":
+				matched = cmp <= 0
+			case ">":
+				matched = cmp > 0
+			case "<":
+				matched = cmp < 0
+			case "!=":
+				matched = cmp != 0
+			default:
+				matched = cmp == 0
+			}
+			if !matched {
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// VersionRules are the version related settings of a dependency.
+type VersionRules struct {
+	Ignore        []versionConstraint
+	Allowed       versionConstraint
+	SeparateMajor bool
+	MinAge        time.Duration
+}
+
+// versionCandidate is a published version of a dependency.
+type versionCandidate struct {
+	version   string
+	published time.Time
+}
+
+// versionSelection is the outcome of selectVersion. Latest and Major are
+// indexes into the candidates or -1.
+type versionSelection struct {
+	Latest  int
+	Major   int
+	Pending []PendingVersion
+	Skipped []string
+}
+
+// majorOf returns the first component of a version.
+func majorOf(version string) int {
+	major, _ := strconv.Atoi(strings.Split(comparableVersion(version), ".")[0])
+	return major
+}
+
+// selectVersion picks the newest candidate newer than current the rules
+// allow. With SeparateMajor a newer major version is reported in Major and
+// Latest stays within the current major line.
+func selectVersion(current string, candidates []versionCandidate, rules VersionRules) versionSelection {
+	selection := versionSelection{Latest: -1, Major: -1}
+
+	order := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return compareVersions(comparableVersion(candidates[order[a]].version), comparableVersion(candidates[order[b]].version)) > 0
+	})
+
+	for _, i := range order {
+		candidate := candidates[i]
+
+		// nothing older than what we run is of interest
+		if current != "" && compareVersions(comparableVersion(candidate.version), comparableVersion(current)) <= 0 {
+			break
+		}
+
+		ignored := false
+		for _, ignore := range rules.Ignore {
+			if ignore.matches(candidate.version) {
+				ignored = true
+			}
+		}
+		if ignored {
+			selection.Skipped = append(selection.Skipped, candidate.version+" (ignored)")
+			continue
+		}
+		if rules.Allowed != nil && !rules.Allowed.matches(candidate.version) {
+			selection.Skipped = append(selection.Skipped, candidate.version+" (not allowed)")
+			continue
+		}
+
+		if !isOldEnough(candidate.published, rules.MinAge) {
+			selection.Pending = append(selection.Pending, PendingVersion{Version: candidate.version, Published: candidate.published})
+			continue
+		}
+
+		isMajor := current != "" && majorOf(candidate.version) > majorOf(current)
+		if isMajor && rules.SeparateMajor {
+			if selection.Major == -1 {
+				selection.Major = i
+			}
+			continue
+		}
+
+		selection.Latest = i
+		break
+	}
+
+	return selection
+}
+
+// printSelection logs the versions selectVersion held back or skipped.
+func printSelection(ctx context.Context, name string, selection versionSelection, minAge time.Duration) {
+	log := logger(ctx)
+	for _, p := range selection.Pending {
+		log.Info("pending", "name", name, "version", p.Version,
+			"published", p.Published.Format(time.RFC3339), "eligible", p.Published.Add(minAge).Format(time.RFC3339))
+	}
+	for _, skipped := range selection.Skipped {
+		log.Info("skipped", "name", name, "version", skipped)
+	}
+}
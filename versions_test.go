@@ -0,0 +1,159 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExpandComparator(t *testing.T) {
+	tests := []struct {
+		op      string
+		version string
+		want    []comparator
+	}{
+		{"", "1.2.3", []comparator{{"=", "1.2.3"}}},
+		{"", "1.2", []comparator{{">=", "1.2"}, {"<", "1.3"}}},
+		{"", "1.x", []comparator{{">=", "1"}, {"<", "2"}}},
+		{"=", "1.2.x", []comparator{{">=", "1.2"}, {"<", "1.3"}}},
+		{"", "*", []comparator{{">=", "0"}}},
+		{"~", "1.2.3", []comparator{{">=", "1.2.3"}, {"<", "1.3"}}},
+		{"~", "1.2", []comparator{{">=", "1.2"}, {"<", "1.3"}}},
+		{"~", "1", []comparator{{">=", "1"}, {"<", "2"}}},
+		{"^", "1.2.3", []comparator{{">=", "1.2.3"}, {"<", "2"}}},
+		{"^", "0.2.3", []comparator{{">=", "0.2.3"}, {"<", "0.3"}}},
+		{"^", "0.0.3", []comparator{{">=", "0.0.3"}, {"<", "0.0.4"}}},
+		{">", "1.2.x", []comparator{{">=", "1.3"}}},
+		{"<=", "1.2.x", []comparator{{"<", "1.3"}}},
+		{">", "1.2", []comparator{{">", "1.2"}}},
+		{">=", "1.2", []comparator{{">=", "1.2"}}},
+		{"<", "5", []comparator{{"<", "5"}}},
+		{"!=", "1.2.3", []comparator{{"!=", "1.2.3"}}},
+	}
+	for _, tt := range tests {
+		got, err := expandComparator(tt.op, tt.version)
+		if err != nil {
+			t.Errorf("%s%s: %v", tt.op, tt.version, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s%s: got %v, want %v", tt.op, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestParseConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		match      []string
+		noMatch    []string
+	}{
+		{"<5", []string{"4.9.9", "v4.0.0"}, []string{"5.0.0", "5.1"}},
+		{">=1.2.0 <1.3.0", []string{"1.2.0", "1.2.9"}, []string{"1.1.9", "1.3.0"}},
+		{">= 1.2.0, < 1.3.0", []string{"1.2.5"}, []string{"1.3.0"}},
+		{"1.2.x", []string{"1.2.0", "1.2.10"}, []string{"1.3.0", "1.1.9"}},
+		{"~1.2", []string{"1.2.0", "1.2.7"}, []string{"1.3.0"}},
+		{"~17.11.0", []string{"17.11.0", "17.11.3"}, []string{"17.12.0", "18.0.0"}},
+		{"^2.0.0", []string{"2.0.0", "2.9.1"}, []string{"1.9.9", "3.0.0"}},
+		{"^0.4.1", []string{"0.4.1", "0.4.9"}, []string{"0.5.0", "0.4.0"}},
+		{"1.2.3 || 1.2.5", []string{"1.2.3", "1.2.5"}, []string{"1.2.4"}},
+		{"*", []string{"0.0.1", "99.0.0"}, nil},
+		{"!=1.2.3", []string{"1.2.4"}, []string{"1.2.3"}},
+		// helm's way to let a range take pre-releases, the suffix is ignored
+		{"~17.11.0-0", []string{"17.11.3"}, []string{"17.12.0"}},
+		{">=1.0.0-rc.1+build.5", []string{"1.0.0", "1.0.1"}, []string{"0.9.0"}},
+		// versions are compared by their numeric part, a pre-release counts
+		// as its release
+		{"<2.0.0", []string{"1.9.0-beta.1"}, []string{"2.0.0-rc.1"}},
+		{"10.8.10", []string{"10.8.10-alpine", "v10.8.10"}, []string{"10.8.11"}},
+	}
+	for _, tt := range tests {
+		c, err := parseConstraint(tt.constraint)
+		if err != nil {
+			t.Errorf("%q: %v", tt.constraint, err)
+			continue
+		}
+		for _, v := range tt.match {
+			if !c.matches(v) {
+				t.Errorf("%q doesn't match %s", tt.constraint, v)
+			}
+		}
+		for _, v := range tt.noMatch {
+			if c.matches(v) {
+				t.Errorf("%q matches %s", tt.constraint, v)
+			}
+		}
+	}
+
+	for _, invalid := range []string{"", "latest", ">=", "1.2.3 ||", "1.a.3", "~>1.2"} {
+		if _, err := parseConstraint(invalid); err == nil {
+			t.Errorf("%q: no error", invalid)
+		}
+	}
+}
+
+func TestSelectVersion(t *testing.T) {
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	fresh := time.Now().Add(-time.Hour)
+	candidates := []versionCandidate{
+		{version: "1.2.0", published: old},
+		{version: "2.1.0", published: fresh},
+		{version: "1.3.0", published: old},
+		{version: "2.0.0", published: old},
+		{version: "1.2.1", published: old},
+	}
+	mustParse := func(constraint string) versionConstraint {
+		c, err := parseConstraint(constraint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		current string
+		rules   VersionRules
+		latest  string
+		major   string
+		pending []string
+		skipped []string
+	}{
+		{name: "newest", current: "1.2.0", latest: "2.1.0"},
+		{name: "up to date", current: "2.1.0"},
+		{name: "no current version", latest: "2.1.0"},
+		{name: "minimum age", current: "1.2.0", rules: VersionRules{MinAge: 7 * 24 * time.Hour}, latest: "2.0.0", pending: []string{"2.1.0"}},
+		{name: "separate major", current: "1.2.0", rules: VersionRules{SeparateMajor: true}, latest: "1.3.0", major: "2.1.0"},
+		{name: "allowed", current: "1.2.0", rules: VersionRules{Allowed: mustParse("<2")}, latest: "1.3.0", skipped: []string{"2.1.0 (not allowed)", "2.0.0 (not allowed)"}},
+		{name: "ignored range", current: "1.2.0", rules: VersionRules{Ignore: []versionConstraint{mustParse(">=2.0.0 <2.2.0")}}, latest: "1.3.0", skipped: []string{"2.1.0 (ignored)", "2.0.0 (ignored)"}},
+		{name: "tilde", current: "1.2.0", rules: VersionRules{Allowed: mustParse("~1.2")}, latest: "1.2.1", skipped: []string{"2.1.0 (not allowed)", "2.0.0 (not allowed)", "1.3.0 (not allowed)"}},
+		{name: "nothing allowed", current: "1.2.0", rules: VersionRules{Allowed: mustParse("^1.2.2 <1.3.0")}, skipped: []string{"2.1.0 (not allowed)", "2.0.0 (not allowed)", "1.3.0 (not allowed)", "1.2.1 (not allowed)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selection := selectVersion(tt.current, candidates, tt.rules)
+			version := func(i int) string {
+				if i < 0 {
+					return ""
+				}
+				return candidates[i].version
+			}
+			if got := version(selection.Latest); got != tt.latest {
+				t.Errorf("latest %q, want %q", got, tt.latest)
+			}
+			if got := version(selection.Major); got != tt.major {
+				t.Errorf("major %q, want %q", got, tt.major)
+			}
+			var pending []string
+			for _, p := range selection.Pending {
+				pending = append(pending, p.Version)
+			}
+			if !reflect.DeepEqual(pending, tt.pending) {
+				t.Errorf("pending %v, want %v", pending, tt.pending)
+			}
+			if !reflect.DeepEqual(selection.Skipped, tt.skipped) {
+				t.Errorf("skipped %v, want %v", selection.Skipped, tt.skipped)
+			}
+		})
+	}
+}